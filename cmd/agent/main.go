@@ -1,19 +1,40 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
 	"log"
+	"maps"
 	agentconfig "metralert/config/agent"
 	"metralert/internal/agent"
+	"metralert/internal/mtls"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
 )
 
+var (
+	buildVersion string = "N/A"
+	buildDate    string = "N/A"
+	buildCommit  string = "N/A"
+)
+
+func PrintTags() {
+	fmt.Printf(`
+Build version: %s
+Build date: %s
+Build commit: %s
+	`, buildVersion, buildDate, buildCommit)
+}
+
 func main() {
 
+	PrintTags()
+
 	// shutdownCh := make(chan os.Signal, 1)
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 
@@ -40,10 +61,107 @@ func main() {
 		RateLimit: %d`,
 		cfg.ServerAddress, cfg.PollInterval, cfg.ReportInterval, cfg.RateLimit)
 
-	metricsAgent := agent.New(cfg.ServerAddress, cfg.PollInterval, cfg.ReportInterval, cfg.HashKey, sugar, true, cfg.CryptoKey)
-	metricsAgent.StartSendPostWorkers(cfg.RateLimit)
-	err = metricsAgent.SendAllMetrics(ctx, metricsAgent.CollectRuntimeMetrics(), metricsAgent.CollectGopsutilMetrics(), metricsAgent.WorkerChanIn, metricsAgent.WorkerChanOut)
+	var tlsConfig *tls.Config
+	if cfg.TLSEnabled() {
+		tlsConfig, err = mtls.ClientConfig(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey, cfg.TLSServerName)
+		if err != nil {
+			sugar.Fatalln("unable to configure tls:", err)
+		}
+	}
+
+	metricsAgent := agent.New(cfg.ServerAddress, cfg.PollInterval, cfg.ReportInterval, cfg.HashKey, sugar, true, cfg.CryptoKey, tlsConfig)
+	metricsAgent.Labels = agentLabels(cfg, sugar)
+	metricsAgent.Version = buildVersion
+	metricsAgent.ID, err = agent.LoadOrCreateID(cfg.IDFile)
+	if err != nil {
+		sugar.Fatalln("unable to get agent id:", err)
+	}
+	sugar.Infoln("Agent ID:", metricsAgent.ID)
+	if cfg.OutboxDir != "" {
+		metricsAgent.Outbox, err = agent.NewOutbox(cfg.OutboxDir, cfg.OutboxMaxSize, cfg.OutboxDropPolicy)
+		if err != nil {
+			sugar.Fatalln("unable to open outbox:", err)
+		}
+		sugar.Infow("Outbox opened", "dir", cfg.OutboxDir, "batches", metricsAgent.Outbox.Len(), "bytes", metricsAgent.Outbox.Size())
+	}
+
+	serverAddress := cfg.ServerAddress
+	if cfg.Transport == "grpc" {
+		serverAddress = cfg.GRPCAddress
+	}
+	realIP, err := agent.OutboundIP(serverAddress)
+	if err != nil {
+		sugar.Warnln("unable to determine agent address:", err)
+	} else {
+		metricsAgent.RealIP = realIP.String()
+	}
+	if cfg.Transport == "grpc" {
+		if err = metricsAgent.ConnectGRPC(cfg.GRPCAddress); err != nil {
+			sugar.Fatalln(err)
+		}
+		defer metricsAgent.CloseGRPC()
+	} else {
+		metricsAgent.StartSendPostWorkers(cfg.RateLimit)
+	}
+	for _, name := range cfg.Collectors {
+		collector, err := agent.NewCollector(name)
+		if err != nil {
+			sugar.Fatalln(err)
+		}
+		if pc, ok := collector.(*agent.ProcessCollector); ok {
+			if err = pc.Configure(cfg.ProcessPIDs, cfg.ProcessPIDFiles, cfg.ProcessNames); err != nil {
+				sugar.Fatalln(err)
+			}
+		}
+		interval := time.Duration(cfg.PollInterval) * time.Second
+		if seconds, ok := cfg.CollectorIntervals[name]; ok && seconds > 0 {
+			interval = time.Duration(seconds) * time.Second
+		}
+		metricsAgent.AddCollector(collector, interval)
+		sugar.Infow("Collector enabled", "collector", name, "interval", interval)
+	}
+	if len(cfg.Collectors) == 0 {
+		sugar.Warnln("no collectors enabled, available:", agent.CollectorNames())
+	}
+	if cfg.StatsDAddress != "" {
+		if err = metricsAgent.ListenStatsD(ctx, "udp", cfg.StatsDAddress); err != nil {
+			sugar.Fatalln(err)
+		}
+	}
+	if cfg.StatsDSocket != "" {
+		if err = metricsAgent.ListenStatsD(ctx, "unixgram", cfg.StatsDSocket); err != nil {
+			sugar.Fatalln(err)
+		}
+	}
+
+	err = metricsAgent.SendAllMetrics(ctx, metricsAgent.WorkerChanIn, metricsAgent.WorkerChanOut)
 	if err != nil {
 		sugar.Fatalln(err)
 	}
 }
+
+// agentLabels собирает метки агента: instance, если он задан, host и instance по умолчанию
+// при включенном HostLabels и метки из конфигурации. Метки из конфигурации имеют приоритет.
+func agentLabels(cfg agentconfig.Config, sugar *zap.SugaredLogger) map[string]string {
+	labels := make(map[string]string, len(cfg.Labels)+2)
+
+	instance := cfg.Instance
+	if cfg.HostLabels {
+		hostname, err := os.Hostname()
+		if err != nil {
+			sugar.Warnln("unable to get hostname:", err)
+		}
+		if hostname != "" {
+			labels["host"] = hostname
+		}
+		if instance == "" {
+			instance = hostname
+		}
+	}
+	if instance != "" {
+		labels["instance"] = instance
+	}
+
+	maps.Copy(labels, cfg.Labels)
+	return labels
+}
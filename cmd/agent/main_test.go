@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	agentconfig "metralert/config/agent"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAgentLabels(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	// без HostLabels метки добавляются только явно
+	assert.Empty(t, agentLabels(agentconfig.Config{}, sugar))
+	assert.Equal(t, map[string]string{"instance": "api-1", "env": "prod"},
+		agentLabels(agentconfig.Config{Instance: "api-1", Labels: map[string]string{"env": "prod"}}, sugar))
+
+	assert.Equal(t, map[string]string{"host": hostname, "instance": hostname},
+		agentLabels(agentconfig.Config{HostLabels: true}, sugar))
+
+	// метки из конфигурации имеют приоритет над автоматическими
+	labels := agentLabels(agentconfig.Config{
+		HostLabels: true,
+		Instance:   "api-1",
+		Labels:     map[string]string{"host": "lb", "instance": "api-2"},
+	}, sugar)
+	assert.Equal(t, map[string]string{"host": "lb", "instance": "api-2"}, labels)
+}
@@ -1,59 +1,462 @@
+// Command cryptogen generates, inspects and rotates the keys used to encrypt agent payloads
+// and generates the certificates used for mutual TLS between agents and the server.
+//
+// Usage:
+//
+//	cryptogen gen [--alg rsa-4096] [--format pkcs8] [--out .] [--private private.pem] [--public public.pem]
+//	cryptogen inspect FILE...
+//	cryptogen rotate --keyring-dir DIR [--public public.pem] [--alg rsa-4096] [--format pkcs8] [--keep 2]
+//	cryptogen certs [--out certs] [--hosts localhost,127.0.0.1] [--agents agent] [--days 365] [--ca-cert ca.pem --ca-key ca-key.pem]
 package main
 
 import (
-	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"metralert/internal/hybrid"
+	"metralert/internal/mtls"
+
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	algRSA2048   = "rsa-2048"
+	algRSA3072   = "rsa-3072"
+	algRSA4096   = "rsa-4096"
+	algECDSAP256 = "ecdsa-p256"
+	algX25519    = "x25519"
 )
 
+var algorithms = []string{algRSA2048, algRSA3072, algRSA4096, algECDSAP256, algX25519}
+
+const usage = `Usage:
+  cryptogen gen [flags]       generate a key pair
+  cryptogen inspect FILE...   print the type, algorithm and key ID of PEM files
+  cryptogen rotate [flags]    add a new private key to the server keyring and replace the agent public key
+  cryptogen certs [flags]     generate a CA with server and agent certificates for mutual TLS
+
+Run "cryptogen COMMAND --help" for the flags of a command.
+`
+
 func main() {
+	log.SetFlags(0)
 
-	// создаём новый приватный RSA-ключ длиной 4096 бит
-	// для генерации ключа и сертификата
-	// используется rand.Reader в качестве источника случайных данных
-	privateKey, err := rsa.GenerateKey(rand.Reader, 9192)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "gen":
+		err = runGen(os.Args[2:], os.Stdout)
+	case "inspect":
+		err = runInspect(os.Args[2:], os.Stdout)
+	case "rotate":
+		err = runRotate(os.Args[2:], os.Stdout)
+	case "certs":
+		err = runCerts(os.Args[2:], os.Stdout)
+	case "-h", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	publicKey := privateKey.PublicKey
+}
 
-	// кодируем ключи в формате PEM, который
-	// используется для хранения и обмена криптографическими ключами
+// keyFlags are the flags shared by the gen and rotate commands.
+type keyFlags struct {
+	alg    string
+	format string
+}
 
-	var privateKeyPEM bytes.Buffer
-	err = pem.Encode(&privateKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	})
+func (kf *keyFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&kf.alg, "alg", algRSA4096, "key algorithm: "+strings.Join(algorithms, ", "))
+	fs.StringVar(&kf.format, "format", hybrid.FormatPKCS8, "key encoding: pkcs8 (PKCS#8 private, PKIX public) or pkcs1 (PKCS#1 RSA, SEC 1 ECDSA)")
+}
+
+// generate creates a key pair and encodes it. The key ID is written to the Key-ID PEM header of both keys.
+func (kf *keyFlags) generate() (privatePEM []byte, publicPEM []byte, keyID string, err error) {
+	if kf.format != hybrid.FormatPKCS8 && kf.format != hybrid.FormatPKCS1 {
+		return nil, nil, "", fmt.Errorf("unknown format %q", kf.format)
+	}
+
+	privateKey, err := generateKey(kf.alg)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, "", err
+	}
+	publicKey, err := hybrid.PublicKey(privateKey)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	keyID, err = hybrid.KeyID(publicKey)
+	if err != nil {
+		return nil, nil, "", err
 	}
 
-	var publicKeyPEM bytes.Buffer
-	err = pem.Encode(&publicKeyPEM, &pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: x509.MarshalPKCS1PublicKey(&publicKey),
+	headers := map[string]string{hybrid.KeyIDPEMHeader: keyID}
+	privatePEM, err = hybrid.EncodePrivateKeyPEM(privateKey, kf.format, headers)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	publicPEM, err = hybrid.EncodePublicKeyPEM(publicKey, kf.format, headers)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return privatePEM, publicPEM, keyID, nil
+}
+
+// generateKey creates a private key of the algorithm.
+func generateKey(alg string) (crypto.PrivateKey, error) {
+	switch alg {
+	case algRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case algRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case algRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case algECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case algX25519:
+		return ecdh.X25519().GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q, expected one of %s", alg, strings.Join(algorithms, ", "))
+	}
+}
+
+// runGen generates a key pair into the output directory.
+func runGen(args []string, out io.Writer) error {
+	var (
+		kf          keyFlags
+		dir         string
+		privateName string
+		publicName  string
+	)
+	fs := flag.NewFlagSet("gen", flag.ContinueOnError)
+	kf.register(fs)
+	fs.StringVar(&dir, "out", ".", "output directory")
+	fs.StringVar(&privateName, "private", "private.pem", "private key file name, used by the server --crypto-key")
+	fs.StringVar(&publicName, "public", "public.pem", "public key file name, used by the agent --crypto-key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	privatePEM, publicPEM, keyID, err := kf.generate()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	privatePath := filepath.Join(dir, privateName)
+	publicPath := filepath.Join(dir, publicName)
+	// закрытый ключ доступен только владельцу
+	if err = writeFile(privatePath, privatePEM, 0600); err != nil {
+		return err
+	}
+	if err = writeFile(publicPath, publicPEM, 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Generated %s key %s\n  private: %s\n  public:  %s\n", kf.alg, keyID, privatePath, publicPath)
+	return nil
+}
+
+// runRotate writes a new private key named after its key ID into the server keyring directory,
+// replaces the agent public key and removes the oldest private keys beyond --keep.
+// The server picks the new key up on SIGHUP or when it notices the file change.
+func runRotate(args []string, out io.Writer) error {
+	var (
+		kf         keyFlags
+		keyringDir string
+		publicPath string
+		keep       int
+	)
+	fs := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	kf.register(fs)
+	fs.StringVar(&keyringDir, "keyring-dir", "", "server keyring directory (the server --crypto-key)")
+	fs.StringVar(&publicPath, "public", "public.pem", "agent public key file to replace")
+	fs.IntVar(&keep, "keep", 2, "number of newest private keys to keep in the keyring, 0 keeps all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if keyringDir == "" {
+		return errors.New("--keyring-dir is required")
+	}
+
+	privatePEM, publicPEM, keyID, err := kf.generate()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(keyringDir, 0700); err != nil {
+		return err
+	}
+	privatePath := filepath.Join(keyringDir, keyID+".pem")
+	if err = writeFile(privatePath, privatePEM, 0600); err != nil {
+		return err
+	}
+	// открытый ключ заменяется после добавления закрытого, чтобы сервер мог расшифровать первые же пакеты
+	if err = writeFile(publicPath, publicPEM, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Added %s key %s\n  private: %s\n  public:  %s\n", kf.alg, keyID, privatePath, publicPath)
+
+	if keep <= 0 {
+		return nil
+	}
+	removed, err := pruneKeyring(keyringDir, keep)
+	for _, file := range removed {
+		fmt.Fprintf(out, "Removed old private key %s\n", file)
+	}
+	return err
+}
+
+// pruneKeyring removes all but the keep newest private keys of the directory.
+func pruneKeyring(dir string, keep int) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	type keyFile struct {
+		path    string
+		modTime int64
+	}
+	var keys []keyFile
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = hybrid.ParsePrivateKeyPEM(data); err != nil {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, keyFile{path: file, modTime: info.ModTime().UnixNano()})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].modTime > keys[j].modTime
 	})
+
+	var removed []string
+	for i := keep; i < len(keys); i++ {
+		if err = os.Remove(keys[i].path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, keys[i].path)
+	}
+	return removed, nil
+}
+
+// runCerts generates a self-signed CA, a server certificate and agent certificates for local setups and tests.
+// With --ca-cert and --ca-key the certificates are issued by an existing CA instead.
+func runCerts(args []string, out io.Writer) error {
+	var (
+		dir    string
+		hosts  []string
+		agents []string
+		days   int
+		caCert string
+		caKey  string
+	)
+	fs := flag.NewFlagSet("certs", flag.ContinueOnError)
+	fs.StringVar(&dir, "out", "certs", "output directory")
+	fs.StringSliceVar(&hosts, "hosts", []string{"localhost", "127.0.0.1"}, "server host names and IP addresses, empty to skip the server certificate")
+	fs.StringSliceVar(&agents, "agents", []string{"agent"}, "common names of the agent certificates")
+	fs.IntVar(&days, "days", 365, "certificate validity in days")
+	fs.StringVar(&caCert, "ca-cert", "", "existing CA certificate used to issue the certificates")
+	fs.StringVar(&caKey, "ca-key", "", "private key of the existing CA")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (caCert == "") != (caKey == "") {
+		return errors.New("--ca-cert and --ca-key must be set together")
+	}
+	validity := time.Duration(days) * 24 * time.Hour
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var (
+		ca  *mtls.Certificate
+		err error
+	)
+	if caCert != "" {
+		ca, err = mtls.LoadCertificate(caCert, caKey)
+		if err != nil {
+			return err
+		}
+	} else {
+		ca, err = mtls.NewCA("metralert CA", validity)
+		if err != nil {
+			return err
+		}
+		if err = writeCertificate(out, ca, filepath.Join(dir, "ca")); err != nil {
+			return err
+		}
+	}
+
+	if len(hosts) > 0 {
+		server, err := ca.IssueServer(hosts[0], hosts, validity)
+		if err != nil {
+			return err
+		}
+		if err = writeCertificate(out, server, filepath.Join(dir, "server")); err != nil {
+			return err
+		}
+	}
+	for _, name := range agents {
+		agent, err := ca.IssueClient(name, validity)
+		if err != nil {
+			return err
+		}
+		if err = writeCertificate(out, agent, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCertificate writes the certificate to <base>.pem and its private key to <base>-key.pem.
+func writeCertificate(out io.Writer, cert *mtls.Certificate, base string) error {
+	keyPEM, err := cert.KeyPEM()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err = writeFile(base+"-key.pem", keyPEM, 0600); err != nil {
+		return err
+	}
+	if err = writeFile(base+".pem", cert.CertPEM(), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Generated certificate %q valid until %s\n  cert: %s.pem\n  key:  %s-key.pem\n",
+		cert.Cert.Subject.CommonName, cert.Cert.NotAfter.Format(time.DateOnly), base, base)
+	return nil
+}
+
+// runInspect prints every PEM block of the files.
+func runInspect(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("no files to inspect")
 	}
 
-	// Сохраняем сертификат и приватный ключ в файлы private.pem и public.pem
-	wDir, err := os.Getwd()
+	for _, file := range fs.Args() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s:\n", file)
+		found := false
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			found = true
+			fmt.Fprintf(out, "  %s\n", describeBlock(block))
+		}
+		if !found {
+			fmt.Fprintln(out, "  no PEM blocks found")
+		}
+	}
+	return nil
+}
+
+// describeBlock returns a one line description of a PEM block.
+func describeBlock(block *pem.Block) string {
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Sprintf("%s: %v", block.Type, err)
+		}
+		return fmt.Sprintf("%s %q issued by %q, CA %t, valid until %s, DNS %v, IP %v", block.Type,
+			cert.Subject.CommonName, cert.Issuer.CommonName, cert.IsCA, cert.NotAfter.Format(time.DateOnly), cert.DNSNames, cert.IPAddresses)
+	}
+
+	encoded := pem.EncodeToMemory(block)
+	encoding := map[string]string{
+		"RSA PRIVATE KEY": "PKCS#1",
+		"RSA PUBLIC KEY":  "PKCS#1",
+		"EC PRIVATE KEY":  "SEC 1",
+		"PRIVATE KEY":     "PKCS#8",
+		"PUBLIC KEY":      "PKIX",
+	}[block.Type]
+
+	var (
+		key    any
+		public crypto.PublicKey
+		err    error
+	)
+	if privateKey, perr := hybrid.ParsePrivateKeyPEM(encoded); perr == nil {
+		key = privateKey
+		public, err = hybrid.PublicKey(privateKey)
+	} else if publicKey, perr := hybrid.ParsePublicKeyPEM(encoded); perr == nil {
+		key, public = publicKey, publicKey
+	} else {
+		return fmt.Sprintf("%s: %v", block.Type, perr)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Sprintf("%s: %v", block.Type, err)
 	}
 
-	if err = os.WriteFile(filepath.Join(wDir, "private.pem"), privateKeyPEM.Bytes(), 0644); err != nil {
-		log.Fatal(err)
+	keyID, err := hybrid.KeyID(public)
+	if err != nil {
+		return fmt.Sprintf("%s: %v", block.Type, err)
+	}
+	description := fmt.Sprintf("%s (%s) %s, key ID %s", block.Type, encoding, hybrid.Describe(key), keyID)
+	if header := block.Headers[hybrid.KeyIDPEMHeader]; header != "" && header != keyID {
+		description += fmt.Sprintf(", WARNING: Key-ID header %s does not match the key", header)
+	}
+	return description
+}
+
+// writeFile atomically replaces the file, so a reloading server never reads a partially written key.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(tmp.Name())
 
-	if err = os.WriteFile(filepath.Join(wDir, "public.pem"), publicKeyPEM.Bytes(), 0644); err != nil {
-		log.Fatal(err)
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
 	}
+	return os.Rename(tmp.Name(), path)
 }
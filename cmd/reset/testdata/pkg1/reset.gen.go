@@ -3,20 +3,15 @@
 
 package metrics
 
-
 func (rs *ResetableStruct) Reset() {
 	if rs == nil {
 		return
 	}
 	rs.i = 0
 	rs.str = ""
-	if rs.strP != nil {
-		*rs.strP = ""
-	}
+	rs.strP = nil
 	rs.s = rs.s[:0]
 	clear(rs.m)
-	var rsInterface interface{} = ResetableStruct{}
-	if resetter, ok := rsInterface.(interface{ Reset() }); ok && rs.child != nil {
-		resetter.Reset()
-	}
+	rs.child = nil
+
 }
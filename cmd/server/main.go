@@ -4,11 +4,17 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"metralert/internal/alert"
+	"metralert/internal/mtls"
+	"metralert/internal/notify"
 	"metralert/internal/server"
+	"metralert/internal/sign"
 	"metralert/internal/storage"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	serverconfig "metralert/config/server"
 
@@ -43,22 +49,78 @@ func main() {
 	defer logger.Sync()
 	sugar := logger.Sugar()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = runMigrate(os.Args[2:], os.Stdout, sugar); err != nil {
+			sugar.Fatalln("migration failed:", err)
+		}
+		return
+	}
+
 	cfg := serverconfig.Config{}
 	err = cfg.GetConfig()
 	if err != nil {
 		sugar.Fatalln("unable to get config :", err)
 	}
 
-	storage := storage.NewStorage(cfg.FileStoragePath, cfg.Restore, cfg.DatabaseAddress, sugar)
+	pgOptions := storage.PgOptions{
+		MaxConns:         int32(cfg.DatabaseMaxConns),
+		StatementTimeout: time.Duration(cfg.DatabaseStatementTimeout) * time.Second,
+	}
+	storage := storage.NewStorage(cfg.FileStoragePath, cfg.Restore, cfg.DatabaseAddress, pgOptions, sugar)
 
 	sugar.Infow("Config applied",
 		"cfg", cfg)
 	go storage.BackupService(cfg.StoreInterval)
+	go storage.CompactionService(cfg.HistoryRetention, cfg.CompactInterval)
 	server := server.New(cfg.ServerAddress, storage, cfg.HashKey, sugar, cfg.CryptoKey)
+	server.PrometheusLabels = cfg.PrometheusLabels
+	server.RejectLegacyEncryption = cfg.RejectLegacyEncryption
+	server.HashVerifier = sign.NewVerifier(cfg.HashKey, cfg.StrictHash, time.Duration(cfg.HashMaxSkew)*time.Second, cfg.NonceCacheSize)
+	if cfg.StrictHash && cfg.HashKey == "" {
+		sugar.Warnln("strict hash mode has no effect without a hash key")
+	}
+	if cfg.TLSCert != "" {
+		server.TLSConfig, err = mtls.ServerConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+		if err != nil {
+			sugar.Fatalln("unable to configure tls:", err)
+		}
+	}
+	server.Agents.SetStaleIntervals(cfg.AgentStaleIntervals)
+	if cfg.TrustedSubnet != "" {
+		_, server.TrustedSubnet, err = net.ParseCIDR(cfg.TrustedSubnet)
+		if err != nil {
+			sugar.Fatalln("invalid trusted subnet:", err)
+		}
+	}
+	server.Alerts, err = alert.NewEngine(cfg.AlertRules)
+	if err != nil {
+		sugar.Fatalln("invalid alert rules:", err)
+	}
 	go server.Start()
+	if cfg.GRPCAddress != "" {
+		go server.StartGRPC(cfg.GRPCAddress)
+	}
 	go server.AuditLogger(cfg.AuditFile, cfg.AuditURL)
 
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go server.KeyringReloader(ctx, reloadCh, time.Duration(cfg.KeyReloadInterval)*time.Second)
+
+	var sinks []notify.Sink
+	if cfg.NotifyWebhookURL != "" {
+		sinks = append(sinks, notify.NewWebhookSink(cfg.NotifyWebhookURL))
+	}
+	if cfg.NotifyFile != "" {
+		sinks = append(sinks, notify.NewFileSink(cfg.NotifyFile))
+	}
+	if cfg.NotifySMTPRelay != "" {
+		sinks = append(sinks, notify.NewSMTPSink(cfg.NotifySMTPRelay, cfg.NotifySMTPFrom, cfg.NotifySMTPTo))
+	}
+	dispatcher := notify.NewDispatcher(sinks, cfg.NotifyRetries, time.Duration(cfg.NotifyRepeatInterval)*time.Second, sugar)
+	go server.AlertNotifier(ctx, dispatcher)
+
 	<-ctx.Done()
+	server.ShutdownGRPC()
 	server.Shutdown()
 	storage.Shutdown()
 
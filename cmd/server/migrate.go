@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"metralert/internal/storage/migrations"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	flag "github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+const migrateUsage = `Usage:
+  server migrate [flags] up            apply all pending migrations
+  server migrate [flags] down [N]      roll back the last N migrations, 1 by default
+  server migrate [flags] to VERSION    migrate the schema to VERSION, 0 drops all tables
+  server migrate [flags] status        print the applied migrations
+
+Flags:
+`
+
+// runMigrate выполняет подкоманду migrate.
+// DSN базы берется из флага -d или переменной окружения DATABASE_DSN.
+func runMigrate(args []string, out io.Writer, logger *zap.SugaredLogger) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dsn := fs.StringP("database-dsn", "d", os.Getenv("DATABASE_DSN"), "database dsn")
+	timeout := fs.Duration("timeout", 5*time.Minute, "timeout of the whole migration run")
+	fs.Usage = func() {
+		fmt.Fprint(out, migrateUsage)
+		fs.SetOutput(out)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("migrate command is missing")
+	}
+	if *dsn == "" {
+		return errors.New("database dsn is not set")
+	}
+
+	db, err := sql.Open("pgx", *dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrations.New(db, logger)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	switch command {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(rest) > 0 {
+			if steps, err = strconv.Atoi(rest[0]); err != nil {
+				return fmt.Errorf("invalid number of steps %q", rest[0])
+			}
+		}
+		return migrator.Down(ctx, steps)
+	case "to":
+		if len(rest) == 0 {
+			return errors.New("schema version is missing")
+		}
+		version, err := strconv.Atoi(rest[0])
+		if err != nil {
+			return fmt.Errorf("invalid schema version %q", rest[0])
+		}
+		return migrator.To(ctx, version)
+	case "status":
+		applied, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, a := range applied {
+			fmt.Fprintf(out, "%03d %s applied at %s\n", a.Version, a.Name, a.AppliedAt.Format(time.RFC3339))
+		}
+		current := 0
+		if len(applied) > 0 {
+			current = applied[len(applied)-1].Version
+		}
+		fmt.Fprintf(out, "current version %d, latest %d\n", current, migrator.Latest())
+		return nil
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown migrate command %q", command)
+	}
+}
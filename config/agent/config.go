@@ -2,9 +2,11 @@ package agentconfig
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -19,13 +21,47 @@ type Config struct {
 	RateLimit      int
 	CryptoKey      string
 	ConfigFile     string
+	Instance       string
+	IDFile         string
+	Labels         map[string]string
+	// HostLabels — добавлять ко всем метрикам метки host (имя хоста) и instance (по умолчанию имя хоста)
+	HostLabels bool
+	// Transport — протокол отправки метрик: http или grpc
+	Transport   string
+	GRPCAddress string
+	// TLSCA — CA для проверки сертификата сервера; если задан, метрики отправляются по HTTPS или gRPC по TLS
+	TLSCA string
+	// TLSCert, TLSKey — сертификат и ключ агента для взаимной аутентификации
+	TLSCert string
+	TLSKey  string
+	// TLSServerName — имя сервера для проверки сертификата, если оно отличается от адреса
+	TLSServerName string
+	// OutboxDir — каталог очереди неотправленных пакетов; пустая строка отключает очередь
+	OutboxDir string
+	// OutboxMaxSize — максимальный размер очереди в байтах, 0 — без ограничения
+	OutboxMaxSize int64
+	// OutboxDropPolicy — что удалять при переполнении очереди: oldest или newest
+	OutboxDropPolicy string
+	// Collectors — включенные сборщики метрик
+	Collectors []string
+	// CollectorIntervals — интервалы опроса отдельных сборщиков в секундах, по умолчанию PollInterval
+	CollectorIntervals map[string]int
+	// ProcessPIDs, ProcessPIDFiles, ProcessNames — процессы, наблюдаемые сборщиком process:
+	// PID, pid-файлы и регулярные выражения для имени процесса
+	ProcessPIDs     []int32
+	ProcessPIDFiles []string
+	ProcessNames    []string
+	// StatsDAddress — UDP адрес приема метрик в формате StatsD; пустая строка отключает прием
+	StatsDAddress string
+	// StatsDSocket — Unix-сокет приема метрик в формате StatsD; пустая строка отключает прием
+	StatsDSocket string
 }
 
 func (cfg *Config) GetConfig() error {
 
 	logger, err := zap.NewDevelopment()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer logger.Sync()
 	sugar := logger.Sugar()
@@ -46,6 +82,26 @@ func (cfg *Config) GetConfig() error {
 	flag.IntP("rate-limit", "l", 0, "rate limit")
 	flag.String("crypto-key", "", "Public Key")
 	flag.StringP("config", "c", "", "configuration file")
+	flag.String("id-file", "agent_id", "file storing the persistent agent id")
+	flag.String("instance", "", "instance label attached to all metrics, hostname with --host-labels")
+	flag.Bool("host-labels", false, "attach host and instance labels to all metrics")
+	flag.StringToString("labels", nil, "extra labels attached to all metrics, e.g. env=prod,dc=msk")
+	flag.String("transport", "http", "transport used to send metrics: http or grpc")
+	flag.String("grpc-address", "localhost:3200", "grpc server address used with --transport=grpc")
+	flag.String("tls-ca", "", "CA bundle used to verify the server certificate, enables TLS")
+	flag.String("tls-cert", "", "agent TLS certificate file presented to the server")
+	flag.String("tls-key", "", "agent TLS private key file")
+	flag.String("tls-server-name", "", "server name expected in the server certificate")
+	flag.String("outbox-dir", "", "directory of the on-disk queue of unsent batches, empty disables the queue")
+	flag.Int64("outbox-max-size", 100<<20, "maximum size of the outbox in bytes, 0 for unlimited")
+	flag.String("outbox-drop-policy", "oldest", "batches dropped when the outbox is full: oldest or newest")
+	flag.StringSlice("collectors", []string{"runtime", "gopsutil"}, "enabled metric collectors")
+	flag.StringToString("collector-intervals", nil, "poll intervals of individual collectors, e.g. gopsutil=10s,runtime=2")
+	flag.StringSlice("process-pids", nil, "pids of processes watched by the process collector")
+	flag.StringSlice("process-pidfiles", nil, "pid files of processes watched by the process collector")
+	flag.StringSlice("process-names", nil, "name patterns (regular expressions) of processes watched by the process collector")
+	flag.String("statsd-address", "", "udp address of the statsd listener, e.g. 127.0.0.1:8125, empty disables it")
+	flag.String("statsd-socket", "", "unix datagram socket of the statsd listener, empty disables it")
 	flag.Parse()
 
 	err = viper.BindPFlags(flag.CommandLine)
@@ -76,18 +132,61 @@ func (cfg *Config) GetConfig() error {
 	cfg.RateLimit = viper.GetInt("rate-limit")
 	cfg.CryptoKey = viper.GetString("crypto-key")
 	cfg.ConfigFile = viper.GetString("config")
+	cfg.IDFile = viper.GetString("id-file")
+	cfg.Instance = viper.GetString("instance")
+	cfg.Labels = viper.GetStringMapString("labels")
+	cfg.HostLabels = viper.GetBool("host-labels")
+	cfg.Transport = viper.GetString("transport")
+	cfg.GRPCAddress = viper.GetString("grpc-address")
+	cfg.TLSCA = viper.GetString("tls-ca")
+	cfg.TLSCert = viper.GetString("tls-cert")
+	cfg.TLSKey = viper.GetString("tls-key")
+	cfg.TLSServerName = viper.GetString("tls-server-name")
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+	cfg.OutboxDir = viper.GetString("outbox-dir")
+	cfg.OutboxMaxSize = viper.GetInt64("outbox-max-size")
+	cfg.OutboxDropPolicy = viper.GetString("outbox-drop-policy")
+	if cfg.Transport != "http" && cfg.Transport != "grpc" {
+		return fmt.Errorf("unknown transport %q", cfg.Transport)
+	}
+
+	cfg.Collectors = viper.GetStringSlice("collectors")
+	cfg.CollectorIntervals = make(map[string]int)
+	for name, interval := range viper.GetStringMapString("collector-intervals") {
+		cfg.CollectorIntervals[name], err = IntervalNormalize(interval)
+		if err != nil {
+			return fmt.Errorf("invalid poll interval of collector %s: %w", name, err)
+		}
+	}
+
+	for _, pid := range viper.GetStringSlice("process-pids") {
+		v, err := strconv.ParseInt(pid, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid process pid %q: %w", pid, err)
+		}
+		cfg.ProcessPIDs = append(cfg.ProcessPIDs, int32(v))
+	}
+	cfg.ProcessPIDFiles = viper.GetStringSlice("process-pidfiles")
+	cfg.ProcessNames = viper.GetStringSlice("process-names")
+	cfg.StatsDAddress = viper.GetString("statsd-address")
+	cfg.StatsDSocket = viper.GetString("statsd-socket")
 
-	cfg.ReportInterval, err = IntervalNormalize(viper.Get("report-interval"))
+	cfg.ReportInterval, err = intervalOption("report-interval")
 	if err != nil {
 		return err
 	}
-	cfg.PollInterval, err = IntervalNormalize(viper.Get("poll-interval"))
+	cfg.PollInterval, err = intervalOption("poll-interval")
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// IntervalNormalize приводит интервал в секундах к int. Поддерживаются строки вида "300" и "300s",
+// целые числа, числа с плавающей точкой без дробной части (так json конфиг декодирует числа)
+// и time.Duration.
 func IntervalNormalize(v any) (int, error) {
 	switch v := v.(type) {
 	case string:
@@ -99,6 +198,32 @@ func IntervalNormalize(v any) (int, error) {
 		return vi, nil
 	case int:
 		return v, nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("interval %v is not a whole number of seconds", v)
+		}
+		return int(v), nil
+	case time.Duration:
+		return int(v / time.Second), nil
 	}
-	return 0, errors.New("unknown type")
+	return 0, fmt.Errorf("unsupported interval type %T", v)
+}
+
+// intervalOption читает интервал в секундах из параметра key конфигурации.
+func intervalOption(key string) (int, error) {
+	v, err := IntervalNormalize(viper.Get(key))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return v, nil
+}
+
+// TLSEnabled сообщает, нужно ли подключаться к серверу по TLS:
+// задан CA, сертификат агента или адрес сервера со схемой https.
+func (cfg *Config) TLSEnabled() bool {
+	return cfg.TLSCA != "" || cfg.TLSCert != "" || strings.HasPrefix(cfg.ServerAddress, "https://")
 }
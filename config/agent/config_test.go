@@ -0,0 +1,37 @@
+package agentconfig
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntervalNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   any
+		want    int
+		wantErr bool
+	}{
+		{name: "int", value: 300, want: 300},
+		{name: "string", value: "300", want: 300},
+		{name: "string with unit", value: "300s", want: 300},
+		{name: "json number", value: float64(600), want: 600},
+		{name: "duration", value: 90 * time.Second, want: 90},
+		{name: "fractional json number", value: 1.5, wantErr: true},
+		{name: "invalid string", value: "5m", wantErr: true},
+		{name: "unsupported type", value: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := IntervalNormalize(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
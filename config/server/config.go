@@ -2,9 +2,13 @@ package config
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"time"
+
+	"metralert/internal/alert"
 
 	flag "github.com/spf13/pflag"
 
@@ -14,6 +18,7 @@ import (
 
 type Config struct {
 	ServerAddress   string
+	GRPCAddress     string
 	StoreInterval   int
 	FileStoragePath string
 	Restore         bool
@@ -23,13 +28,50 @@ type Config struct {
 	AuditURL        string
 	CryptoKey       string
 	ConfigFile      string
+	// TLSCert, TLSKey — сертификат и ключ сервера; если заданы, сервер принимает только HTTPS и gRPC по TLS
+	TLSCert string
+	TLSKey  string
+	// TLSClientCA — CA для проверки сертификатов агентов; если задан, агенты без сертификата отклоняются
+	TLSClientCA string
+	// KeyReloadInterval — интервал проверки изменения файлов закрытых ключей в секундах, 0 отключает проверку
+	KeyReloadInterval int
+	// RejectLegacyEncryption — отклонять тела, зашифрованные напрямую RSA PKCS#1 v1.5 старыми агентами
+	RejectLegacyEncryption bool
+	// StrictHash — при заданном ключе требовать подпись с отметкой времени и nonce у всех запросов с телом
+	StrictHash bool
+	// HashMaxSkew — допустимое расхождение времени подписи с часами сервера в секундах
+	HashMaxSkew int
+	// NonceCacheSize — количество запоминаемых nonce для защиты от повторной отправки
+	NonceCacheSize int
+	// TrustedSubnet — подсеть в формате CIDR, из которой принимаются метрики; пустая строка отключает проверку
+	TrustedSubnet string
+	// HistoryRetention — срок хранения истории метрик в секундах
+	HistoryRetention int
+	CompactInterval  int
+	AlertRules       []alert.Rule
+	// PrometheusLabels — постоянные метки для /metrics
+	PrometheusLabels map[string]string
+	// AgentStaleIntervals — сколько интервалов отправки агент может пропустить, прежде чем считаться неактивным
+	AgentStaleIntervals int
+	// DatabaseMaxConns — максимальное количество соединений пула PostgreSQL, 0 — значение pgxpool по умолчанию
+	DatabaseMaxConns int
+	// DatabaseStatementTimeout — таймаут операции с базой данных в секундах
+	DatabaseStatementTimeout int
+
+	NotifyWebhookURL     string
+	NotifyFile           string
+	NotifySMTPRelay      string
+	NotifySMTPFrom       string
+	NotifySMTPTo         []string
+	NotifyRetries        int
+	NotifyRepeatInterval int
 }
 
 func (cfg *Config) GetConfig() error {
 
 	logger, err := zap.NewDevelopment()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer logger.Sync()
 	sugar := logger.Sugar()
@@ -43,14 +85,37 @@ func (cfg *Config) GetConfig() error {
 	// flags
 	flag.StringP("config", "c", "", "json config file")
 	flag.StringP("address", "a", "", "server url")
+	flag.String("grpc-address", "", "grpc server address, empty disables grpc")
 	flag.IntP("store-interval", "i", 300, "file swap interval")
 	flag.StringP("file-storage-path", "f", "metrics_database.json", "filename to store metrics")
 	flag.BoolP("restore", "r", false, "restore metrics on startup")
 	flag.StringP("database-dsn", "d", "", "database dsn")
+	flag.Int("database-max-conns", 0, "maximum size of the database connection pool, 0 uses the pgxpool default")
+	flag.Int("database-statement-timeout", 3, "timeout of a database operation in seconds")
 	flag.StringP("key", "k", "", "hash key")
+	flag.Bool("strict-hash", false, "require signed requests with timestamp and nonce when the hash key is set")
+	flag.Int("hash-max-skew", 300, "allowed difference between the signature timestamp and the server clock in seconds")
+	flag.Int("nonce-cache-size", 100000, "number of remembered signature nonces used to reject replayed requests")
 	flag.String("audit-file", "", "path of a file to store audit logs")
 	flag.String("audit-url", "", "path of a file to store audit logs")
-	flag.String("crypto-key", "", "private key")
+	flag.String("crypto-key", "", "private key file or directory of *.pem private keys")
+	flag.String("tls-cert", "", "server TLS certificate file, enables HTTPS and gRPC over TLS")
+	flag.String("tls-key", "", "server TLS private key file")
+	flag.String("tls-client-ca", "", "CA bundle used to verify agent certificates, requires client certificates")
+	flag.Int("key-reload-interval", 30, "interval in seconds to check private key files for changes, 0 disables the check")
+	flag.Bool("reject-legacy-encryption", false, "reject bodies encrypted with plain RSA PKCS#1 v1.5 instead of the hybrid envelope")
+	flag.StringP("trusted-subnet", "t", "", "trusted agent subnet in CIDR notation, empty allows any address")
+	flag.Int("history-retention", 86400, "retention period of metric history in seconds, 0 keeps history forever")
+	flag.Int("compact-interval", 600, "history compaction interval in seconds")
+	flag.Int("agent-stale-intervals", 3, "number of missed report intervals after which an agent is marked stale")
+	flag.StringToString("prometheus-labels", nil, "constant labels added to /metrics samples, e.g. env=prod,dc=msk")
+	flag.String("notify-webhook-url", "", "webhook url for alert notifications")
+	flag.String("notify-file", "", "path of a file to append alert notifications")
+	flag.String("notify-smtp-relay", "", "smtp relay address (host:port) for alert notifications")
+	flag.String("notify-smtp-from", "metralert@localhost", "sender address of alert emails")
+	flag.StringSlice("notify-smtp-to", nil, "recipients of alert emails")
+	flag.Int("notify-retries", 3, "number of retries per notification sink")
+	flag.Int("notify-repeat-interval", 0, "interval to repeat firing notifications, 0 disables repeats")
 	flag.Parse()
 
 	err = viper.BindPFlags(flag.CommandLine)
@@ -77,22 +142,81 @@ func (cfg *Config) GetConfig() error {
 	}
 
 	cfg.ServerAddress = viper.GetString("address")
+	cfg.GRPCAddress = viper.GetString("grpc-address")
 	cfg.FileStoragePath = viper.GetString("file-storage-path")
 	cfg.Restore = viper.GetBool("restore")
 	cfg.DatabaseAddress = viper.GetString("database-dsn")
+	cfg.DatabaseMaxConns = viper.GetInt("database-max-conns")
 	cfg.HashKey = viper.GetString("key")
+	cfg.StrictHash = viper.GetBool("strict-hash")
+	cfg.NonceCacheSize = viper.GetInt("nonce-cache-size")
 	cfg.AuditFile = viper.GetString("audit-file")
 	cfg.AuditURL = viper.GetString("audit-url")
 	cfg.CryptoKey = viper.GetString("crypto-key")
+	cfg.RejectLegacyEncryption = viper.GetBool("reject-legacy-encryption")
 	cfg.ConfigFile = viper.GetString("config")
+	cfg.TLSCert = viper.GetString("tls-cert")
+	cfg.TLSKey = viper.GetString("tls-key")
+	cfg.TLSClientCA = viper.GetString("tls-client-ca")
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+	if cfg.TLSClientCA != "" && cfg.TLSCert == "" {
+		return errors.New("tls-client-ca requires tls-cert and tls-key")
+	}
+	// флаг, переменная TRUSTED_SUBNET или ключ trusted-subnet json конфига, как и остальные параметры
+	if viper.IsSet("trusted-subnet") {
+		cfg.TrustedSubnet = viper.GetString("trusted-subnet")
+	}
+	cfg.AgentStaleIntervals = viper.GetInt("agent-stale-intervals")
+	cfg.PrometheusLabels = viper.GetStringMapString("prometheus-labels")
+	cfg.NotifyWebhookURL = viper.GetString("notify-webhook-url")
+	cfg.NotifyFile = viper.GetString("notify-file")
+	cfg.NotifySMTPRelay = viper.GetString("notify-smtp-relay")
+	cfg.NotifySMTPFrom = viper.GetString("notify-smtp-from")
+	cfg.NotifySMTPTo = viper.GetStringSlice("notify-smtp-to")
+	cfg.NotifyRetries = viper.GetInt("notify-retries")
+
+	// правила алертинга задаются только в json конфиге
+	err = viper.UnmarshalKey("alerts", &cfg.AlertRules)
+	if err != nil {
+		return err
+	}
 
 	cfg.StoreInterval, err = IntervalNormalize(viper.GetInt("store-interval"))
 	if err != nil {
 		return err
 	}
+	cfg.HistoryRetention, err = intervalOption("history-retention")
+	if err != nil {
+		return err
+	}
+	cfg.CompactInterval, err = intervalOption("compact-interval")
+	if err != nil {
+		return err
+	}
+	cfg.NotifyRepeatInterval, err = intervalOption("notify-repeat-interval")
+	if err != nil {
+		return err
+	}
+	cfg.HashMaxSkew, err = intervalOption("hash-max-skew")
+	if err != nil {
+		return err
+	}
+	cfg.KeyReloadInterval, err = intervalOption("key-reload-interval")
+	if err != nil {
+		return err
+	}
+	cfg.DatabaseStatementTimeout, err = intervalOption("database-statement-timeout")
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// IntervalNormalize приводит интервал в секундах к int. Поддерживаются строки вида "300" и "300s",
+// целые числа, числа с плавающей точкой без дробной части (так json конфиг декодирует числа)
+// и time.Duration.
 func IntervalNormalize(v any) (int, error) {
 	switch v := v.(type) {
 	case string:
@@ -104,6 +228,26 @@ func IntervalNormalize(v any) (int, error) {
 		return vi, nil
 	case int:
 		return v, nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("interval %v is not a whole number of seconds", v)
+		}
+		return int(v), nil
+	case time.Duration:
+		return int(v / time.Second), nil
+	}
+	return 0, fmt.Errorf("unsupported interval type %T", v)
+}
+
+// intervalOption читает интервал в секундах из параметра key конфигурации.
+func intervalOption(key string) (int, error) {
+	v, err := IntervalNormalize(viper.Get(key))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
 	}
-	return 0, errors.New("unknown type")
+	return v, nil
 }
@@ -4,22 +4,26 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"maps"
+	"metralert/internal/hybrid"
 	"metralert/internal/metrics"
+	pb "metralert/internal/proto"
+	"metralert/internal/sign"
 	"net/http"
 	"net/url"
-	"runtime"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -36,14 +40,8 @@ type Agent struct {
 	pollInterval int
 	// reportInterval - интервал отправки метрик в секундах.
 	reportInterval int
-	// pollCount - счетчик опросов.
-	pollCount metrics.Counter
-	// mutex - мьютекс для синхронизации доступа к memoryStatistics.
-	mutex sync.Mutex
-	// memoryStatistics - слайс собранных метрик.
-	memoryStatistics []metrics.Metrics
-	// rtm - структура для хранения статистики памяти Go runtime.
-	rtm runtime.MemStats
+	// collectors - сборщики метрик, добавленные AddCollector.
+	collectors []*collectorRunner
 	// client - HTTP клиент для отправки запросов.
 	client http.Client
 	// logger - логгер для записи логов.
@@ -60,6 +58,26 @@ type Agent struct {
 		err      error
 	}
 	PublicKeyPath string
+	// Labels - метки, добавляемые ко всем отправляемым метрикам (host, instance и т.д.).
+	Labels map[string]string
+	// ID - постоянный идентификатор агента, передается серверу в заголовке X-Agent-ID.
+	ID string
+	// Version - версия сборки агента.
+	Version string
+	// RealIP - адрес агента, передается серверу в заголовке X-Real-IP для проверки доверенной подсети.
+	RealIP string
+	// grpcConn - соединение с gRPC сервером, если выбран транспорт grpc.
+	grpcConn *grpc.ClientConn
+	// grpcClient - клиент gRPC сервиса Metrics.
+	grpcClient pb.MetricsClient
+	// tlsConfig - настройки TLS для HTTPS и gRPC, nil если TLS не используется.
+	tlsConfig *tls.Config
+	// Outbox - очередь неотправленных пакетов на диске, nil если очередь не используется.
+	Outbox *Outbox
+	// counters - приращения счетчиков, еще не подтвержденные сервером.
+	counters *counterTracker
+	// statsd - значения gauge и множества, полученные ListenStatsD.
+	statsd *statsdValues
 }
 
 // New создает новый экземпляр Agent.
@@ -69,9 +87,15 @@ type Agent struct {
 // hashKey - ключ для вычисления хеша тела запроса.
 // logger - логгер для записи логов.
 // batch - флаг, указывающий, использовать ли пакетную отправку метрик.
-func New(address string, pollInterval int, reportInterval int, hashKey string, logger *zap.SugaredLogger, batch bool, publicKeyPath string) *Agent {
+// publicKeyPath - путь к открытому ключу для шифрования тела запроса.
+// tlsConfig - настройки TLS (CA сервера и сертификат агента), nil для HTTP без TLS.
+func New(address string, pollInterval int, reportInterval int, hashKey string, logger *zap.SugaredLogger, batch bool, publicKeyPath string, tlsConfig *tls.Config) *Agent {
 	if !strings.Contains(address, "http") {
-		address = "http://" + address
+		if tlsConfig != nil {
+			address = "https://" + address
+		} else {
+			address = "http://" + address
+		}
 	}
 	destinationAddress, err := url.ParseRequestURI(address)
 	if err != nil {
@@ -79,6 +103,7 @@ func New(address string, pollInterval int, reportInterval int, hashKey string, l
 	}
 	transport := &http.Transport{
 		DisableCompression: false,
+		TLSClientConfig:    tlsConfig,
 	}
 
 	retryClient := *retryablehttp.NewClient()
@@ -98,20 +123,19 @@ func New(address string, pollInterval int, reportInterval int, hashKey string, l
 	}, metricsMax)
 
 	return &Agent{
-		BaseURL:          destinationAddress.String(),
-		pollInterval:     pollInterval,
-		reportInterval:   reportInterval,
-		pollCount:        metrics.Counter(0),
-		mutex:            sync.Mutex{},
-		memoryStatistics: []metrics.Metrics{},
-		rtm:              runtime.MemStats{},
-		client:           standardClient,
-		logger:           logger,
-		batch:            batch,
-		hashKey:          hashKey,
-		WorkerChanIn:     workerChanIn,
-		WorkerChanOut:    workerChanOut,
-		PublicKeyPath:    publicKeyPath,
+		BaseURL:        destinationAddress.String(),
+		pollInterval:   pollInterval,
+		reportInterval: reportInterval,
+		client:         standardClient,
+		logger:         logger,
+		batch:          batch,
+		hashKey:        hashKey,
+		WorkerChanIn:   workerChanIn,
+		WorkerChanOut:  workerChanOut,
+		PublicKeyPath:  publicKeyPath,
+		tlsConfig:      tlsConfig,
+		counters:       newCounterTracker(),
+		statsd:         newStatsDValues(),
 	}
 }
 
@@ -178,13 +202,14 @@ func (a *Agent) SendPostWorker(id int, jobs chan metrics.Metrics, results chan s
 
 		req.Header.Set("Content-Encoding", "gzip")
 		req.Header.Add("Content-Type", "application/json")
+		a.setAgentHeaders(req)
 
-		if a.hashKey != "" {
-			h := hmac.New(sha256.New, []byte(a.hashKey))
-			h.Write(compressedBody)
-			hash := hex.EncodeToString(h.Sum(nil))
-			req.Header.Add("Hash", hash)
-			a.logger.Infof("Hash is %s", hash)
+		if err = a.signRequest(req, compressedBody); err != nil {
+			results <- struct {
+				response *http.Response
+				err      error
+			}{nil, err}
+			continue
 		}
 
 		resp, err := a.client.Do(req)
@@ -205,111 +230,221 @@ func (a *Agent) SendPostWorker(id int, jobs chan metrics.Metrics, results chan s
 	}
 }
 
-// SendAllMetrics отправляет все собранные метрики на сервер.
-// ctx - контекст для управления жизненным циклом функции.
-// memIn - канал для получения метрик из runtime.
-// gopsIn - канал для получения метрик из gopsutil.
-// workerIn - канал для передачи метрик воркерам.
-// workerOut - канал для получения результатов от воркеров.
-// Возвращает ошибку, если отправка метрик не удалась.
-func (a *Agent) SendAllMetrics(ctx context.Context, memIn chan []metrics.Metrics, gopsIn chan []metrics.Metrics, workerIn chan metrics.Metrics, workerOut chan struct {
-	response *http.Response
-	err      error
-}) error {
-	memoryStatistics := make([]metrics.Metrics, 0)
+// setAgentHeaders добавляет в запрос идентификатор, версию, интервал отправки и адрес агента.
+func (a *Agent) setAgentHeaders(req *http.Request) {
+	if a.ID != "" {
+		req.Header.Set(agentIDHeader, a.ID)
+	}
+	if a.Version != "" {
+		req.Header.Set(agentVersionHeader, a.Version)
+	}
+	req.Header.Set(agentReportIntervalHeader, strconv.Itoa(a.reportInterval))
+	if a.RealIP != "" {
+		req.Header.Set(realIPHeader, a.RealIP)
+	}
+}
 
-	// горутина поддерживает pollinterval
-	pollTicker := time.NewTicker(time.Duration(a.pollInterval) * time.Second)
-	reportTicker := time.NewTicker(time.Duration(a.reportInterval) * time.Second)
+// signRequest подписывает тело запроса ключом агента.
+// Подпись вычисляется по времени, случайному nonce и телу, все три передаются в заголовках,
+// поэтому сервер может отклонить повторно отправленный запрос.
+func (a *Agent) signRequest(req *http.Request, body []byte) error {
+	if a.hashKey == "" {
+		return nil
+	}
+	stamp, err := sign.NewStamp()
+	if err != nil {
+		return fmt.Errorf("unable to sign request: %w", err)
+	}
+	stamp.SetHeader(req.Header)
+	req.Header.Set(sign.HashHeader, sign.Sum(a.hashKey, stamp, body))
+	return nil
+}
 
-	go func(memoryStatistics *[]metrics.Metrics) {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-pollTicker.C:
-				memoryMetrics := make([]metrics.Metrics, 0)
-				runtimeMetrics := <-memIn
-				gopsutilMetrics := <-gopsIn
-				memoryMetrics = append(memoryMetrics, runtimeMetrics...)
-				memoryMetrics = append(memoryMetrics, gopsutilMetrics...)
-				*memoryStatistics = memoryMetrics
-			}
+// applyLabels добавляет метки агента к метрикам, не перезаписывая уже заданные.
+func (a *Agent) applyLabels(ms []metrics.Metrics) {
+	if len(a.Labels) == 0 {
+		return
+	}
+	for i := range ms {
+		if len(ms[i].Labels) == 0 {
+			ms[i].Labels = a.Labels
+			continue
 		}
-	}(&memoryStatistics)
+		labels := maps.Clone(a.Labels)
+		maps.Copy(labels, ms[i].Labels)
+		ms[i].Labels = labels
+	}
+}
 
-	SendMetrics := func() error {
-		if a.batch {
-			endpoint := a.BaseURL + batchUpdatePath
-			if len(memoryStatistics) == 0 {
-				return nil
-			}
-			jsonData, err := json.Marshal(memoryStatistics)
-			if err != nil {
-				a.logger.Fatalw("unable to marshal []metric")
-			}
+// deliver отправляет пакет метрик на сервер.
+// Если задана очередь Outbox, сначала по порядку отправляются сохраненные в ней пакеты,
+// а при недоступности сервера пакет сохраняется в очередь для повторной отправки.
+// Недоступность сервера и отклонение пакета сервером не считаются ошибкой.
+// Возвращает true, если сервер принял пакет или пакет сохранен в очередь.
+func (a *Agent) deliver(ms []metrics.Metrics) (bool, error) {
+	var err error
+	if a.Outbox != nil {
+		var sent int
+		sent, err = a.Outbox.Replay(a.sendBatch, func(seq uint64, err error) {
+			a.logger.Warnw("Outbox batch dropped", "seq", seq, "error", err)
+		})
+		if sent > 0 {
+			a.logger.Infow("Outbox batches sent", "sent", sent, "left", a.Outbox.Len())
+		}
+	}
+	if err == nil {
+		err = a.sendBatch(ms)
+	}
 
-			compressedBody, err := gzipCompress(jsonData)
-			if err != nil {
-				a.logger.Fatalw("Unable to compress body")
-			}
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrBatchRejected):
+		a.logger.Warnw("Batch rejected by server", "error", err)
+		return false, nil
+	case errors.Is(err, ErrServerUnavailable):
+		if a.Outbox == nil || len(ms) == 0 {
+			a.logger.Infow("Server unreachable", "error", err)
+			return false, nil
+		}
+		dropped, pushErr := a.Outbox.Push(ms)
+		if pushErr != nil {
+			a.logger.Errorw("Server unreachable, unable to save batch to outbox", "error", err, "outbox_error", pushErr)
+			return false, nil
+		}
+		if dropped > 0 {
+			a.logger.Warnw("Outbox is full, oldest batches dropped", "dropped", dropped)
+		}
+		a.logger.Infow("Server unreachable, batch saved to outbox", "error", err, "batches", a.Outbox.Len(), "bytes", a.Outbox.Size())
+		return true, nil
+	default:
+		return false, err
+	}
+}
 
-			Data := compressedBody
+// sendBatch отправляет пакет метрик по gRPC или HTTP.
+// Возвращает ErrServerUnavailable, если пакет нужно отправить повторно,
+// и ErrBatchRejected, если сервер отклонил пакет.
+func (a *Agent) sendBatch(ms []metrics.Metrics) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	if a.grpcClient != nil {
+		return a.sendGRPC(ms)
+	}
+	return a.sendHTTPBatch(ms)
+}
 
-			if a.PublicKeyPath != "" {
-				EncrypredData, err := RetrieveEncrypt(Data, a.PublicKeyPath)
-				if err != nil {
-					return err
-				}
-				Data = EncrypredData
-			}
+// sendHTTPBatch отправляет пакет метрик на /updates/.
+func (a *Agent) sendHTTPBatch(ms []metrics.Metrics) error {
+	endpoint := a.BaseURL + batchUpdatePath
+	jsonData, err := json.Marshal(ms)
+	if err != nil {
+		return fmt.Errorf("unable to marshal metrics: %w", err)
+	}
 
-			compressedBodyReader := bytes.NewReader(Data)
+	compressedBody, err := gzipCompress(jsonData)
+	if err != nil {
+		return fmt.Errorf("unable to compress body: %w", err)
+	}
 
-			req, err := http.NewRequest("POST", endpoint, compressedBodyReader)
-			if err != nil {
-				a.logger.Fatalw("Unable to form request")
-			}
+	Data := compressedBody
 
-			req.Header.Set("Content-Encoding", "gzip")
-			req.Header.Add("Content-Type", "application/json")
+	var keyID string
+	if a.PublicKeyPath != "" {
+		publicKey, id, err := LoadPublicKey(a.PublicKeyPath)
+		if err != nil {
+			return err
+		}
+		EncrypredData, err := hybrid.Seal(publicKey, Data)
+		if err != nil {
+			return err
+		}
+		Data = EncrypredData
+		keyID = id
+	}
 
-			if a.hashKey != "" {
-				buf, err := io.ReadAll(bytes.NewReader(compressedBody))
-				if err != nil {
-					a.logger.Warnf("read body error: %w", err)
-				}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(Data))
+	if err != nil {
+		return fmt.Errorf("unable to form request: %w", err)
+	}
 
-				h := hmac.New(sha256.New, []byte(a.hashKey))
-				h.Write(buf)
-				req.Header.Add("Hash", hex.EncodeToString(h.Sum(nil)))
-			}
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Add("Content-Type", "application/json")
+	a.setAgentHeaders(req)
+	if keyID != "" {
+		req.Header.Set(hybrid.KeyIDHeader, keyID)
+	}
 
-			resp, err := a.client.Do(req)
-			if err != nil {
-				a.logger.Infow("Server unreachable", err)
-				return nil
+	// подписывается тело в том виде, в котором оно передается,
+	// так как сервер проверяет подпись до расшифровки
+	if err = a.signRequest(req, Data); err != nil {
+		return err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		// retryablehttp возвращает ошибку и при ответах 5xx после всех попыток
+		return fmt.Errorf("%w: %w", ErrServerUnavailable, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: status %d", ErrServerUnavailable, resp.StatusCode)
+	case resp.StatusCode >= http.StatusBadRequest:
+		return fmt.Errorf("%w: status %d", ErrBatchRejected, resp.StatusCode)
+	}
+	a.logger.Infow("Batch Metrics sent successfully", "count", len(ms))
+	return nil
+}
+
+// SendAllMetrics запускает сборщики метрик и отправляет собранные метрики на сервер.
+// ctx - контекст для управления жизненным циклом функции.
+// workerIn - канал для передачи метрик воркерам.
+// workerOut - канал для получения результатов от воркеров.
+// Возвращает ошибку, если отправка метрик не удалась.
+func (a *Agent) SendAllMetrics(ctx context.Context, workerIn chan metrics.Metrics, workerOut chan struct {
+	response *http.Response
+	err      error
+}) error {
+	for _, r := range a.collectors {
+		go a.runCollector(ctx, r)
+	}
+	reportTicker := time.NewTicker(time.Duration(a.reportInterval) * time.Second)
+	defer reportTicker.Stop()
+
+	SendMetrics := func() error {
+		batch := a.gauges()
+		counters := a.counters.Snapshot()
+		batch = append(batch, counters...)
+
+		if a.grpcClient != nil || a.batch {
+			acknowledged, err := a.deliver(batch)
+			if acknowledged {
+				a.counters.Commit(counters)
 			}
-			a.logger.Infow("Batch Metrics sent successfully")
-			defer resp.Body.Close()
+			return err
 		}
 
 		// single metric mode
-		if !a.batch {
-			for _, s := range memoryStatistics {
-				workerIn <- s
-				response := <-workerOut
-
-				if response.err != nil {
-					log.Printf("При отправке метрик произошла ошибка: %v", response.err)
-					continue
-				}
-				a.logger.Infow("Response received",
-					"status", response.response.StatusCode,
-					"Content-Type", response.response.Header.Get("Content-Type"),
-					"Content-Encoding", response.response.Header.Get("Content-Encoding"))
-				response.response.Body.Close()
+		for _, s := range batch {
+			workerIn <- s
+			response := <-workerOut
+
+			if response.err != nil {
+				log.Printf("При отправке метрик произошла ошибка: %v", response.err)
+				continue
+			}
+			if response.response.StatusCode == http.StatusOK {
+				a.counters.Commit([]metrics.Metrics{s})
 			}
+			a.logger.Infow("Response received",
+				"status", response.response.StatusCode,
+				"Content-Type", response.response.Header.Get("Content-Type"),
+				"Content-Encoding", response.response.Header.Get("Content-Encoding"))
+			response.response.Body.Close()
 		}
 		return nil
 	}
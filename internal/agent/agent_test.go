@@ -5,11 +5,13 @@ import (
 	"metralert/internal/server"
 	"metralert/internal/storage"
 	"net/http"
+	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
 
-	_ "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
@@ -77,15 +79,35 @@ func TestAgent_SendPost(t *testing.T) {
 			// }
 			logger, _ := zap.NewDevelopment()
 			sugar := logger.Sugar()
-			storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", logger.Sugar())
+			storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, logger.Sugar())
 
 			server := server.New(tt.fields.serverurl, storage, "", sugar, "")
 			go server.Start()
 			time.Sleep(time.Second * 3)
 
 			tt.args.metric.Value = (&tt.args.randValue)
-			a := New(tt.fields.agenturl, tt.fields.pollInterval, tt.fields.reportInterval, "1234567890123456", sugar, true, "")
+			a := New(tt.fields.agenturl, tt.fields.pollInterval, tt.fields.reportInterval, "1234567890123456", sugar, true, "", nil)
 			a.logger.Info("Agent created successfully", a)
 		})
 	}
 }
+
+func TestLoadOrCreateID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "agent_id")
+
+	id, err := LoadOrCreateID(path)
+	require.NoError(t, err)
+	assert.Len(t, id, 36)
+
+	again, err := LoadOrCreateID(path)
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+}
+
+func TestOutboundIP(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:8080", "http://127.0.0.1:8080", "127.0.0.1"} {
+		ip, err := OutboundIP(address)
+		require.NoError(t, err, address)
+		assert.True(t, ip.IsLoopback(), address)
+	}
+}
@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"metralert/internal/metrics"
+)
+
+// Collector - источник метрик агента.
+type Collector interface {
+	// Name возвращает имя сборщика, под которым он включается в конфигурации.
+	Name() string
+	// Collect собирает метрики. Счетчики возвращаются приращениями с предыдущего вызова.
+	// При частичном сбое сборщик может вернуть собранные метрики вместе с ошибкой.
+	// ctx отменяется, если сбор длится дольше интервала опроса сборщика.
+	Collect(ctx context.Context) ([]metrics.Metrics, error)
+}
+
+var (
+	// collectorsMutex - мьютекс для синхронизации доступа к collectorFactories.
+	collectorsMutex sync.RWMutex
+	// collectorFactories - зарегистрированные сборщики по имени, включая встроенные.
+	collectorFactories = map[string]func() Collector{
+		RuntimeCollectorName:  func() Collector { return &runtimeCollector{} },
+		GopsutilCollectorName: func() Collector { return newHostCollector() },
+		ProcessCollectorName:  func() Collector { return NewProcessCollector() },
+	}
+)
+
+// RegisterCollector регистрирует сборщик под именем name.
+// Если имя уже занято, возвращается ошибка, а зарегистрированный сборщик не меняется.
+func RegisterCollector(name string, factory func() Collector) error {
+	collectorsMutex.Lock()
+	defer collectorsMutex.Unlock()
+
+	if _, ok := collectorFactories[name]; ok {
+		return fmt.Errorf("collector %q is already registered", name)
+	}
+	collectorFactories[name] = factory
+	return nil
+}
+
+// NewCollector создает зарегистрированный сборщик по имени.
+func NewCollector(name string) (Collector, error) {
+	collectorsMutex.RLock()
+	defer collectorsMutex.RUnlock()
+
+	factory, ok := collectorFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown collector %q, available: %v", name, slices.Sorted(maps.Keys(collectorFactories)))
+	}
+	return factory(), nil
+}
+
+// CollectorNames возвращает отсортированные имена зарегистрированных сборщиков.
+func CollectorNames() []string {
+	collectorsMutex.RLock()
+	defer collectorsMutex.RUnlock()
+	return slices.Sorted(maps.Keys(collectorFactories))
+}
+
+// collectorRunner опрашивает сборщик со своим интервалом и хранит последние значения gauge.
+type collectorRunner struct {
+	collector Collector
+	interval  time.Duration
+	// mutex - мьютекс для синхронизации доступа к gauges.
+	mutex sync.Mutex
+	// gauges - значения gauge последнего успешного опроса.
+	gauges []metrics.Metrics
+}
+
+// AddCollector добавляет сборщик, опрашиваемый с интервалом interval.
+// При нулевом интервале используется общий интервал опроса агента.
+// Сборщики запускаются в SendAllMetrics.
+func (a *Agent) AddCollector(c Collector, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Duration(a.pollInterval) * time.Second
+	}
+	a.collectors = append(a.collectors, &collectorRunner{collector: c, interval: interval})
+}
+
+// runCollector опрашивает сборщик до отмены ctx.
+// Каждый сборщик работает в своей горутине, поэтому зависший или сбойный сборщик
+// не задерживает остальные сборщики и отправку метрик.
+func (a *Agent) runCollector(ctx context.Context, r *collectorRunner) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.poll(ctx, r)
+		}
+	}
+}
+
+// poll выполняет один опрос сборщика: счетчики добавляются к неподтвержденным приращениям,
+// значения gauge заменяют значения предыдущего опроса.
+func (a *Agent) poll(ctx context.Context, r *collectorRunner) {
+	name := r.collector.Name()
+	ms, err := collectSafely(ctx, r.collector, r.interval)
+	if err != nil {
+		a.logger.Warnw("Collector failed", "collector", name, "error", err, "collected", len(ms))
+	}
+	if len(ms) == 0 {
+		return
+	}
+	a.applyLabels(ms)
+
+	gauges := make([]metrics.Metrics, 0, len(ms))
+	for _, m := range ms {
+		if m.MType == "counter" {
+			a.counters.Add(m)
+			continue
+		}
+		gauges = append(gauges, m)
+	}
+
+	r.mutex.Lock()
+	r.gauges = gauges
+	r.mutex.Unlock()
+	a.logger.Debugw("Metrics collected", "collector", name, "number", len(ms))
+}
+
+// collectSafely вызывает Collect с ограничением времени и превращает панику сборщика в ошибку.
+func collectSafely(ctx context.Context, c Collector, timeout time.Duration) (ms []metrics.Metrics, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	defer func() {
+		if p := recover(); p != nil {
+			ms, err = nil, fmt.Errorf("collector panicked: %v", p)
+		}
+	}()
+	return c.Collect(ctx)
+}
+
+// gauges возвращает последние значения gauge всех сборщиков и полученные по StatsD.
+func (a *Agent) gauges() []metrics.Metrics {
+	var result []metrics.Metrics
+	for _, r := range a.collectors {
+		r.mutex.Lock()
+		result = append(result, r.gauges...)
+		r.mutex.Unlock()
+	}
+	return append(result, a.statsd.snapshot()...)
+}
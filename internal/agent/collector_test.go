@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"metralert/internal/metrics"
+
+	"github.com/shirou/gopsutil/v4/cpu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// funcCollector - сборщик для тестов, вызывающий функцию collect.
+type funcCollector struct {
+	name    string
+	collect func(ctx context.Context) ([]metrics.Metrics, error)
+}
+
+func (c *funcCollector) Name() string {
+	return c.name
+}
+
+func (c *funcCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	return c.collect(ctx)
+}
+
+func TestCollectorRegistry(t *testing.T) {
+	names := CollectorNames()
+	assert.Contains(t, names, RuntimeCollectorName)
+	assert.Contains(t, names, GopsutilCollectorName)
+
+	c, err := NewCollector(RuntimeCollectorName)
+	require.NoError(t, err)
+	assert.Equal(t, RuntimeCollectorName, c.Name())
+
+	_, err = NewCollector("unknown")
+	assert.Error(t, err)
+
+	err = RegisterCollector(RuntimeCollectorName, func() Collector { return &funcCollector{name: "other"} })
+	assert.Error(t, err)
+	c, err = NewCollector(RuntimeCollectorName)
+	require.NoError(t, err)
+	assert.IsType(t, &runtimeCollector{}, c, "duplicate registration does not replace the collector")
+}
+
+func TestRuntimeCollector(t *testing.T) {
+	c := &runtimeCollector{}
+	for range 2 {
+		ms, err := c.Collect(context.Background())
+		require.NoError(t, err)
+
+		found := map[string]metrics.Metrics{}
+		for _, m := range ms {
+			found[m.ID] = m
+		}
+		require.Contains(t, found, "PollCount")
+		assert.Equal(t, int64(1), *found["PollCount"].Delta, "counter is sent as the increment of a single poll")
+		assert.Contains(t, found, "HeapAlloc")
+		assert.Contains(t, found, "RandomValue")
+	}
+}
+
+func TestAgent_CollectorIsolation(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	a := New("localhost:8080", 1, 10, "", logger.Sugar(), true, "", nil)
+	a.Labels = map[string]string{"host": "test"}
+
+	value := 42.0
+	delta := int64(3)
+	a.AddCollector(&funcCollector{name: "ok", collect: func(context.Context) ([]metrics.Metrics, error) {
+		return []metrics.Metrics{
+			{ID: "Good", MType: "gauge", Value: &value},
+			{ID: "Events", MType: "counter", Delta: &delta},
+		}, nil
+	}}, 10*time.Millisecond)
+	a.AddCollector(&funcCollector{name: "failing", collect: func(context.Context) ([]metrics.Metrics, error) {
+		return nil, errors.New("device not found")
+	}}, 10*time.Millisecond)
+	a.AddCollector(&funcCollector{name: "panicking", collect: func(context.Context) ([]metrics.Metrics, error) {
+		var gauges map[string]float64
+		gauges["Broken"] = 1 // запись в nil map вызывает панику
+		return nil, nil
+	}}, 10*time.Millisecond)
+	a.AddCollector(&funcCollector{name: "partial", collect: func(context.Context) ([]metrics.Metrics, error) {
+		return []metrics.Metrics{{ID: "Partial", MType: "gauge", Value: &value}}, errors.New("one device failed")
+	}}, 10*time.Millisecond)
+	hung := make(chan struct{})
+	defer close(hung)
+	a.AddCollector(&funcCollector{name: "hanging", collect: func(context.Context) ([]metrics.Metrics, error) {
+		<-hung
+		return nil, nil
+	}}, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, r := range a.collectors {
+		go a.runCollector(ctx, r)
+	}
+
+	require.Eventually(t, func() bool {
+		return len(a.gauges()) == 2 && len(a.counters.Snapshot()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	gauges := a.gauges()
+	assert.Equal(t, "Good", gauges[0].ID)
+	assert.Equal(t, "test", gauges[0].Labels["host"])
+	assert.Equal(t, "Partial", gauges[1].ID)
+
+	// значения gauge не накапливаются, счетчики накапливаются между отправками
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, a.gauges(), 2)
+	assert.Greater(t, *a.counters.Snapshot()[0].Delta, delta)
+}
+
+func TestCPUUtilization(t *testing.T) {
+	prev := cpu.TimesStat{User: 10, System: 10, Idle: 80}
+	cur := cpu.TimesStat{User: 40, System: 20, Idle: 140}
+	assert.InDelta(t, 40.0, cpuUtilization(prev, cur), 1e-9)
+	assert.Zero(t, cpuUtilization(cur, cur), "no time passed between polls")
+	assert.InDelta(t, 20.0, cpuUtilization(cpu.TimesStat{}, prev), 1e-9, "first poll reports utilization since boot")
+}
+
+func TestHostCollector_Deltas(t *testing.T) {
+	c := newHostCollector()
+	labels := map[string]string{"interface": "eth0"}
+
+	c.totals = map[string]uint64{}
+	assert.Empty(t, c.appendDelta(nil, "NetBytesSent", 100, labels), "first poll only records the baseline")
+	c.prevTotals = c.totals
+
+	c.totals = map[string]uint64{}
+	ms := c.appendDelta(nil, "NetBytesSent", 150, labels)
+	require.Len(t, ms, 1)
+	assert.Equal(t, "counter", ms[0].MType)
+	assert.Equal(t, int64(50), *ms[0].Delta)
+	assert.Equal(t, "eth0", ms[0].Labels["interface"])
+	c.prevTotals = c.totals
+
+	c.totals = map[string]uint64{}
+	ms = c.appendDelta(nil, "NetBytesSent", 30, labels)
+	require.Len(t, ms, 1)
+	assert.Equal(t, int64(30), *ms[0].Delta, "counter reset is reported as the new value")
+}
+
+func TestHostCollector(t *testing.T) {
+	c := newHostCollector()
+	for range 2 {
+		// отдельные источники могут быть недоступны в песочнице, поэтому ошибка не проверяется
+		ms, _ := c.Collect(context.Background())
+
+		found := map[string]metrics.Metrics{}
+		for _, m := range ms {
+			found[m.ID] = m
+		}
+		require.Contains(t, found, "TotalMemory")
+		require.Contains(t, found, "FreeMemory")
+		assert.LessOrEqual(t, *found["FreeMemory"].Value, *found["TotalMemory"].Value)
+		require.Contains(t, found, "CPUutilization1")
+		assert.GreaterOrEqual(t, *found["CPUutilization1"].Value, 0.0)
+		assert.LessOrEqual(t, *found["CPUutilization1"].Value, 100.0)
+	}
+}
+
+func TestProcessCollector(t *testing.T) {
+	dir := t.TempDir()
+	self := int32(os.Getpid())
+	pidFile := filepath.Join(dir, "self.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(int(self))+"\n"), 0o600))
+	badPIDFile := filepath.Join(dir, "bad.pid")
+	require.NoError(t, os.WriteFile(badPIDFile, []byte("not a pid"), 0o600))
+
+	name, err := os.Executable()
+	require.NoError(t, err)
+
+	c := NewProcessCollector()
+	assert.Error(t, c.Configure(nil, nil, []string{"("}))
+	require.NoError(t, c.Configure(
+		[]int32{self},
+		[]string{pidFile, badPIDFile, filepath.Join(dir, "missing.pid")},
+		[]string{"^" + regexp.QuoteMeta(filepath.Base(name)) + "$"},
+	))
+
+	pids, errs := c.targets(context.Background())
+	assert.Equal(t, []int32{self}, pids, "process matched several times is collected once")
+	assert.Len(t, errs, 1, "missing pid file is not an error, invalid one is")
+
+	for range 2 {
+		ms, _ := c.Collect(context.Background())
+		found := map[string]metrics.Metrics{}
+		for _, m := range ms {
+			found[m.ID] = m
+		}
+		for _, id := range []string{"ProcessCount", "ProcessRSS", "ProcessCPUPercent", "ProcessThreads", "ProcessUptime", "ProcessOpenFDs"} {
+			require.Contains(t, found, id)
+			assert.NotContains(t, found[id].Labels, "pid")
+			assert.NotEmpty(t, found[id].Labels["process"])
+		}
+		assert.Equal(t, 1.0, *found["ProcessCount"].Value)
+		assert.Positive(t, *found["ProcessRSS"].Value)
+		assert.GreaterOrEqual(t, *found["ProcessCPUPercent"].Value, 0.0)
+	}
+	assert.Contains(t, c.prev, self)
+}
+
+func TestProcessCollector_SameName(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not available")
+	}
+	var pids []int32
+	for range 2 {
+		cmd := exec.Command(sleep, "30")
+		require.NoError(t, cmd.Start())
+		t.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+		pids = append(pids, int32(cmd.Process.Pid))
+	}
+
+	c := NewProcessCollector()
+	require.NoError(t, c.Configure(pids, nil, nil))
+	ms, err := c.Collect(context.Background())
+	require.NoError(t, err)
+
+	// процессы с одним именем передаются одним рядом без PID
+	found := map[string]metrics.Metrics{}
+	for _, m := range ms {
+		assert.Equal(t, map[string]string{"process": "sleep"}, m.Labels)
+		found[m.ID] = m
+	}
+	require.Contains(t, found, "ProcessCount")
+	assert.Equal(t, 2.0, *found["ProcessCount"].Value)
+	assert.GreaterOrEqual(t, *found["ProcessThreads"].Value, 2.0)
+	assert.Len(t, c.prev, 2)
+}
+
+func TestProcessCollector_GoneProcess(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	require.NoError(t, cmd.Run())
+	gone := int32(cmd.Process.Pid)
+
+	c := NewProcessCollector()
+	require.NoError(t, c.Configure([]int32{gone}, nil, nil))
+	c.prev[gone] = processSample{createTime: 1, at: time.Now()}
+
+	ms, err := c.Collect(context.Background())
+	assert.NoError(t, err, "exited process is skipped silently")
+	assert.Empty(t, ms)
+	assert.NotContains(t, c.prev, gone, "state of exited processes is dropped")
+}
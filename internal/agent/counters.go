@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"metralert/internal/metrics"
+)
+
+// counterTracker накапливает приращения счетчиков между отправками.
+// Сервер прибавляет каждое полученное значение Delta к сохраненному, поэтому агент передает
+// только приращение с последней подтвержденной отправки. Приращение уменьшается только после
+// подтверждения сервером, так что неподтвержденные приращения попадают в следующую отправку
+// и не теряются и не учитываются дважды.
+type counterTracker struct {
+	mutex sync.Mutex
+	// pending - накопленные приращения по ключу хранения счетчика (имя и метки).
+	pending map[string]metrics.Metrics
+}
+
+// newCounterTracker создает пустой counterTracker.
+func newCounterTracker() *counterTracker {
+	return &counterTracker{pending: make(map[string]metrics.Metrics)}
+}
+
+// Add прибавляет приращение счетчика m.Delta к накопленному.
+func (t *counterTracker) Add(m metrics.Metrics) {
+	if m.Delta == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := m.Key()
+	delta := *m.Delta
+	if p, ok := t.pending[key]; ok {
+		delta += *p.Delta
+	}
+	m.Delta = &delta
+	t.pending[key] = m
+}
+
+// Snapshot возвращает копии счетчиков с накопленными приращениями, упорядоченные по ключу.
+func (t *counterTracker) Snapshot() []metrics.Metrics {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	result := make([]metrics.Metrics, 0, len(t.pending))
+	for _, key := range slices.Sorted(maps.Keys(t.pending)) {
+		m := t.pending[key]
+		delta := *m.Delta
+		m.Delta = &delta
+		result = append(result, m)
+	}
+	return result
+}
+
+// Commit вычитает из накопленных приращений отправленные и подтвержденные сервером.
+// Приращения, накопленные после Snapshot, сохраняются до следующей отправки.
+func (t *counterTracker) Commit(sent []metrics.Metrics) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, m := range sent {
+		if m.MType != "counter" || m.Delta == nil {
+			continue
+		}
+		key := m.Key()
+		p, ok := t.pending[key]
+		if !ok {
+			continue
+		}
+		delta := *p.Delta - *m.Delta
+		if delta == 0 {
+			delete(t.pending, key)
+			continue
+		}
+		p.Delta = &delta
+		t.pending[key] = p
+	}
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"metralert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func counter(id string, delta int64, labels map[string]string) metrics.Metrics {
+	return metrics.Metrics{ID: id, MType: "counter", Delta: &delta, Labels: labels}
+}
+
+func TestCounterTracker(t *testing.T) {
+	tracker := newCounterTracker()
+	assert.Empty(t, tracker.Snapshot())
+
+	tracker.Add(counter("PollCount", 1, nil))
+	tracker.Add(counter("PollCount", 1, nil))
+	tracker.Add(counter("Requests", 5, map[string]string{"host": "a"}))
+	tracker.Add(counter("Requests", 7, map[string]string{"host": "b"}))
+
+	snapshot := tracker.Snapshot()
+	require.Len(t, snapshot, 3)
+	assert.Equal(t, "PollCount", snapshot[0].ID)
+	assert.Equal(t, int64(2), *snapshot[0].Delta)
+	assert.Equal(t, int64(5), *snapshot[1].Delta)
+	assert.Equal(t, int64(7), *snapshot[2].Delta)
+
+	// снимок не меняется при новых опросах
+	tracker.Add(counter("PollCount", 1, nil))
+	assert.Equal(t, int64(2), *snapshot[0].Delta)
+
+	// подтвержденные приращения вычитаются, накопленные после снимка сохраняются
+	tracker.Commit(snapshot)
+	pending := tracker.Snapshot()
+	require.Len(t, pending, 1)
+	assert.Equal(t, "PollCount", pending[0].ID)
+	assert.Equal(t, int64(1), *pending[0].Delta)
+
+	tracker.Commit(pending)
+	assert.Empty(t, tracker.Snapshot())
+}
+
+func TestAgent_CounterDeltasFoldedUntilAcknowledged(t *testing.T) {
+	var (
+		down  atomic.Bool
+		total atomic.Int64
+	)
+	// сервер прибавляет полученное приращение к сохраненному значению
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []metrics.Metrics
+		require.NoError(t, json.NewDecoder(gz).Decode(&batch))
+		for _, m := range batch {
+			if m.ID == "PollCount" {
+				total.Add(*m.Delta)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	a := New(ts.URL, 2, 10, "", logger.Sugar(), true, "", nil)
+
+	report := func() {
+		counters := a.counters.Snapshot()
+		acknowledged, err := a.deliver(counters)
+		require.NoError(t, err)
+		if acknowledged {
+			a.counters.Commit(counters)
+		}
+	}
+
+	polls := 0
+	poll := func(n int) {
+		for range n {
+			a.counters.Add(counter("PollCount", 1, nil))
+			polls++
+		}
+	}
+
+	poll(3)
+	report()
+	assert.Equal(t, int64(3), total.Load())
+
+	down.Store(true)
+	poll(2)
+	report()
+	poll(4)
+	report()
+	assert.Equal(t, int64(3), total.Load())
+
+	down.Store(false)
+	poll(1)
+	report()
+	assert.Equal(t, int64(polls), total.Load())
+
+	// без новых опросов повторная отправка ничего не добавляет
+	report()
+	assert.Equal(t, int64(polls), total.Load())
+}
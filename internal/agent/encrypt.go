@@ -1,13 +1,12 @@
 package agent
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"crypto"
 	"errors"
 	"fmt"
 	"os"
+
+	"metralert/internal/hybrid"
 )
 
 func RetrieveEncrypt(body []byte, publicKeyPath string) ([]byte, error) {
@@ -20,30 +19,45 @@ func RetrieveEncrypt(body []byte, publicKeyPath string) ([]byte, error) {
 	return Encrypt(body, publicKeyPEM)
 }
 
+// Encrypt шифрует тело гибридной схемой: тело шифруется случайным ключом AES-256-GCM,
+// ключ шифруется публичным ключом RSA-OAEP или выводится из обмена ECDH для ключей ECDSA и X25519,
+// размер тела не ограничен размером ключа.
 func Encrypt(body []byte, publicKeyPEM []byte) ([]byte, error) {
 
 	if len(body) == 0 || len(publicKeyPEM) == 0 {
 		return nil, errors.New("publicKeyPEM or body are empty")
 	}
 
-	publicKeyStruct, rest := pem.Decode(publicKeyPEM)
-	if publicKeyStruct == nil && len(rest) != 0 {
-		return nil, errors.New("unable to decode PEM PublicKey")
+	publicKey, err := hybrid.ParsePublicKeyPEM(publicKeyPEM)
+	if err != nil {
+		return nil, err
 	}
 
-	if publicKeyStruct.Type != "RSA PUBLIC KEY" {
-		return nil, errors.New("the key is not public")
+	encryptedData, err := hybrid.Seal(publicKey, body)
+	if err != nil {
+		return nil, err
 	}
 
-	publicKey, err := x509.ParsePKCS1PublicKey(publicKeyStruct.Bytes)
+	return encryptedData, nil
+}
+
+// LoadPublicKey читает открытый ключ сервера (RSA, ECDSA P-256 или X25519 в PEM PKCS#1 или PKIX)
+// из файла и возвращает его вместе с идентификатором, по которому сервер выбирает закрытый ключ для расшифровки.
+// Файл читается при каждой отправке, поэтому замена ключа не требует перезапуска агента.
+func LoadPublicKey(publicKeyPath string) (crypto.PublicKey, string, error) {
+	publicKeyPEM, err := os.ReadFile(publicKeyPath)
 	if err != nil {
-		return nil, err
+		return nil, "", fmt.Errorf("unable to read public key from file %s: %w", publicKeyPath, err)
 	}
 
-	encryptedData, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, body)
+	publicKey, err := hybrid.ParsePublicKeyPEM(publicKeyPEM)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return encryptedData, nil
+	keyID, err := hybrid.KeyID(publicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return publicKey, keyID, nil
 }
@@ -40,6 +40,12 @@ func TestEncrypt(t *testing.T) {
 			publicKeyPEM: publicKeyPEM,
 			expectError:  false,
 		},
+		{
+			name:         "Body larger than the key",
+			body:         make([]byte, 1<<20),
+			publicKeyPEM: publicKeyPEM,
+			expectError:  false,
+		},
 		{
 			name:         "Invalid PEM - nil publicKeyUntyped",
 			body:         testBody,
@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"metralert/internal/hybrid"
+	"metralert/internal/metrics"
+	pb "metralert/internal/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const grpcTimeout = 10 * time.Second
+
+// grpcServiceConfig повторяет вызовы при недоступности сервера, как retryablehttp для HTTP.
+const grpcServiceConfig = `{
+	"methodConfig": [{
+		"name": [{"service": "metralert.Metrics", "method": "Update"}, {"service": "metralert.Metrics", "method": "UpdateBatch"}],
+		"retryPolicy": {
+			"maxAttempts": 4,
+			"initialBackoff": "1s",
+			"maxBackoff": "5s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`
+
+// ConnectGRPC переключает агента на отправку метрик по gRPC.
+// Если заданы настройки TLS, соединение устанавливается по TLS.
+// address - адрес gRPC сервера.
+func (a *Agent) ConnectGRPC(address string) error {
+	creds := insecure.NewCredentials()
+	if a.tlsConfig != nil {
+		creds = credentials.NewTLS(a.tlsConfig)
+	}
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultServiceConfig(grpcServiceConfig),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create grpc client for %s: %w", address, err)
+	}
+	a.grpcConn = conn
+	a.grpcClient = pb.NewMetricsClient(conn)
+	return nil
+}
+
+// CloseGRPC закрывает gRPC соединение, если оно было открыто.
+func (a *Agent) CloseGRPC() error {
+	if a.grpcConn == nil {
+		return nil
+	}
+	return a.grpcConn.Close()
+}
+
+// grpcContext добавляет в метаданные вызова идентификатор, версию, интервал отправки и адрес агента.
+func (a *Agent) grpcContext(ctx context.Context) context.Context {
+	kv := []string{strings.ToLower(agentReportIntervalHeader), strconv.Itoa(a.reportInterval)}
+	if a.ID != "" {
+		kv = append(kv, strings.ToLower(agentIDHeader), a.ID)
+	}
+	if a.Version != "" {
+		kv = append(kv, strings.ToLower(agentVersionHeader), a.Version)
+	}
+	if a.RealIP != "" {
+		kv = append(kv, strings.ToLower(realIPHeader), a.RealIP)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// sealGRPC подписывает сообщение ключом агента и шифрует его, если задан публичный ключ.
+func (a *Agent) sealGRPC(msg pb.Envelope, publicKey crypto.PublicKey) error {
+	var encrypt func([]byte) ([]byte, error)
+	if publicKey != nil {
+		encrypt = func(data []byte) ([]byte, error) {
+			return hybrid.Seal(publicKey, data)
+		}
+	}
+	return pb.Seal(msg, a.hashKey, encrypt)
+}
+
+// sendGRPC отправляет метрики по gRPC.
+// В пакетном режиме пакеты до metricsMax метрик отправляются через UpdateBatch,
+// более крупные разбиваются на части и передаются потоком StreamMetrics.
+// Ошибки вызовов преобразуются функцией grpcError в ErrServerUnavailable или ErrBatchRejected.
+func (a *Agent) sendGRPC(ms []metrics.Metrics) error {
+	ctx := a.grpcContext(context.Background())
+	var publicKey crypto.PublicKey
+	if a.PublicKeyPath != "" {
+		var (
+			keyID string
+			err   error
+		)
+		publicKey, keyID, err = LoadPublicKey(a.PublicKeyPath)
+		if err != nil {
+			return err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(hybrid.KeyIDHeader), keyID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, grpcTimeout)
+	defer cancel()
+
+	if !a.batch {
+		for _, m := range ms {
+			req := &pb.UpdateRequest{Metric: pb.FromMetrics(m)}
+			if err := a.sealGRPC(req, publicKey); err != nil {
+				return err
+			}
+			if _, err := a.grpcClient.Update(ctx, req); err != nil {
+				a.logger.Warnw("Unable to send metric over gRPC", "metric", m.ID, "error", err)
+			}
+		}
+		return nil
+	}
+
+	if len(ms) <= metricsMax {
+		req := &pb.UpdateBatchRequest{Metrics: pb.FromMetricsSlice(ms)}
+		if err := a.sealGRPC(req, publicKey); err != nil {
+			return err
+		}
+		if _, err := a.grpcClient.UpdateBatch(ctx, req); err != nil {
+			return grpcError(err)
+		}
+		a.logger.Infow("Batch Metrics sent successfully over gRPC")
+		return nil
+	}
+
+	stream, err := a.grpcClient.StreamMetrics(ctx)
+	if err != nil {
+		return grpcError(err)
+	}
+	for start := 0; start < len(ms); start += metricsMax {
+		end := min(start+metricsMax, len(ms))
+		req := &pb.UpdateBatchRequest{Metrics: pb.FromMetricsSlice(ms[start:end])}
+		if err = a.sealGRPC(req, publicKey); err != nil {
+			return err
+		}
+		if err = stream.Send(req); err != nil {
+			// причина ошибки возвращается из CloseAndRecv
+			break
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return grpcError(err)
+	}
+	a.logger.Infow("Metrics streamed successfully over gRPC", "received", resp.GetReceived())
+	return nil
+}
+
+// grpcError классифицирует ошибку вызова: при недоступности сервера или его внутренней ошибке
+// пакет нужно отправить повторно,
+// остальные ошибки означают, что сервер отклонил пакет.
+func grpcError(err error) error {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Canceled, codes.Internal:
+		return fmt.Errorf("%w: %w", ErrServerUnavailable, err)
+	default:
+		return fmt.Errorf("%w: %w", ErrBatchRejected, err)
+	}
+}
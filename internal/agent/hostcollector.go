@@ -0,0 +1,244 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+
+	"metralert/internal/metrics"
+
+	"github.com/shirou/gopsutil/v4/cpu"
+	"github.com/shirou/gopsutil/v4/disk"
+	"github.com/shirou/gopsutil/v4/load"
+	"github.com/shirou/gopsutil/v4/mem"
+	"github.com/shirou/gopsutil/v4/net"
+)
+
+// GopsutilCollectorName - имя сборщика метрик хоста через gopsutil.
+const GopsutilCollectorName = "gopsutil"
+
+// hostCollector собирает метрики хоста: память, загрузку CPU по ядрам, load average,
+// swap, заполнение дисков, а также счетчики ввода-вывода дисков и сетевых интерфейсов.
+// Сборщик вызывается из одной горутины, поэтому состояние между опросами не защищается мьютексом.
+type hostCollector struct {
+	// prevCPU - времена CPU по ядрам на момент предыдущего опроса.
+	prevCPU []cpu.TimesStat
+	// prevTotals - накопленные значения счетчиков ввода-вывода на момент предыдущего опроса
+	// по ключу хранения метрики.
+	prevTotals map[string]uint64
+	// totals - накопленные значения счетчиков текущего опроса. После опроса заменяют prevTotals,
+	// так что значения исчезнувших устройств и интерфейсов не хранятся.
+	totals map[string]uint64
+}
+
+// newHostCollector создает hostCollector.
+func newHostCollector() *hostCollector {
+	return &hostCollector{prevTotals: make(map[string]uint64)}
+}
+
+// Name возвращает имя сборщика.
+func (c *hostCollector) Name() string {
+	return GopsutilCollectorName
+}
+
+// Collect собирает метрики хоста.
+// Недоступность отдельного источника (например, load average на Windows) не прерывает сбор:
+// метрики остальных источников возвращаются вместе с ошибкой.
+func (c *hostCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	var (
+		result []metrics.Metrics
+		errs   []error
+	)
+	c.totals = make(map[string]uint64, len(c.prevTotals))
+	for _, collect := range []func(context.Context) ([]metrics.Metrics, error){
+		c.collectMemory,
+		c.collectCPU,
+		c.collectLoad,
+		c.collectSwap,
+		c.collectDiskUsage,
+		c.collectDiskIO,
+		c.collectNetIO,
+	} {
+		ms, err := collect(ctx)
+		result = append(result, ms...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	c.prevTotals, c.totals = c.totals, nil
+	return result, errors.Join(errs...)
+}
+
+// collectMemory собирает общий, свободный, доступный и занятый объем памяти.
+func (c *hostCollector) collectMemory(ctx context.Context) ([]metrics.Metrics, error) {
+	v, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("memory: %w", err)
+	}
+	return []metrics.Metrics{
+		gaugeMetric("TotalMemory", float64(v.Total), nil),
+		gaugeMetric("FreeMemory", float64(v.Free), nil),
+		gaugeMetric("AvailableMemory", float64(v.Available), nil),
+		gaugeMetric("UsedMemory", float64(v.Used), nil),
+	}, nil
+}
+
+// collectCPU собирает загрузку каждого ядра CPUutilization1..N в процентах
+// за время с предыдущего опроса. При первом опросе загрузка считается с момента загрузки системы.
+func (c *hostCollector) collectCPU(ctx context.Context) ([]metrics.Metrics, error) {
+	times, err := cpu.TimesWithContext(ctx, true)
+	if err != nil {
+		return nil, fmt.Errorf("cpu: %w", err)
+	}
+	// при изменении числа ядер (hotplug) предыдущие значения не сопоставимы
+	if len(c.prevCPU) != len(times) {
+		c.prevCPU = make([]cpu.TimesStat, len(times))
+	}
+
+	result := make([]metrics.Metrics, 0, len(times))
+	for i, t := range times {
+		result = append(result, gaugeMetric("CPUutilization"+strconv.Itoa(i+1), cpuUtilization(c.prevCPU[i], t), nil))
+	}
+	c.prevCPU = times
+	return result, nil
+}
+
+// cpuUtilization возвращает долю времени в процентах, которое ядро было занято между prev и cur.
+func cpuUtilization(prev, cur cpu.TimesStat) float64 {
+	prevTotal, prevBusy := cpuBusy(prev)
+	curTotal, curBusy := cpuBusy(cur)
+	if curTotal <= prevTotal || curBusy <= prevBusy {
+		return 0
+	}
+	return min(100, (curBusy-prevBusy)/(curTotal-prevTotal)*100)
+}
+
+// cpuBusy возвращает общее и занятое время ядра.
+// Время гостевых систем на Linux уже учтено в User и Nice и не прибавляется повторно.
+func cpuBusy(t cpu.TimesStat) (total, busy float64) {
+	total = t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+	if runtime.GOOS != "linux" {
+		total += t.Guest + t.GuestNice
+	}
+	return total, total - t.Idle - t.Iowait
+}
+
+// collectLoad собирает load average за 1, 5 и 15 минут.
+func (c *hostCollector) collectLoad(ctx context.Context) ([]metrics.Metrics, error) {
+	avg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load average: %w", err)
+	}
+	return []metrics.Metrics{
+		gaugeMetric("LoadAverage1", avg.Load1, nil),
+		gaugeMetric("LoadAverage5", avg.Load5, nil),
+		gaugeMetric("LoadAverage15", avg.Load15, nil),
+	}, nil
+}
+
+// collectSwap собирает общий, свободный и занятый объем swap.
+func (c *hostCollector) collectSwap(ctx context.Context) ([]metrics.Metrics, error) {
+	s, err := mem.SwapMemoryWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("swap: %w", err)
+	}
+	return []metrics.Metrics{
+		gaugeMetric("SwapTotal", float64(s.Total), nil),
+		gaugeMetric("SwapFree", float64(s.Free), nil),
+		gaugeMetric("SwapUsed", float64(s.Used), nil),
+	}, nil
+}
+
+// collectDiskUsage собирает заполнение каждой точки монтирования с меткой mount.
+func (c *hostCollector) collectDiskUsage(ctx context.Context) ([]metrics.Metrics, error) {
+	partitions, err := disk.PartitionsWithContext(ctx, false)
+	if err != nil && len(partitions) == 0 {
+		return nil, fmt.Errorf("disk partitions: %w", err)
+	}
+
+	var (
+		result []metrics.Metrics
+		errs   []error
+	)
+	seen := make(map[string]bool, len(partitions))
+	for _, p := range partitions {
+		if seen[p.Mountpoint] {
+			continue
+		}
+		seen[p.Mountpoint] = true
+
+		u, err := disk.UsageWithContext(ctx, p.Mountpoint)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("disk usage of %s: %w", p.Mountpoint, err))
+			continue
+		}
+		labels := map[string]string{"mount": p.Mountpoint}
+		result = append(result,
+			gaugeMetric("DiskTotal", float64(u.Total), labels),
+			gaugeMetric("DiskFree", float64(u.Free), labels),
+			gaugeMetric("DiskUsed", float64(u.Used), labels),
+		)
+	}
+	return result, errors.Join(errs...)
+}
+
+// collectDiskIO собирает приращения счетчиков чтения и записи каждого диска с меткой device.
+func (c *hostCollector) collectDiskIO(ctx context.Context) ([]metrics.Metrics, error) {
+	counters, err := disk.IOCountersWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("disk io: %w", err)
+	}
+
+	var result []metrics.Metrics
+	for name, s := range counters {
+		labels := map[string]string{"device": name}
+		result = c.appendDelta(result, "DiskReadBytes", s.ReadBytes, labels)
+		result = c.appendDelta(result, "DiskWriteBytes", s.WriteBytes, labels)
+		result = c.appendDelta(result, "DiskReadCount", s.ReadCount, labels)
+		result = c.appendDelta(result, "DiskWriteCount", s.WriteCount, labels)
+	}
+	return result, nil
+}
+
+// collectNetIO собирает приращения счетчиков трафика каждого сетевого интерфейса с меткой interface.
+func (c *hostCollector) collectNetIO(ctx context.Context) ([]metrics.Metrics, error) {
+	counters, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		return nil, fmt.Errorf("net io: %w", err)
+	}
+
+	var result []metrics.Metrics
+	for _, s := range counters {
+		labels := map[string]string{"interface": s.Name}
+		result = c.appendDelta(result, "NetBytesSent", s.BytesSent, labels)
+		result = c.appendDelta(result, "NetBytesRecv", s.BytesRecv, labels)
+		result = c.appendDelta(result, "NetPacketsSent", s.PacketsSent, labels)
+		result = c.appendDelta(result, "NetPacketsRecv", s.PacketsRecv, labels)
+	}
+	return result, nil
+}
+
+// appendDelta добавляет к ms счетчик id с приращением накопленного значения total с предыдущего опроса.
+// При первом опросе запоминается начальное значение и счетчик не передается.
+// Если значение уменьшилось (счетчик устройства сброшен), приращением считается само значение.
+func (c *hostCollector) appendDelta(ms []metrics.Metrics, id string, total uint64, labels map[string]string) []metrics.Metrics {
+	key := metrics.Key(id, labels)
+	prev, ok := c.prevTotals[key]
+	c.totals[key] = total
+	if !ok {
+		return ms
+	}
+
+	delta := int64(total - prev)
+	if total < prev {
+		delta = int64(total)
+	}
+	return append(ms, metrics.Metrics{ID: id, MType: "counter", Delta: &delta, Labels: labels})
+}
+
+// gaugeMetric создает метрику gauge.
+func gaugeMetric(id string, value float64, labels map[string]string) metrics.Metrics {
+	return metrics.Metrics{ID: id, MType: "gauge", Value: &value, Labels: labels}
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	agentIDHeader             = "X-Agent-ID"
+	agentVersionHeader        = "X-Agent-Version"
+	agentReportIntervalHeader = "X-Agent-Report-Interval"
+	realIPHeader              = "X-Real-IP"
+)
+
+// LoadOrCreateID читает идентификатор агента из файла path.
+// Если файла нет, генерирует новый случайный идентификатор и сохраняет его.
+func LoadOrCreateID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		if id != "" {
+			return id, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("unable to read agent id from %s: %w", path, err)
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("unable to create directory for agent id: %w", err)
+		}
+	}
+	if err = os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("unable to save agent id to %s: %w", path, err)
+	}
+	return id, nil
+}
+
+// newID генерирует случайный идентификатор в формате UUID v4.
+func newID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	s := hex.EncodeToString(b[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], nil
+}
+
+// OutboundIP возвращает адрес интерфейса, через который агент отправляет запросы на address.
+// Пакеты при этом не отправляются: UDP-сокет только выбирает маршрут.
+func OutboundIP(address string) (net.IP, error) {
+	host := address
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine outbound address for %s: %w", address, err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -1,107 +1,79 @@
 package agent
 
 import (
+	"context"
 	"math/rand/v2"
 	"metralert/internal/metrics"
 	"reflect"
 	"runtime"
-
-	"github.com/shirou/gopsutil/v4/mem"
 )
 
-// Сбор метрик MemStats
-func (a *Agent) CollectRuntimeMetrics() chan []metrics.Metrics {
-	out := make(chan []metrics.Metrics, 1)
-	go func() {
-		for {
-			var RandomValue metrics.Gauge
-			runtime.ReadMemStats(&a.rtm)
-
-			// result := []string{}
-			result := []metrics.Metrics{}
-
-			for i, k := range reflect.VisibleFields(reflect.TypeOf(a.rtm)) {
-				value := reflect.ValueOf(a.rtm).Field(i)
-				switch {
-				case k.Type == reflect.TypeFor[uint64]():
-					v := float64(value.Interface().(uint64))
-					result = append(result, metrics.Metrics{
-						ID:    k.Name,
-						MType: "gauge",
-						Value: &v,
-					})
-				case k.Type == reflect.TypeFor[uint32]():
-					v := float64(value.Interface().(uint32))
-					result = append(result, metrics.Metrics{
-						ID:    k.Name,
-						MType: "gauge",
-						Value: &v,
-					})
-				case k.Type == reflect.TypeFor[float64]():
-					v := float64(value.Interface().(float64))
-					result = append(result, metrics.Metrics{
-						ID:    k.Name,
-						MType: "gauge",
-						Value: &v,
-					})
-				}
-			}
-
-			RandomValue = metrics.Gauge(rand.Float64())
-
-			result = append(result, metrics.Metrics{
-				ID:    "PollCount",
-				MType: "counter",
-				Delta: (*int64)(&a.pollCount),
-			})
-
-			result = append(result, metrics.Metrics{
-				ID:    "RandomValue",
-				MType: "gauge",
-				Value: (*float64)(&RandomValue),
-			})
-
-			a.pollCount += metrics.Counter(1)
-
-			a.logger.Infow("Runtime Metrics collected", "number", len(result))
+const (
+	// RuntimeCollectorName - имя сборщика метрик runtime.MemStats.
+	RuntimeCollectorName = "runtime"
+)
 
-			out <- result
-		}
+// runtimeCollector собирает метрики MemStats, PollCount и RandomValue.
+type runtimeCollector struct {
+	// rtm - структура для хранения статистики памяти Go runtime.
+	rtm runtime.MemStats
+}
 
-	}()
-	return out
+// Name возвращает имя сборщика.
+func (c *runtimeCollector) Name() string {
+	return RuntimeCollectorName
 }
 
-func (a *Agent) CollectGopsutilMetrics() chan []metrics.Metrics {
-	out := make(chan []metrics.Metrics)
-	go func() {
-		for {
-			v, _ := mem.VirtualMemory()
-			result := []metrics.Metrics{}
+// Collect собирает метрики MemStats
+func (c *runtimeCollector) Collect(context.Context) ([]metrics.Metrics, error) {
+	var RandomValue metrics.Gauge
+	runtime.ReadMemStats(&c.rtm)
+
+	result := []metrics.Metrics{}
 
-			valueTotalMemory := float64(v.Total)
+	for i, k := range reflect.VisibleFields(reflect.TypeOf(c.rtm)) {
+		value := reflect.ValueOf(c.rtm).Field(i)
+		switch {
+		case k.Type == reflect.TypeFor[uint64]():
+			v := float64(value.Interface().(uint64))
 			result = append(result, metrics.Metrics{
-				ID:    "TotalMemory",
+				ID:    k.Name,
 				MType: "gauge",
-				Value: &valueTotalMemory,
+				Value: &v,
 			})
-			valueFreeMemory := float64(v.Total)
+		case k.Type == reflect.TypeFor[uint32]():
+			v := float64(value.Interface().(uint32))
 			result = append(result, metrics.Metrics{
-				ID:    "FreeMemory",
+				ID:    k.Name,
 				MType: "gauge",
-				Value: &valueFreeMemory,
+				Value: &v,
 			})
-			valueCPUutilization1 := float64(runtime.GOMAXPROCS(0))
+		case k.Type == reflect.TypeFor[float64]():
+			v := float64(value.Interface().(float64))
 			result = append(result, metrics.Metrics{
-				ID:    "CPUutilization1",
+				ID:    k.Name,
 				MType: "gauge",
-				Value: &valueCPUutilization1,
+				Value: &v,
 			})
-
-			a.logger.Infow("Gopsutil Metrics collected", "number", len(result))
-			out <- result
 		}
-
-	}()
-	return out
+	}
+
+	RandomValue = metrics.Gauge(rand.Float64())
+
+	// передается приращение за один опрос, а не накопленное значение,
+	// так как сервер прибавляет полученное значение к сохраненному
+	pollDelta := int64(1)
+	result = append(result, metrics.Metrics{
+		ID:    "PollCount",
+		MType: "counter",
+		Delta: &pollDelta,
+	})
+
+	result = append(result, metrics.Metrics{
+		ID:    "RandomValue",
+		MType: "gauge",
+		Value: (*float64)(&RandomValue),
+	})
+
+	return result, nil
 }
@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"metralert/internal/metrics"
+)
+
+const (
+	// DropOldest - при переполнении очереди удаляются самые старые пакеты.
+	DropOldest = "oldest"
+	// DropNewest - при переполнении очереди новый пакет не сохраняется.
+	DropNewest = "newest"
+
+	outboxExt    = ".json"
+	outboxTmpExt = ".tmp"
+)
+
+var (
+	// ErrOutboxFull возвращается, если пакет не помещается в очередь.
+	ErrOutboxFull = errors.New("outbox is full")
+	// ErrServerUnavailable возвращается, если сервер недоступен и пакет нужно отправить повторно.
+	ErrServerUnavailable = errors.New("server unavailable")
+	// ErrBatchRejected возвращается, если сервер отклонил пакет и повторная отправка не поможет.
+	ErrBatchRejected = errors.New("batch rejected by server")
+)
+
+// outboxEntry - пакет метрик, сохраненный на диске.
+type outboxEntry struct {
+	seq  uint64
+	size int64
+}
+
+// Outbox - очередь неотправленных пакетов метрик на диске.
+// Каждый пакет хранится в отдельном файле с порядковым номером в имени,
+// поэтому очередь переживает перезапуск агента, а пакеты отправляются в порядке сбора.
+// Пакеты хранятся в открытом виде и подписываются и шифруются заново при отправке.
+type Outbox struct {
+	mutex sync.Mutex
+	// dir - каталог очереди.
+	dir string
+	// maxSize - максимальный суммарный размер пакетов в байтах, 0 - без ограничения.
+	maxSize int64
+	// dropPolicy - что удалять при переполнении: DropOldest или DropNewest.
+	dropPolicy string
+	// entries - пакеты в порядке сбора.
+	entries []outboxEntry
+	// size - суммарный размер пакетов в байтах.
+	size int64
+	// nextSeq - номер следующего пакета.
+	nextSeq uint64
+}
+
+// NewOutbox открывает очередь в каталоге dir, создавая его при необходимости,
+// и загружает пакеты, сохраненные до перезапуска.
+// maxSize - максимальный размер очереди в байтах, 0 - без ограничения.
+// dropPolicy - DropOldest или DropNewest.
+func NewOutbox(dir string, maxSize int64, dropPolicy string) (*Outbox, error) {
+	if dropPolicy != DropOldest && dropPolicy != DropNewest {
+		return nil, fmt.Errorf("unknown outbox drop policy %q", dropPolicy)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create outbox directory: %w", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read outbox directory: %w", err)
+	}
+
+	o := &Outbox{dir: dir, maxSize: maxSize, dropPolicy: dropPolicy}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, outboxTmpExt) {
+			// запись была прервана, пакет не попал в очередь
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(name, outboxExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, outboxExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+		o.entries = append(o.entries, outboxEntry{seq: seq, size: info.Size()})
+		o.size += info.Size()
+		o.nextSeq = max(o.nextSeq, seq+1)
+	}
+	sort.Slice(o.entries, func(i, j int) bool {
+		return o.entries[i].seq < o.entries[j].seq
+	})
+	return o, nil
+}
+
+// Len возвращает количество пакетов в очереди.
+func (o *Outbox) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.entries)
+}
+
+// Size возвращает суммарный размер пакетов в байтах.
+func (o *Outbox) Size() int64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.size
+}
+
+// Push сохраняет пакет в конец очереди.
+// Если очередь переполнена, по политике DropOldest удаляются самые старые пакеты,
+// по политике DropNewest возвращается ErrOutboxFull.
+// Возвращает количество удаленных старых пакетов.
+func (o *Outbox) Push(batch []metrics.Metrics) (int, error) {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(len(data))
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.maxSize > 0 && size > o.maxSize {
+		return 0, fmt.Errorf("%w: batch of %d bytes exceeds the limit of %d bytes", ErrOutboxFull, size, o.maxSize)
+	}
+	dropped := 0
+	for o.maxSize > 0 && o.size+size > o.maxSize {
+		if o.dropPolicy == DropNewest {
+			return 0, fmt.Errorf("%w: %d bytes in %d batches", ErrOutboxFull, o.size, len(o.entries))
+		}
+		if err = o.removeFirst(); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+
+	seq := o.nextSeq
+	if err = writeFileSync(o.path(seq), data); err != nil {
+		return dropped, fmt.Errorf("unable to write outbox batch: %w", err)
+	}
+	o.nextSeq++
+	o.entries = append(o.entries, outboxEntry{seq: seq, size: size})
+	o.size += size
+	return dropped, nil
+}
+
+// Replay отправляет пакеты очереди по порядку функцией send и удаляет отправленные.
+// Пакеты, отклоненные сервером (ErrBatchRejected), и поврежденные файлы удаляются с вызовом onDrop,
+// на любой другой ошибке отправка останавливается, чтобы не нарушить порядок пакетов.
+// Возвращает количество отправленных пакетов.
+func (o *Outbox) Replay(send func([]metrics.Metrics) error, onDrop func(seq uint64, err error)) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	sent := 0
+	for len(o.entries) > 0 {
+		seq := o.entries[0].seq
+		batch, err := o.read(seq)
+		if err == nil {
+			err = send(batch)
+			if err != nil && !errors.Is(err, ErrBatchRejected) {
+				return sent, err
+			}
+		}
+		if err != nil && onDrop != nil {
+			onDrop(seq, err)
+		}
+		if err == nil {
+			sent++
+		}
+		if err = o.removeFirst(); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// read читает пакет с номером seq.
+func (o *Outbox) read(seq uint64) ([]metrics.Metrics, error) {
+	data, err := os.ReadFile(o.path(seq))
+	if err != nil {
+		return nil, err
+	}
+	var batch []metrics.Metrics
+	if err = json.Unmarshal(data, &batch); err != nil {
+		return nil, fmt.Errorf("corrupted outbox batch %d: %w", seq, err)
+	}
+	return batch, nil
+}
+
+// removeFirst удаляет первый пакет очереди.
+func (o *Outbox) removeFirst() error {
+	if err := os.Remove(o.path(o.entries[0].seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove outbox batch: %w", err)
+	}
+	o.size -= o.entries[0].size
+	o.entries = o.entries[1:]
+	return nil
+}
+
+// path возвращает путь к файлу пакета. Номер дополняется нулями, чтобы файлы сортировались по имени.
+func (o *Outbox) path(seq uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", seq, outboxExt))
+}
+
+// writeFileSync записывает файл через временный файл и переименование,
+// чтобы при сбое в очереди не оказался частично записанный пакет.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + outboxTmpExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
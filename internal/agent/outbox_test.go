@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"metralert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func gaugeBatch(id string, value float64) []metrics.Metrics {
+	return []metrics.Metrics{{ID: id, MType: "gauge", Value: &value}}
+}
+
+func TestOutbox_ReplayOrderAndRestart(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := NewOutbox(dir, 0, DropOldest)
+	require.NoError(t, err)
+
+	for _, id := range []string{"first", "second", "third"} {
+		_, err = outbox.Push(gaugeBatch(id, 1))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 3, outbox.Len())
+
+	// прерванная запись не должна попасть в очередь после перезапуска
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000099.json.tmp"), []byte("[{"), 0600))
+
+	outbox, err = NewOutbox(dir, 0, DropOldest)
+	require.NoError(t, err)
+	assert.Equal(t, 3, outbox.Len())
+
+	var sent []string
+	unavailable := true
+	send := func(batch []metrics.Metrics) error {
+		if unavailable {
+			return ErrServerUnavailable
+		}
+		sent = append(sent, batch[0].ID)
+		return nil
+	}
+
+	n, err := outbox.Replay(send, nil)
+	assert.ErrorIs(t, err, ErrServerUnavailable)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 3, outbox.Len())
+
+	unavailable = false
+	n, err = outbox.Replay(send, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []string{"first", "second", "third"}, sent)
+	assert.Equal(t, 0, outbox.Len())
+	assert.Equal(t, int64(0), outbox.Size())
+
+	// номера продолжаются после перезапуска, новые пакеты остаются в конце очереди
+	_, err = outbox.Push(gaugeBatch("fourth", 1))
+	require.NoError(t, err)
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "00000000000000000003.json", files[0].Name())
+}
+
+func TestOutbox_DropPolicy(t *testing.T) {
+	batchSize := func() int64 {
+		data, err := json.Marshal(gaugeBatch("m0", 1))
+		require.NoError(t, err)
+		return int64(len(data))
+	}()
+
+	t.Run("oldest", func(t *testing.T) {
+		outbox, err := NewOutbox(t.TempDir(), 2*batchSize, DropOldest)
+		require.NoError(t, err)
+		for _, id := range []string{"m0", "m1", "m2"} {
+			_, err = outbox.Push(gaugeBatch(id, 1))
+			require.NoError(t, err)
+		}
+		assert.Equal(t, 2, outbox.Len())
+		assert.LessOrEqual(t, outbox.Size(), 2*batchSize)
+
+		var sent []string
+		_, err = outbox.Replay(func(batch []metrics.Metrics) error {
+			sent = append(sent, batch[0].ID)
+			return nil
+		}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"m1", "m2"}, sent)
+	})
+
+	t.Run("newest", func(t *testing.T) {
+		outbox, err := NewOutbox(t.TempDir(), 2*batchSize, DropNewest)
+		require.NoError(t, err)
+		for _, id := range []string{"m0", "m1"} {
+			_, err = outbox.Push(gaugeBatch(id, 1))
+			require.NoError(t, err)
+		}
+		_, err = outbox.Push(gaugeBatch("m2", 1))
+		assert.ErrorIs(t, err, ErrOutboxFull)
+		assert.Equal(t, 2, outbox.Len())
+	})
+
+	_, err := NewOutbox(t.TempDir(), 0, "random")
+	assert.Error(t, err)
+}
+
+func TestOutbox_DropsRejectedAndCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := NewOutbox(dir, 0, DropOldest)
+	require.NoError(t, err)
+	for _, id := range []string{"rejected", "corrupted", "ok"} {
+		_, err = outbox.Push(gaugeBatch(id, 1))
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.WriteFile(outbox.path(1), []byte("not json"), 0600))
+
+	var (
+		sent    []string
+		dropped []uint64
+	)
+	n, err := outbox.Replay(func(batch []metrics.Metrics) error {
+		if batch[0].ID == "rejected" {
+			return ErrBatchRejected
+		}
+		sent = append(sent, batch[0].ID)
+		return nil
+	}, func(seq uint64, err error) {
+		dropped = append(dropped, seq)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"ok"}, sent)
+	assert.Equal(t, []uint64{0, 1}, dropped)
+	assert.Equal(t, 0, outbox.Len())
+
+	// локальные ошибки отправки не удаляют пакет
+	_, err = outbox.Push(gaugeBatch("kept", 1))
+	require.NoError(t, err)
+	_, err = outbox.Replay(func([]metrics.Metrics) error {
+		return errors.New("unable to load public key")
+	}, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 1, outbox.Len())
+}
+
+func TestAgent_DeliverWithOutbox(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		received []string
+		down     atomic.Bool
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []metrics.Metrics
+		require.NoError(t, json.NewDecoder(gz).Decode(&batch))
+		mutex.Lock()
+		received = append(received, batch[0].ID)
+		mutex.Unlock()
+	}))
+	defer ts.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	a := New(ts.URL, 2, 10, "", logger.Sugar(), true, "", nil)
+	a.Outbox, err = NewOutbox(dir, 0, DropOldest)
+	require.NoError(t, err)
+
+	down.Store(true)
+	for _, id := range []string{"offline1", "offline2"} {
+		acknowledged, err := a.deliver(gaugeBatch(id, 1))
+		require.NoError(t, err)
+		assert.True(t, acknowledged, "batch saved to outbox")
+	}
+	assert.Equal(t, 2, a.Outbox.Len())
+	assert.Empty(t, received)
+
+	// после перезапуска агента очередь отправляется раньше нового пакета
+	a.Outbox, err = NewOutbox(dir, 0, DropOldest)
+	require.NoError(t, err)
+	down.Store(false)
+	acknowledged, err := a.deliver(gaugeBatch("online", 3))
+	require.NoError(t, err)
+	assert.True(t, acknowledged)
+	assert.Equal(t, []string{"offline1", "offline2", "online"}, received)
+	assert.Equal(t, 0, a.Outbox.Len())
+}
@@ -0,0 +1,278 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"metralert/internal/metrics"
+
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// ProcessCollectorName - имя сборщика метрик отдельных процессов.
+const ProcessCollectorName = "process"
+
+// ProcessCollector собирает метрики процессов, заданных PID, pid-файлами и шаблонами имени:
+// RSS, загрузку CPU, число открытых файловых дескрипторов, число потоков и время работы.
+// Метрики передаются с меткой process (имя процесса) и суммируются по всем наблюдаемым процессам
+// с этим именем, чтобы перезапуск процесса с новым PID не создавал новый ряд на сервере.
+// Процессы, завершившиеся или еще не запущенные к моменту опроса, пропускаются без ошибки.
+type ProcessCollector struct {
+	// pids - PID наблюдаемых процессов.
+	pids []int32
+	// pidFiles - pid-файлы наблюдаемых процессов, перечитываются при каждом опросе.
+	pidFiles []string
+	// patterns - шаблоны имени наблюдаемых процессов.
+	patterns []*regexp.Regexp
+	// prev - время CPU процессов на момент предыдущего опроса по PID.
+	prev map[int32]processSample
+}
+
+// processSample - время CPU процесса на момент опроса.
+type processSample struct {
+	// createTime - время запуска процесса в миллисекундах, отличает процесс от нового процесса с тем же PID.
+	createTime int64
+	// cpuTime - суммарное время CPU процесса в секундах.
+	cpuTime float64
+	// at - время опроса.
+	at time.Time
+}
+
+// NewProcessCollector создает сборщик без наблюдаемых процессов. Процессы задаются Configure.
+func NewProcessCollector() *ProcessCollector {
+	return &ProcessCollector{prev: make(map[int32]processSample)}
+}
+
+// Configure задает наблюдаемые процессы: PID, pid-файлы и регулярные выражения для имени процесса.
+// Возвращает ошибку, если шаблон имени не компилируется.
+func (c *ProcessCollector) Configure(pids []int32, pidFiles []string, names []string) error {
+	patterns := make([]*regexp.Regexp, 0, len(names))
+	for _, name := range names {
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return fmt.Errorf("invalid process name pattern %q: %w", name, err)
+		}
+		patterns = append(patterns, re)
+	}
+	c.pids = pids
+	c.pidFiles = pidFiles
+	c.patterns = patterns
+	return nil
+}
+
+// Name возвращает имя сборщика.
+func (c *ProcessCollector) Name() string {
+	return ProcessCollectorName
+}
+
+// Collect собирает метрики наблюдаемых процессов, агрегированные по имени процесса.
+func (c *ProcessCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	pids, errs := c.targets(ctx)
+
+	stats := make(map[string]*processStats)
+	samples := make(map[int32]processSample, len(pids))
+	for _, pid := range pids {
+		st, sample, err := c.collectProcess(ctx, pid)
+		if err != nil && !processExists(ctx, pid) {
+			// процесс завершился во время опроса
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("process %d: %w", pid, err))
+		}
+		if st.name == "" {
+			continue
+		}
+		if total, ok := stats[st.name]; ok {
+			total.add(st)
+		} else {
+			stats[st.name] = &st
+		}
+		samples[pid] = sample
+	}
+	// завершившиеся процессы не хранятся
+	c.prev = samples
+
+	var result []metrics.Metrics
+	for _, name := range slices.Sorted(maps.Keys(stats)) {
+		result = append(result, stats[name].metrics()...)
+	}
+	return result, errors.Join(errs...)
+}
+
+// processStats - метрики процесса или сумма метрик процессов с одним именем.
+type processStats struct {
+	name string
+	// count - количество процессов.
+	count      int
+	rss        uint64
+	cpuPercent float64
+	threads    int32
+	// uptime - время работы самого старого процесса в секундах.
+	uptime float64
+	fds    int32
+	// fdsKnown - удалось ли получить число дескрипторов всех процессов.
+	fdsKnown bool
+}
+
+// add прибавляет метрики другого процесса с тем же именем.
+func (s *processStats) add(other processStats) {
+	s.count += other.count
+	s.rss += other.rss
+	s.cpuPercent += other.cpuPercent
+	s.threads += other.threads
+	s.uptime = max(s.uptime, other.uptime)
+	s.fds += other.fds
+	s.fdsKnown = s.fdsKnown && other.fdsKnown
+}
+
+// metrics возвращает метрики с меткой process.
+// ProcessOpenFDs не передается, если число дескрипторов известно не для всех процессов.
+func (s *processStats) metrics() []metrics.Metrics {
+	labels := map[string]string{"process": s.name}
+	ms := []metrics.Metrics{
+		gaugeMetric("ProcessCount", float64(s.count), labels),
+		gaugeMetric("ProcessRSS", float64(s.rss), labels),
+		gaugeMetric("ProcessCPUPercent", s.cpuPercent, labels),
+		gaugeMetric("ProcessThreads", float64(s.threads), labels),
+		gaugeMetric("ProcessUptime", s.uptime, labels),
+	}
+	if s.fdsKnown {
+		ms = append(ms, gaugeMetric("ProcessOpenFDs", float64(s.fds), labels))
+	}
+	return ms
+}
+
+// targets возвращает отсортированные PID наблюдаемых процессов.
+// Отсутствующий pid-файл означает, что процесс не запущен, и ошибкой не считается.
+func (c *ProcessCollector) targets(ctx context.Context) ([]int32, []error) {
+	var errs []error
+	pids := slices.Clone(c.pids)
+
+	for _, path := range c.pidFiles {
+		pid, err := readPIDFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pids = append(pids, pid)
+	}
+
+	if len(c.patterns) > 0 {
+		procs, err := process.ProcessesWithContext(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to list processes: %w", err))
+		}
+		for _, p := range procs {
+			name, err := p.NameWithContext(ctx)
+			if err != nil {
+				continue
+			}
+			if slices.ContainsFunc(c.patterns, func(re *regexp.Regexp) bool { return re.MatchString(name) }) {
+				pids = append(pids, p.Pid)
+			}
+		}
+	}
+
+	slices.Sort(pids)
+	return slices.Compact(pids), errs
+}
+
+// readPIDFile читает PID из pid-файла.
+func readPIDFile(path string) (int32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid file %s: %q", path, strings.TrimSpace(string(data)))
+	}
+	return int32(pid), nil
+}
+
+// collectProcess собирает метрики процесса pid.
+// Если не удалось получить только число дескрипторов (например, процесс другого пользователя),
+// остальные метрики возвращаются вместе с ошибкой.
+func (c *ProcessCollector) collectProcess(ctx context.Context, pid int32) (processStats, processSample, error) {
+	p, err := process.NewProcessWithContext(ctx, pid)
+	if err != nil {
+		return processStats{}, processSample{}, err
+	}
+	name, err := p.NameWithContext(ctx)
+	if err != nil {
+		return processStats{}, processSample{}, err
+	}
+	createTime, err := p.CreateTimeWithContext(ctx)
+	if err != nil {
+		return processStats{}, processSample{}, err
+	}
+	memory, err := p.MemoryInfoWithContext(ctx)
+	if err != nil {
+		return processStats{}, processSample{}, err
+	}
+	times, err := p.TimesWithContext(ctx)
+	if err != nil {
+		return processStats{}, processSample{}, err
+	}
+	threads, err := p.NumThreadsWithContext(ctx)
+	if err != nil {
+		return processStats{}, processSample{}, err
+	}
+
+	now := time.Now()
+	created := time.UnixMilli(createTime)
+	sample := processSample{
+		createTime: createTime,
+		cpuTime:    times.User + times.System,
+		at:         now,
+	}
+
+	st := processStats{
+		name:       name,
+		count:      1,
+		rss:        memory.RSS,
+		cpuPercent: c.cpuPercent(pid, sample, created),
+		threads:    threads,
+		uptime:     now.Sub(created).Seconds(),
+	}
+
+	fds, err := p.NumFDsWithContext(ctx)
+	if err != nil {
+		return st, sample, fmt.Errorf("open files of %s: %w", name, err)
+	}
+	st.fds = fds
+	st.fdsKnown = true
+	return st, sample, nil
+}
+
+// cpuPercent возвращает загрузку CPU процессом в процентах одного ядра с предыдущего опроса.
+// Для процесса, не встречавшегося при предыдущем опросе, загрузка считается с момента его запуска.
+func (c *ProcessCollector) cpuPercent(pid int32, cur processSample, created time.Time) float64 {
+	prev, ok := c.prev[pid]
+	if !ok || prev.createTime != cur.createTime {
+		prev = processSample{createTime: cur.createTime, at: created}
+	}
+	elapsed := cur.at.Sub(prev.at).Seconds()
+	if elapsed <= 0 || cur.cpuTime < prev.cpuTime {
+		return 0
+	}
+	return (cur.cpuTime - prev.cpuTime) / elapsed * 100
+}
+
+// processExists сообщает, существует ли процесс pid.
+func processExists(ctx context.Context, pid int32) bool {
+	exists, err := process.PidExistsWithContext(ctx, pid)
+	return err != nil || exists
+}
@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"metralert/internal/metrics"
+)
+
+// statsdMaxPacket - максимальный размер принимаемого пакета StatsD.
+const statsdMaxPacket = 64 << 10
+
+// statsdValues хранит последние значения gauge и наброски множеств, полученные по StatsD.
+// Значения не сбрасываются после отправки, как и в StatsD: gauge сохраняет значение до следующего обновления.
+// Наброски множеств отправляются целиком при каждой отправке: сервер объединяет их
+// идемпотентно, поэтому повторная отправка не искажает оценку.
+type statsdValues struct {
+	mutex sync.Mutex
+	// values - значения gauge по ключу хранения метрики (имя и метки).
+	values map[string]metrics.Metrics
+	// sets - наброски HyperLogLog множеств по ключу хранения метрики.
+	sets map[string]metrics.Metrics
+}
+
+// newStatsDValues создает пустой statsdValues.
+func newStatsDValues() *statsdValues {
+	return &statsdValues{
+		values: make(map[string]metrics.Metrics),
+		sets:   make(map[string]metrics.Metrics),
+	}
+}
+
+// set записывает значение gauge. Если relative, значение прибавляется к сохраненному.
+func (g *statsdValues) set(m metrics.Metrics, relative bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	key := m.Key()
+	value := *m.Value
+	if prev, ok := g.values[key]; ok && relative {
+		value += *prev.Value
+	}
+	m.Value = &value
+	g.values[key] = m
+}
+
+// addSet объединяет набросок множества m с сохраненным.
+func (g *statsdValues) addSet(m metrics.Metrics) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	key := m.Key()
+	if prev, ok := g.sets[key]; ok && prev.Set.Merge(m.Set) {
+		return
+	}
+	m.Set = m.Set.Clone()
+	g.sets[key] = m
+}
+
+// snapshot возвращает копии значений gauge и набросков множеств, упорядоченные по ключу.
+func (g *statsdValues) snapshot() []metrics.Metrics {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	result := make([]metrics.Metrics, 0, len(g.values)+len(g.sets))
+	for _, key := range slices.Sorted(maps.Keys(g.values)) {
+		m := g.values[key]
+		value := *m.Value
+		m.Value = &value
+		result = append(result, m)
+	}
+	for _, key := range slices.Sorted(maps.Keys(g.sets)) {
+		m := g.sets[key]
+		m.Set = m.Set.Clone()
+		result = append(result, m)
+	}
+	return result
+}
+
+// ListenStatsD принимает метрики приложений в формате StatsD по UDP (network udp)
+// или через Unix-сокет (network unixgram) до отмены ctx.
+// Счетчики накапливаются вместе со счетчиками сборщиков, значения gauge отправляются
+// при каждой отправке метрик. Возвращает ошибку, если адрес не удалось занять.
+func (a *Agent) ListenStatsD(ctx context.Context, network, address string) error {
+	if network == "unixgram" {
+		// сокет, оставшийся от предыдущего запуска, мешает занять адрес
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove stale statsd socket: %w", err)
+		}
+	}
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return fmt.Errorf("unable to listen statsd on %s %s: %w", network, address, err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		if network == "unixgram" {
+			os.Remove(address)
+		}
+	}()
+	go a.serveStatsD(conn)
+	a.logger.Infow("StatsD listener started", "network", network, "address", conn.LocalAddr().String())
+	return nil
+}
+
+// serveStatsD читает пакеты StatsD из conn до его закрытия.
+func (a *Agent) serveStatsD(conn net.PacketConn) {
+	buf := make([]byte, statsdMaxPacket)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			a.logger.Warnw("Unable to read statsd packet", "error", err)
+			continue
+		}
+		a.handleStatsD(buf[:n])
+	}
+}
+
+// handleStatsD разбирает пакет StatsD, в котором метрики разделены переводом строки.
+// Ошибочные строки записываются в лог и пропускаются.
+func (a *Agent) handleStatsD(packet []byte) {
+	for line := range strings.SplitSeq(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m, relative, err := parseStatsD(line)
+		if err != nil {
+			a.logger.Debugw("Invalid statsd line", "line", line, "error", err)
+			continue
+		}
+		ms := []metrics.Metrics{m}
+		a.applyLabels(ms)
+		switch m.MType {
+		case "counter":
+			a.counters.Add(ms[0])
+		case "set":
+			a.statsd.addSet(ms[0])
+		default:
+			a.statsd.set(ms[0], relative)
+		}
+	}
+}
+
+// parseStatsD разбирает строку StatsD вида name:value|type[|@rate][|#tag:value,...].
+// Поддерживаются типы g (gauge), c (counter) и s (set). Значение gauge со знаком + или -
+// является приращением, relative в этом случае равно true. Значение счетчика делится
+// на частоту выборки @rate и округляется. Значение set - произвольная строка, которая
+// добавляется в набросок HyperLogLog. Теги DogStatsD становятся метками метрики.
+func parseStatsD(line string) (m metrics.Metrics, relative bool, err error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return m, false, errors.New("metric name is missing")
+	}
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return m, false, errors.New("metric type is missing")
+	}
+	rate := 1.0
+	var labels map[string]string
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			rate, err = strconv.ParseFloat(f[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return m, false, fmt.Errorf("invalid sample rate %q", f)
+			}
+		case strings.HasPrefix(f, "#"):
+			labels = make(map[string]string)
+			for tag := range strings.SplitSeq(f[1:], ",") {
+				k, v, _ := strings.Cut(tag, ":")
+				if k != "" {
+					labels[k] = v
+				}
+			}
+		default:
+			return m, false, fmt.Errorf("unknown field %q", f)
+		}
+	}
+
+	m = metrics.Metrics{ID: name, Labels: labels}
+	if fields[1] == "s" {
+		if fields[0] == "" {
+			return m, false, errors.New("set item is missing")
+		}
+		m.MType = "set"
+		m.Set = metrics.NewHyperLogLog(metrics.DefaultPrecision)
+		m.Set.Add(fields[0])
+		return m, false, nil
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return m, false, fmt.Errorf("invalid value %q", fields[0])
+	}
+	switch fields[1] {
+	case "g":
+		m.MType = "gauge"
+		m.Value = &value
+		return m, strings.HasPrefix(fields[0], "+") || strings.HasPrefix(fields[0], "-"), nil
+	case "c":
+		delta := int64(math.Round(value / rate))
+		m.MType = "counter"
+		m.Delta = &delta
+		return m, false, nil
+	}
+	return m, false, fmt.Errorf("unsupported metric type %q", fields[1])
+}
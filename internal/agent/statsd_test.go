@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"metralert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseStatsD(t *testing.T) {
+	tests := []struct {
+		line     string
+		want     metrics.Metrics
+		relative bool
+		wantErr  bool
+	}{
+		{line: "queue.size:12.5|g", want: gaugeMetric("queue.size", 12.5, nil)},
+		{line: "queue.size:-3|g", want: gaugeMetric("queue.size", -3, nil), relative: true},
+		{line: "requests:1|c", want: counter("requests", 1, nil)},
+		{line: "requests:1|c|@0.1", want: counter("requests", 10, nil)},
+		{line: "requests:2|c|#route:/api,code:200", want: counter("requests", 2, map[string]string{"route": "/api", "code": "200"})},
+		{line: "requests|c", wantErr: true},
+		{line: ":1|c", wantErr: true},
+		{line: "requests:1", wantErr: true},
+		{line: "requests:abc|c", wantErr: true},
+		{line: "requests:NaN|g", wantErr: true},
+		{line: "latency:12|ms", wantErr: true},
+		{line: "requests:1|c|@2", wantErr: true},
+		{line: "users:|s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			m, relative, err := parseStatsD(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, m)
+			assert.Equal(t, tt.relative, relative)
+		})
+	}
+}
+
+func TestParseStatsD_Set(t *testing.T) {
+	m, relative, err := parseStatsD("users:alice|s|#region:eu")
+	require.NoError(t, err)
+	assert.False(t, relative)
+	assert.Equal(t, "set", m.MType)
+	assert.Equal(t, map[string]string{"region": "eu"}, m.Labels)
+	require.NotNil(t, m.Set)
+	assert.Equal(t, uint64(1), m.Set.Estimate())
+}
+
+func TestAgent_ListenStatsD(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	a := New("localhost:8080", 1, 10, "", logger.Sugar(), true, "", nil)
+	a.Labels = map[string]string{"host": "test"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(t.TempDir(), "statsd.sock")
+	require.NoError(t, a.ListenStatsD(ctx, "unixgram", socket))
+
+	conn, err := net.Dial("unixgram", socket)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("requests:2|c\nqueue.size:10|g\ngarbage\n"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("requests:3|c\nqueue.size:+5|g"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("users:alice|s\nusers:bob|s\nusers:alice|s"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		counters := a.counters.Snapshot()
+		return len(counters) == 1 && *counters[0].Delta == 5
+	}, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		gauges := a.gauges()
+		return len(gauges) == 2 && *gauges[0].Value == 15 && gauges[1].Set.Estimate() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	gauges := a.gauges()
+	assert.Equal(t, "test", gauges[0].Labels["host"])
+	assert.Equal(t, "set", gauges[1].MType)
+	assert.Equal(t, "test", gauges[1].Labels["host"])
+	assert.Len(t, a.gauges(), 2, "gauges and sets keep their value between reports")
+
+	// после подтверждения отправки приращения счетчиков сбрасываются
+	a.counters.Commit(a.counters.Snapshot())
+	assert.Empty(t, a.counters.Snapshot())
+}
@@ -0,0 +1,282 @@
+// Package alert implements threshold rules evaluated over incoming metric updates.
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"metralert/internal/metrics"
+)
+
+const (
+	// FuncValue compares the current metric value with the threshold.
+	FuncValue string = "value"
+	// FuncRate compares the counter growth rate per RateInterval with the threshold.
+	FuncRate string = "rate"
+
+	defaultRateInterval = 60
+)
+
+// State describes the lifecycle stage of an alert.
+type State string
+
+const (
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+var operators = []string{">", ">=", "<", "<=", "==", "!="}
+
+// Rule describes a single threshold condition loaded from the server configuration.
+type Rule struct {
+	Name         string  `mapstructure:"name" json:"name"`
+	Metric       string  `mapstructure:"metric" json:"metric"`
+	MType        string  `mapstructure:"type" json:"type"`
+	Func         string  `mapstructure:"func" json:"func"`
+	Op           string  `mapstructure:"op" json:"op"`
+	Threshold    float64 `mapstructure:"threshold" json:"threshold"`
+	For          int     `mapstructure:"for" json:"for"`                     // количество подряд идущих обновлений
+	RateInterval int     `mapstructure:"rate_interval" json:"rate_interval"` // интервал в секундах для func=rate
+}
+
+// Alert is a snapshot of a rule state change or of a currently firing rule.
+type Alert struct {
+	Rule      string            `json:"rule"`
+	Metric    string            `json:"metric"`
+	MType     string            `json:"type"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	State     State             `json:"state"`
+	Value     float64           `json:"value"`
+	Op        string            `json:"op"`
+	Threshold float64           `json:"threshold"`
+	Since     time.Time         `json:"since"`
+}
+
+// Key identifies the alert by rule and metric labels.
+func (a Alert) Key() string {
+	return metrics.Key(a.Rule, a.Labels)
+}
+
+// ruleState holds the evaluation progress of a single rule for one labelled series.
+type ruleState struct {
+	labels      map[string]string
+	consecutive int
+	firing      bool
+	since       time.Time
+	value       float64
+
+	// предыдущее значение счетчика для вычисления скорости
+	hasPrev  bool
+	prevVal  float64
+	prevTime time.Time
+}
+
+// Engine evaluates the configured rules every time metrics are updated
+// and tracks firing/resolved state per rule and metric labels.
+type Engine struct {
+	mutex  sync.Mutex
+	rules  []Rule
+	states map[string]map[string]*ruleState // rule name -> labels key -> state
+	now    func() time.Time
+}
+
+// Validate checks the rule and fills the defaults.
+func (r *Rule) Validate() error {
+	if r.Name == "" {
+		return errors.New("rule name is empty")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("rule %s: metric is empty", r.Name)
+	}
+	if r.MType != "gauge" && r.MType != "counter" {
+		return fmt.Errorf("rule %s: invalid metric type %q", r.Name, r.MType)
+	}
+	if r.Func == "" {
+		r.Func = FuncValue
+	}
+	if r.Func != FuncValue && r.Func != FuncRate {
+		return fmt.Errorf("rule %s: invalid func %q", r.Name, r.Func)
+	}
+	if r.Func == FuncRate && r.MType != "counter" {
+		return fmt.Errorf("rule %s: rate is supported only for counters", r.Name)
+	}
+	if !slices.Contains(operators, r.Op) {
+		return fmt.Errorf("rule %s: invalid operator %q", r.Name, r.Op)
+	}
+	if r.For <= 0 {
+		r.For = 1
+	}
+	if r.RateInterval <= 0 {
+		r.RateInterval = defaultRateInterval
+	}
+	return nil
+}
+
+// NewEngine validates the rules and creates an Engine for them.
+// Rule names must be unique.
+func NewEngine(rules []Rule) (*Engine, error) {
+	e := &Engine{
+		rules:  make([]Rule, 0, len(rules)),
+		states: make(map[string]map[string]*ruleState, len(rules)),
+		now:    time.Now,
+	}
+
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := e.states[r.Name]; ok {
+			return nil, fmt.Errorf("rule %s: duplicate name", r.Name)
+		}
+		e.rules = append(e.rules, r)
+		e.states[r.Name] = make(map[string]*ruleState)
+	}
+	return e, nil
+}
+
+// Rules returns a copy of the configured rules.
+func (e *Engine) Rules() []Rule {
+	return slices.Clone(e.rules)
+}
+
+// Evaluate applies the rules to the updated metrics and returns the alerts
+// whose state changed (became firing or resolved) during this evaluation.
+func (e *Engine) Evaluate(updated []metrics.Metrics) []Alert {
+	var changed []Alert
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	now := e.now()
+	for _, m := range updated {
+		for _, r := range e.rules {
+			if r.Metric != m.ID || r.MType != m.MType {
+				continue
+			}
+			value, ok := metricValue(m)
+			if !ok {
+				continue
+			}
+			if a, ok := e.apply(r, m.Labels, value, now); ok {
+				changed = append(changed, a)
+			}
+		}
+	}
+	return changed
+}
+
+// apply updates the rule state with a new observation.
+// The second return value reports whether the rule changed its state.
+func (e *Engine) apply(r Rule, labels map[string]string, value float64, now time.Time) (Alert, bool) {
+	key := metrics.CanonicalLabels(labels)
+	st, ok := e.states[r.Name][key]
+	if !ok {
+		st = &ruleState{labels: maps.Clone(labels)}
+		e.states[r.Name][key] = st
+	}
+
+	observed := value
+	if r.Func == FuncRate {
+		if !st.hasPrev {
+			st.hasPrev, st.prevVal, st.prevTime = true, value, now
+			return Alert{}, false
+		}
+		elapsed := now.Sub(st.prevTime).Seconds()
+		if elapsed <= 0 {
+			return Alert{}, false
+		}
+		observed = (value - st.prevVal) / elapsed * float64(r.RateInterval)
+		st.prevVal, st.prevTime = value, now
+	}
+	st.value = observed
+
+	if compare(observed, r.Op, r.Threshold) {
+		st.consecutive++
+		if !st.firing && st.consecutive >= r.For {
+			st.firing = true
+			st.since = now
+			return newAlert(r, st, StateFiring), true
+		}
+		return Alert{}, false
+	}
+
+	st.consecutive = 0
+	if st.firing {
+		st.firing = false
+		st.since = now
+		return newAlert(r, st, StateResolved), true
+	}
+	return Alert{}, false
+}
+
+// Active returns currently firing alerts sorted by rule name and labels.
+func (e *Engine) Active() []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	result := make([]Alert, 0)
+	for _, r := range e.rules {
+		for _, st := range e.states[r.Name] {
+			if st.firing {
+				result = append(result, newAlert(r, st, StateFiring))
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key() < result[j].Key()
+	})
+	return result
+}
+
+func newAlert(r Rule, st *ruleState, state State) Alert {
+	return Alert{
+		Rule:      r.Name,
+		Metric:    r.Metric,
+		MType:     r.MType,
+		Labels:    st.labels,
+		State:     state,
+		Value:     st.value,
+		Op:        r.Op,
+		Threshold: r.Threshold,
+		Since:     st.since,
+	}
+}
+
+func metricValue(m metrics.Metrics) (float64, bool) {
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return 0, false
+		}
+		return *m.Value, true
+	case "counter":
+		if m.Delta == nil {
+			return 0, false
+		}
+		return float64(*m.Delta), true
+	}
+	return 0, false
+}
+
+func compare(value float64, op string, threshold float64) bool {
+	switch op {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case "==":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"metralert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(id string, v float64) metrics.Metrics {
+	return metrics.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func counter(id string, d int64) metrics.Metrics {
+	return metrics.Metrics{ID: id, MType: "counter", Delta: &d}
+}
+
+func TestEngine_GaugeThresholdFor(t *testing.T) {
+	e, err := NewEngine([]Rule{{
+		Name:      "HighHeap",
+		Metric:    "HeapAlloc",
+		MType:     "gauge",
+		Op:        ">",
+		Threshold: 500,
+		For:       3,
+	}})
+	require.NoError(t, err)
+
+	assert.Empty(t, e.Evaluate([]metrics.Metrics{gauge("HeapAlloc", 600)}))
+	assert.Empty(t, e.Evaluate([]metrics.Metrics{gauge("HeapAlloc", 700)}))
+	assert.Empty(t, e.Active())
+
+	changed := e.Evaluate([]metrics.Metrics{gauge("HeapAlloc", 800)})
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateFiring, changed[0].State)
+	assert.Equal(t, 800.0, changed[0].Value)
+	assert.Len(t, e.Active(), 1)
+
+	// повторное срабатывание не меняет состояние
+	assert.Empty(t, e.Evaluate([]metrics.Metrics{gauge("HeapAlloc", 900)}))
+
+	changed = e.Evaluate([]metrics.Metrics{gauge("HeapAlloc", 100)})
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateResolved, changed[0].State)
+	assert.Empty(t, e.Active())
+}
+
+func TestEngine_CounterRate(t *testing.T) {
+	e, err := NewEngine([]Rule{{
+		Name:      "PollStalled",
+		Metric:    "PollCount",
+		MType:     "counter",
+		Func:      FuncRate,
+		Op:        "<",
+		Threshold: 1,
+	}})
+	require.NoError(t, err)
+
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+
+	assert.Empty(t, e.Evaluate([]metrics.Metrics{counter("PollCount", 10)}))
+
+	now = now.Add(time.Minute)
+	assert.Empty(t, e.Evaluate([]metrics.Metrics{counter("PollCount", 20)}))
+
+	now = now.Add(time.Minute)
+	changed := e.Evaluate([]metrics.Metrics{counter("PollCount", 20)})
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateFiring, changed[0].State)
+	assert.Equal(t, 0.0, changed[0].Value)
+}
+
+func TestNewEngine_InvalidRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"empty name", Rule{Metric: "A", MType: "gauge", Op: ">"}},
+		{"bad type", Rule{Name: "r", Metric: "A", MType: "bad", Op: ">"}},
+		{"bad op", Rule{Name: "r", Metric: "A", MType: "gauge", Op: "=>"}},
+		{"rate on gauge", Rule{Name: "r", Metric: "A", MType: "gauge", Func: FuncRate, Op: ">"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEngine([]Rule{tt.rule})
+			assert.Error(t, err)
+		})
+	}
+}
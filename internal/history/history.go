@@ -0,0 +1,190 @@
+// Package history downsamples stored metric samples into fixed step buckets.
+package history
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"metralert/internal/metrics"
+)
+
+const (
+	FuncAvg  string = "avg"
+	FuncMin  string = "min"
+	FuncMax  string = "max"
+	FuncLast string = "last"
+	FuncSum  string = "sum"
+	FuncRate string = "rate"
+
+	// MaxPoints ограничивает количество бакетов в одном запросе
+	MaxPoints = 11000
+)
+
+var funcs = []string{FuncAvg, FuncMin, FuncMax, FuncLast, FuncSum, FuncRate}
+
+// Point is an aggregated value of a single step bucket.
+type Point struct {
+	TS    time.Time `json:"ts"`
+	Value float64   `json:"value"`
+}
+
+// Query describes a range query over the history of a single metric.
+type Query struct {
+	ID    string
+	MType string
+	From  time.Time
+	To    time.Time
+	Step  time.Duration
+	Func  string
+}
+
+// Validate checks the query parameters.
+func (q Query) Validate() error {
+	if q.ID == "" {
+		return errors.New("id is empty")
+	}
+	if q.MType != "gauge" && q.MType != "counter" {
+		return fmt.Errorf("invalid type %q", q.MType)
+	}
+	if !q.To.After(q.From) {
+		return errors.New("to must be after from")
+	}
+	if q.Step <= 0 {
+		return errors.New("step must be positive")
+	}
+	if q.To.Sub(q.From)/q.Step > MaxPoints {
+		return fmt.Errorf("too many points, at most %d are allowed", MaxPoints)
+	}
+	if !slices.Contains(funcs, q.Func) {
+		return fmt.Errorf("invalid func %q", q.Func)
+	}
+	if q.Func == FuncRate && q.MType != "counter" {
+		return errors.New("rate is supported only for counters")
+	}
+	return nil
+}
+
+// Downsample groups the samples into [From, To) buckets of Step width and applies
+// the aggregation function to every bucket. Empty buckets are omitted.
+// Samples are expected to be sorted by time. For counters the stored cumulative
+// value is aggregated, except sum, which returns the increase within the bucket,
+// and rate, which returns the per second increase within the bucket.
+func Downsample(samples []metrics.Sample, q Query) ([]Point, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := make([]Point, 0)
+
+	var (
+		bucket     []float64
+		bucketIdx  = -1
+		prev       float64
+		hasPrev    bool
+		bucketPrev float64
+		bucketHas  bool
+	)
+
+	flush := func() {
+		if len(bucket) == 0 {
+			return
+		}
+		ts := q.From.Add(time.Duration(bucketIdx) * q.Step)
+		result = append(result, Point{
+			TS:    ts,
+			Value: aggregate(q.Func, q.MType, bucket, bucketPrev, bucketHas, q.Step),
+		})
+	}
+
+	for _, sample := range samples {
+		value, ok := sampleValue(sample)
+		if !ok {
+			continue
+		}
+		if sample.TS.Before(q.From) {
+			prev, hasPrev = value, true
+			continue
+		}
+		if !sample.TS.Before(q.To) {
+			break
+		}
+
+		idx := int(sample.TS.Sub(q.From) / q.Step)
+		if idx != bucketIdx {
+			flush()
+			bucket = bucket[:0]
+			bucketIdx = idx
+			// значение перед началом бакета нужно для вычисления rate
+			bucketPrev, bucketHas = prev, hasPrev
+		}
+		bucket = append(bucket, value)
+		prev, hasPrev = value, true
+	}
+	flush()
+
+	return result, nil
+}
+
+func aggregate(fn string, mtype string, values []float64, prev float64, hasPrev bool, step time.Duration) float64 {
+	switch fn {
+	case FuncMin:
+		return slices.Min(values)
+	case FuncMax:
+		return slices.Max(values)
+	case FuncLast:
+		return values[len(values)-1]
+	case FuncSum:
+		// сумма накопленных значений счетчика не имеет смысла, суммируются приросты
+		if mtype == "counter" {
+			return increase(values, prev, hasPrev)
+		}
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	case FuncRate:
+		return increase(values, prev, hasPrev) / step.Seconds()
+	default:
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	}
+}
+
+// increase суммирует приросты счетчика между соседними значениями, начиная со значения prev
+// перед бакетом. Без prev отсчет ведется от первого значения бакета.
+// Уменьшение значения считается сбросом счетчика, приростом тогда считается само значение.
+func increase(values []float64, prev float64, hasPrev bool) float64 {
+	if !hasPrev {
+		prev = values[0]
+	}
+	var sum float64
+	for _, v := range values {
+		if v < prev {
+			sum += v
+		} else {
+			sum += v - prev
+		}
+		prev = v
+	}
+	return sum
+}
+
+func sampleValue(s metrics.Sample) (float64, bool) {
+	switch {
+	case s.Value != nil:
+		if math.IsNaN(*s.Value) {
+			return 0, false
+		}
+		return *s.Value, true
+	case s.Delta != nil:
+		return float64(*s.Delta), true
+	}
+	return 0, false
+}
@@ -0,0 +1,124 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"metralert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gaugeSample(ts time.Time, v float64) metrics.Sample {
+	return metrics.Sample{TS: ts, ID: "HeapAlloc", MType: "gauge", Value: &v}
+}
+
+func counterSample(ts time.Time, d int64) metrics.Sample {
+	return metrics.Sample{TS: ts, ID: "PollCount", MType: "counter", Delta: &d}
+}
+
+func TestDownsample_Gauge(t *testing.T) {
+	from := time.Unix(0, 0)
+	samples := []metrics.Sample{
+		gaugeSample(from.Add(10*time.Second), 1),
+		gaugeSample(from.Add(20*time.Second), 3),
+		gaugeSample(from.Add(70*time.Second), 5),
+		gaugeSample(from.Add(190*time.Second), 7),
+	}
+
+	tests := []struct {
+		fn   string
+		want []float64
+	}{
+		{FuncAvg, []float64{2, 5, 7}},
+		{FuncMin, []float64{1, 5, 7}},
+		{FuncMax, []float64{3, 5, 7}},
+		{FuncLast, []float64{3, 5, 7}},
+		{FuncSum, []float64{4, 5, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fn, func(t *testing.T) {
+			points, err := Downsample(samples, Query{
+				ID:    "HeapAlloc",
+				MType: "gauge",
+				From:  from,
+				To:    from.Add(4 * time.Minute),
+				Step:  time.Minute,
+				Func:  tt.fn,
+			})
+			require.NoError(t, err)
+			require.Len(t, points, len(tt.want))
+			for i, p := range points {
+				assert.Equal(t, tt.want[i], p.Value)
+			}
+			assert.Equal(t, from.Add(3*time.Minute), points[2].TS)
+		})
+	}
+}
+
+func TestDownsample_CounterRate(t *testing.T) {
+	from := time.Unix(0, 0)
+	samples := []metrics.Sample{
+		counterSample(from.Add(-10*time.Second), 100),
+		counterSample(from.Add(30*time.Second), 130),
+		counterSample(from.Add(50*time.Second), 160),
+		counterSample(from.Add(90*time.Second), 220),
+	}
+
+	points, err := Downsample(samples, Query{
+		ID:    "PollCount",
+		MType: "counter",
+		From:  from,
+		To:    from.Add(2 * time.Minute),
+		Step:  time.Minute,
+		Func:  FuncRate,
+	})
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	assert.Equal(t, 1.0, points[0].Value)
+	assert.Equal(t, 1.0, points[1].Value)
+}
+
+func TestDownsample_CounterSum(t *testing.T) {
+	from := time.Unix(0, 0)
+	samples := []metrics.Sample{
+		counterSample(from.Add(-10*time.Second), 100),
+		counterSample(from.Add(10*time.Second), 130),
+		counterSample(from.Add(30*time.Second), 160),
+		// сброс счетчика
+		counterSample(from.Add(50*time.Second), 20),
+		counterSample(from.Add(90*time.Second), 50),
+	}
+
+	points, err := Downsample(samples, Query{
+		ID:    "PollCount",
+		MType: "counter",
+		From:  from,
+		To:    from.Add(2 * time.Minute),
+		Step:  time.Minute,
+		Func:  FuncSum,
+	})
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	assert.Equal(t, 80.0, points[0].Value)
+	assert.Equal(t, 30.0, points[1].Value)
+}
+
+func TestQuery_Validate(t *testing.T) {
+	from := time.Unix(0, 0)
+	base := Query{ID: "HeapAlloc", MType: "gauge", From: from, To: from.Add(time.Hour), Step: time.Minute, Func: FuncAvg}
+	assert.NoError(t, base.Validate())
+
+	rate := base
+	rate.Func = FuncRate
+	assert.Error(t, rate.Validate())
+
+	tooMany := base
+	tooMany.Step = time.Millisecond
+	assert.Error(t, tooMany.Validate())
+
+	reversed := base
+	reversed.To = from.Add(-time.Hour)
+	assert.Error(t, reversed.Validate())
+}
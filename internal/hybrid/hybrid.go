@@ -0,0 +1,252 @@
+// Package hybrid implements envelope encryption of agent payloads.
+//
+// A random AES-256-GCM data key encrypts the payload, so payloads of any size can be encrypted
+// with an asymmetric key. The data key is either wrapped with RSA-OAEP (SHA-256) for RSA keys
+// or derived with HKDF-SHA256 from an ephemeral ECDH exchange for X25519 and ECDSA P-256 keys.
+// The envelope layout is:
+//
+//	magic "MAE" | version (1 byte) | key material length (uint16, big endian) | key material | nonce (12 bytes) | ciphertext
+//
+// The key material is the wrapped data key in version 1 and the ephemeral public key in version 2.
+// The header is authenticated as additional data of the GCM ciphertext.
+package hybrid
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	// VersionRSA is the envelope version with an RSA-OAEP wrapped data key.
+	VersionRSA byte = 1
+	// VersionECDH is the envelope version with a data key derived from an ephemeral ECDH exchange.
+	VersionECDH byte = 2
+	// KeyIDHeader carries the ID of the public key the payload was encrypted with.
+	KeyIDHeader = "X-Encryption-Key-ID"
+
+	magic       = "MAE"
+	dataKeySize = 32
+	headerSize  = len(magic) + 1 + 2
+	hkdfInfo    = "metralert hybrid envelope v2"
+)
+
+var (
+	// ErrNotEnvelope is returned when the data does not start with the envelope header.
+	ErrNotEnvelope = errors.New("data is not an encrypted envelope")
+	// ErrUnsupportedVersion is returned for envelopes of an unknown version.
+	ErrUnsupportedVersion = errors.New("unsupported envelope version")
+	// ErrMalformed is returned when the envelope is truncated.
+	ErrMalformed = errors.New("malformed envelope")
+	// ErrUnsupportedKey is returned for keys that can not be used for envelope encryption
+	// or do not match the envelope version.
+	ErrUnsupportedKey = errors.New("unsupported key type")
+)
+
+// KeyID returns the identifier of a public key:
+// the first 8 bytes of the SHA-256 of its PKIX encoding in hex.
+func KeyID(publicKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// IsEnvelope reports whether the data starts with the envelope magic.
+func IsEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(magic))
+}
+
+// Seal encrypts the plaintext for the owner of the public key.
+// RSA, ECDSA P-256 and X25519 public keys are supported.
+func Seal(publicKey crypto.PublicKey, plaintext []byte) ([]byte, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return sealRSA(key, plaintext)
+	case *ecdsa.PublicKey:
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnsupportedKey, err)
+		}
+		return sealECDH(ecdhKey, plaintext)
+	case *ecdh.PublicKey:
+		return sealECDH(key, plaintext)
+	default:
+		return nil, fmt.Errorf("%w %T", ErrUnsupportedKey, publicKey)
+	}
+}
+
+// Open decrypts an envelope produced by Seal with the private key.
+func Open(privateKey crypto.PrivateKey, data []byte) ([]byte, error) {
+	if !IsEnvelope(data) {
+		return nil, ErrNotEnvelope
+	}
+	if len(data) < headerSize {
+		return nil, ErrMalformed
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(data[len(magic)+1:]))
+	rest := data[headerSize:]
+	if len(rest) < keyLen {
+		return nil, ErrMalformed
+	}
+	keyMaterial, rest := rest[:keyLen], rest[keyLen:]
+
+	var (
+		dataKey []byte
+		aad     []byte
+	)
+	switch version := data[len(magic)]; version {
+	case VersionRSA:
+		rsaKey, ok := privateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%w %T for RSA envelope", ErrUnsupportedKey, privateKey)
+		}
+		var err error
+		dataKey, err = rsa.DecryptOAEP(sha256.New(), nil, rsaKey, keyMaterial, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to unwrap data key: %w", err)
+		}
+		aad = data[:len(magic)+1]
+	case VersionECDH:
+		ecdhKey, err := ecdhPrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := ecdhKey.Curve().NewPublicKey(keyMaterial)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+		}
+		shared, err := ecdhKey.ECDH(ephemeral)
+		if err != nil {
+			return nil, fmt.Errorf("unable to derive shared secret: %w", err)
+		}
+		dataKey, err = deriveKey(shared, ephemeral, ecdhKey.PublicKey())
+		if err != nil {
+			return nil, err
+		}
+		aad = data[:headerSize+keyLen]
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+// sealRSA encrypts the plaintext with a random data key wrapped with RSA-OAEP.
+func sealRSA(publicKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to wrap data key: %w", err)
+	}
+
+	header := appendHeader(nil, VersionRSA, wrappedKey)
+	return seal(header, dataKey, plaintext, header[:len(magic)+1])
+}
+
+// sealECDH encrypts the plaintext with a data key derived from an ephemeral ECDH exchange.
+func sealECDH(publicKey *ecdh.PublicKey, plaintext []byte) ([]byte, error) {
+	ephemeral, err := publicKey.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive shared secret: %w", err)
+	}
+	dataKey, err := deriveKey(shared, ephemeral.PublicKey(), publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := appendHeader(nil, VersionECDH, ephemeral.PublicKey().Bytes())
+	return seal(header, dataKey, plaintext, header)
+}
+
+// deriveKey derives the data key from the ECDH shared secret.
+// The salt binds the key to the ephemeral and the recipient public keys.
+func deriveKey(shared []byte, ephemeral *ecdh.PublicKey, recipient *ecdh.PublicKey) ([]byte, error) {
+	salt := append(bytes.Clone(ephemeral.Bytes()), recipient.Bytes()...)
+	return hkdf.Key(sha256.New, shared, salt, hkdfInfo, dataKeySize)
+}
+
+// ecdhPrivateKey converts a private key to an ECDH key.
+func ecdhPrivateKey(privateKey crypto.PrivateKey) (*ecdh.PrivateKey, error) {
+	switch key := privateKey.(type) {
+	case *ecdh.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnsupportedKey, err)
+		}
+		return ecdhKey, nil
+	default:
+		return nil, fmt.Errorf("%w %T for ECDH envelope", ErrUnsupportedKey, privateKey)
+	}
+}
+
+// appendHeader appends the envelope header with the key material.
+func appendHeader(out []byte, version byte, keyMaterial []byte) []byte {
+	out = append(out, magic...)
+	out = append(out, version)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(keyMaterial)))
+	return append(out, keyMaterial...)
+}
+
+// seal appends a random nonce and the GCM ciphertext of the plaintext to the header.
+func seal(header []byte, dataKey []byte, plaintext []byte, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, aad), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
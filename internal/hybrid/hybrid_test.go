@@ -0,0 +1,104 @@
+package hybrid
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealOpen(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	large := bytes.Repeat([]byte("metric"), 100000)
+	for name, plaintext := range map[string][]byte{
+		"small": []byte("test data for encryption"),
+		"large": large,
+		"empty": {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sealed, err := Seal(&privateKey.PublicKey, plaintext)
+			require.NoError(t, err)
+			assert.True(t, IsEnvelope(sealed))
+
+			opened, err := Open(privateKey, sealed)
+			require.NoError(t, err)
+			assert.Equal(t, len(plaintext), len(opened))
+			assert.True(t, bytes.Equal(plaintext, opened))
+		})
+	}
+}
+
+func TestSealOpen_ECDH(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for name, tt := range map[string]struct {
+		privateKey crypto.PrivateKey
+		publicKey  crypto.PublicKey
+	}{
+		"ecdsa-p256": {ecdsaKey, &ecdsaKey.PublicKey},
+		"x25519":     {x25519Key, x25519Key.PublicKey()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			plaintext := bytes.Repeat([]byte("metric"), 10000)
+			sealed, err := Seal(tt.publicKey, plaintext)
+			require.NoError(t, err)
+			assert.Equal(t, VersionECDH, sealed[len(magic)])
+
+			opened, err := Open(tt.privateKey, sealed)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(plaintext, opened))
+
+			// эфемерный ключ входит в аутентифицированный заголовок
+			tampered := bytes.Clone(sealed)
+			tampered[headerSize] ^= 0x01
+			_, err = Open(tt.privateKey, tampered)
+			assert.Error(t, err)
+
+			rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			require.NoError(t, err)
+			_, err = Open(rsaKey, sealed)
+			assert.ErrorIs(t, err, ErrUnsupportedKey)
+		})
+	}
+}
+
+func TestOpen_Errors(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	sealed, err := Seal(&privateKey.PublicKey, []byte("payload"))
+	require.NoError(t, err)
+
+	_, err = Open(privateKey, []byte("plain"))
+	assert.ErrorIs(t, err, ErrNotEnvelope)
+
+	_, err = Open(privateKey, sealed[:10])
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	wrongVersion := bytes.Clone(sealed)
+	wrongVersion[len(magic)] = 99
+	_, err = Open(privateKey, wrongVersion)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = Open(privateKey, tampered)
+	assert.Error(t, err)
+
+	_, err = Open(otherKey, sealed)
+	assert.Error(t, err)
+}
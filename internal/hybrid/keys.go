@@ -0,0 +1,174 @@
+package hybrid
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	// FormatPKCS8 encodes private keys as PKCS#8 and public keys as PKIX.
+	FormatPKCS8 = "pkcs8"
+	// FormatPKCS1 encodes RSA keys as PKCS#1 and ECDSA private keys as SEC 1, the formats of older tools.
+	FormatPKCS1 = "pkcs1"
+
+	// KeyIDPEMHeader is the PEM header with the key ID written by cryptogen.
+	KeyIDPEMHeader = "Key-ID"
+)
+
+var (
+	// ErrNotPEM is returned when the data does not contain a PEM block.
+	ErrNotPEM = errors.New("unable to decode PEM block")
+	// ErrNotPrivateKey is returned for PEM blocks that do not hold a private key.
+	ErrNotPrivateKey = errors.New("PEM block is not a private key")
+	// ErrNotPublicKey is returned for PEM blocks that do not hold a public key.
+	ErrNotPublicKey = errors.New("PEM block is not a public key")
+)
+
+// ParsePublicKeyPEM decodes a public key in PKCS#1 ("RSA PUBLIC KEY") or PKIX ("PUBLIC KEY") PEM encoding.
+func ParsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNotPEM
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkPublicKey(publicKey); err != nil {
+			return nil, err
+		}
+		return publicKey, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNotPublicKey, block.Type)
+	}
+}
+
+// ParsePrivateKeyPEM decodes a private key in PKCS#1 ("RSA PRIVATE KEY"), SEC 1 ("EC PRIVATE KEY")
+// or PKCS#8 ("PRIVATE KEY") PEM encoding.
+func ParsePrivateKeyPEM(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNotPEM
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err := PublicKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkPublicKey(publicKey); err != nil {
+			return nil, err
+		}
+		return privateKey, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNotPrivateKey, block.Type)
+	}
+}
+
+// PublicKey returns the public key of a private key.
+func PublicKey(privateKey crypto.PrivateKey) (crypto.PublicKey, error) {
+	key, ok := privateKey.(interface{ Public() crypto.PublicKey })
+	if !ok {
+		return nil, fmt.Errorf("%w %T", ErrUnsupportedKey, privateKey)
+	}
+	return key.Public(), nil
+}
+
+// EncodePrivateKeyPEM encodes the private key in the format with the optional PEM headers.
+func EncodePrivateKeyPEM(privateKey crypto.PrivateKey, format string, headers map[string]string) ([]byte, error) {
+	block := &pem.Block{Headers: headers}
+	var err error
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if format == FormatPKCS1 {
+			block.Type, block.Bytes = "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)
+			break
+		}
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+	case *ecdsa.PrivateKey:
+		if format == FormatPKCS1 {
+			block.Type = "EC PRIVATE KEY"
+			block.Bytes, err = x509.MarshalECPrivateKey(key)
+			break
+		}
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+	case *ecdh.PrivateKey:
+		if format == FormatPKCS1 {
+			return nil, fmt.Errorf("%s is not supported for %s keys, use %s", format, key.Curve(), FormatPKCS8)
+		}
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+	default:
+		return nil, fmt.Errorf("%w %T", ErrUnsupportedKey, privateKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// EncodePublicKeyPEM encodes the public key in the format with the optional PEM headers.
+// Only RSA keys have a PKCS#1 encoding, other keys are always encoded as PKIX.
+func EncodePublicKeyPEM(publicKey crypto.PublicKey, format string, headers map[string]string) ([]byte, error) {
+	if key, ok := publicKey.(*rsa.PublicKey); ok && format == FormatPKCS1 {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Headers: headers, Bytes: x509.MarshalPKCS1PublicKey(key)}), nil
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: headers, Bytes: der}), nil
+}
+
+// Describe returns a short description of the key algorithm, e.g. "RSA-4096" or "X25519".
+func Describe(key any) string {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case *ecdsa.PrivateKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case *ecdh.PrivateKey:
+		return fmt.Sprint(k.Curve())
+	case *ecdh.PublicKey:
+		return fmt.Sprint(k.Curve())
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+}
+
+// checkPublicKey rejects keys that can not be used by Seal, such as Ed25519.
+func checkPublicKey(publicKey crypto.PublicKey) error {
+	switch publicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, *ecdh.PublicKey:
+		return nil
+	default:
+		return fmt.Errorf("%w %T", ErrUnsupportedKey, publicKey)
+	}
+}
@@ -0,0 +1,110 @@
+package hybrid
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeParsePEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		privateKey  crypto.PrivateKey
+		format      string
+		privateType string
+		publicType  string
+		describe    string
+	}{
+		{"rsa pkcs8", rsaKey, FormatPKCS8, "PRIVATE KEY", "PUBLIC KEY", "RSA-2048"},
+		{"rsa pkcs1", rsaKey, FormatPKCS1, "RSA PRIVATE KEY", "RSA PUBLIC KEY", "RSA-2048"},
+		{"ecdsa pkcs8", ecdsaKey, FormatPKCS8, "PRIVATE KEY", "PUBLIC KEY", "ECDSA P-256"},
+		{"ecdsa sec1", ecdsaKey, FormatPKCS1, "EC PRIVATE KEY", "PUBLIC KEY", "ECDSA P-256"},
+		{"x25519 pkcs8", x25519Key, FormatPKCS8, "PRIVATE KEY", "PUBLIC KEY", "X25519"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publicKey, err := PublicKey(tt.privateKey)
+			require.NoError(t, err)
+			keyID, err := KeyID(publicKey)
+			require.NoError(t, err)
+			headers := map[string]string{KeyIDPEMHeader: keyID}
+
+			privatePEM, err := EncodePrivateKeyPEM(tt.privateKey, tt.format, headers)
+			require.NoError(t, err)
+			block, _ := pem.Decode(privatePEM)
+			require.NotNil(t, block)
+			assert.Equal(t, tt.privateType, block.Type)
+			assert.Equal(t, keyID, block.Headers[KeyIDPEMHeader])
+
+			publicPEM, err := EncodePublicKeyPEM(publicKey, tt.format, headers)
+			require.NoError(t, err)
+			block, _ = pem.Decode(publicPEM)
+			require.NotNil(t, block)
+			assert.Equal(t, tt.publicType, block.Type)
+
+			parsedPrivate, err := ParsePrivateKeyPEM(privatePEM)
+			require.NoError(t, err)
+			assert.Equal(t, tt.describe, Describe(parsedPrivate))
+			parsedPublic, err := ParsePublicKeyPEM(publicPEM)
+			require.NoError(t, err)
+			assert.Equal(t, tt.describe, Describe(parsedPublic))
+
+			parsedID, err := KeyID(parsedPublic)
+			require.NoError(t, err)
+			assert.Equal(t, keyID, parsedID)
+
+			sealed, err := Seal(parsedPublic, []byte("payload"))
+			require.NoError(t, err)
+			opened, err := Open(parsedPrivate, sealed)
+			require.NoError(t, err)
+			assert.Equal(t, "payload", string(opened))
+		})
+	}
+
+	_, err = EncodePrivateKeyPEM(x25519Key, FormatPKCS1, nil)
+	assert.Error(t, err)
+}
+
+func TestParsePEM_Errors(t *testing.T) {
+	_, err := ParsePrivateKeyPEM(nil)
+	assert.ErrorIs(t, err, ErrNotPEM)
+	_, err = ParsePublicKeyPEM([]byte("not a key"))
+	assert.ErrorIs(t, err, ErrNotPEM)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	publicPEM, err := EncodePublicKeyPEM(&rsaKey.PublicKey, FormatPKCS8, nil)
+	require.NoError(t, err)
+	_, err = ParsePrivateKeyPEM(publicPEM)
+	assert.ErrorIs(t, err, ErrNotPrivateKey)
+
+	privatePEM, err := EncodePrivateKeyPEM(rsaKey, FormatPKCS8, nil)
+	require.NoError(t, err)
+	_, err = ParsePublicKeyPEM(privatePEM)
+	assert.ErrorIs(t, err, ErrNotPublicKey)
+
+	// ключи Ed25519 не подходят для шифрования
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	require.NoError(t, err)
+	_, err = ParsePrivateKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+}
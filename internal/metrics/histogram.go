@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultBuckets - верхние границы бакетов гистограммы по умолчанию.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ReportedQuantiles - квантили, которые сервер возвращает для гистограмм в /value/.
+var ReportedQuantiles = []float64{0.5, 0.95, 0.99}
+
+// generate:reset
+type Histogram struct {
+	Count  uint64    `json:"count"`  // количество наблюдений
+	Sum    float64   `json:"sum"`    // сумма наблюдений
+	Bounds []float64 `json:"bounds"` // верхние границы бакетов по возрастанию, бакет +Inf не указывается
+	Counts []uint64  `json:"counts"` // количество наблюдений в каждом бакете, включая +Inf, не накопленное
+	// Quantiles - оценки квантилей вида p50, заполняются сервером в ответах /value/.
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// NewHistogram создает пустую гистограмму с границами бакетов bounds.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		Bounds: slices.Clone(bounds),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// ParseBuckets разбирает границы бакетов, перечисленные через запятую.
+// Пустая строка возвращает DefaultBuckets.
+func ParseBuckets(s string) ([]float64, error) {
+	if s == "" {
+		return DefaultBuckets, nil
+	}
+	var bounds []float64
+	for part := range strings.SplitSeq(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q", part)
+		}
+		bounds = append(bounds, v)
+	}
+	if err := validateBounds(bounds); err != nil {
+		return nil, err
+	}
+	return bounds, nil
+}
+
+// validateBounds проверяет, что границы бакетов заданы, конечны и строго возрастают.
+func validateBounds(bounds []float64) error {
+	if len(bounds) == 0 {
+		return errors.New("histogram has no buckets")
+	}
+	for i, b := range bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("invalid bucket bound %v", b)
+		}
+		if i > 0 && b <= bounds[i-1] {
+			return errors.New("bucket bounds must be strictly increasing")
+		}
+	}
+	return nil
+}
+
+// Validate проверяет согласованность гистограммы: границы бакетов, число бакетов и Count.
+func (h *Histogram) Validate() error {
+	if err := validateBounds(h.Bounds); err != nil {
+		return err
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("histogram has %d bucket counts, %d expected", len(h.Counts), len(h.Bounds)+1)
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return fmt.Errorf("histogram count %d differs from the sum of buckets %d", h.Count, total)
+	}
+	if math.IsNaN(h.Sum) || math.IsInf(h.Sum, 0) {
+		return errors.New("invalid histogram sum")
+	}
+	return nil
+}
+
+// Observe добавляет наблюдение v.
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.Bounds, v)
+	h.Counts[i]++
+	h.Count++
+	h.Sum += v
+}
+
+// Merge прибавляет к гистограмме наблюдения гистограммы o.
+// Возвращает false и не изменяет гистограмму, если границы бакетов различаются.
+func (h *Histogram) Merge(o *Histogram) bool {
+	if !slices.Equal(h.Bounds, o.Bounds) || len(h.Counts) != len(o.Counts) {
+		return false
+	}
+	for i, c := range o.Counts {
+		h.Counts[i] += c
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+	return true
+}
+
+// Clone возвращает копию гистограммы без оценок квантилей.
+func (h *Histogram) Clone() *Histogram {
+	if h == nil {
+		return nil
+	}
+	return &Histogram{
+		Count:  h.Count,
+		Sum:    h.Sum,
+		Bounds: slices.Clone(h.Bounds),
+		Counts: slices.Clone(h.Counts),
+	}
+}
+
+// Quantile оценивает квантиль q (0 <= q <= 1) линейной интерполяцией внутри бакета,
+// как histogram_quantile в Prometheus. Нижней границей первого бакета считается 0,
+// если его верхняя граница положительна. Для наблюдений в бакете +Inf возвращается
+// наибольшая конечная граница. Для пустой гистограммы возвращается NaN.
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 || len(h.Bounds) == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+
+	rank := q * float64(h.Count)
+	var cumulative uint64
+	for i, c := range h.Counts {
+		if c == 0 || float64(cumulative+c) < rank {
+			cumulative += c
+			continue
+		}
+		if i == len(h.Bounds) {
+			return h.Bounds[len(h.Bounds)-1]
+		}
+		upper := h.Bounds[i]
+		lower := 0.0
+		switch {
+		case i > 0:
+			lower = h.Bounds[i-1]
+		case upper <= 0:
+			return upper
+		}
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(c)
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// QuantileName возвращает имя квантиля вида p95.
+func QuantileName(q float64) string {
+	return "p" + strconv.FormatFloat(q*100, 'f', -1, 64)
+}
+
+// SetQuantiles заполняет Quantiles оценками ReportedQuantiles.
+// Для пустой гистограммы оценки не заполняются.
+func (h *Histogram) SetQuantiles() {
+	if h.Count == 0 {
+		return
+	}
+	h.Quantiles = make(map[string]float64, len(ReportedQuantiles))
+	for _, q := range ReportedQuantiles {
+		h.Quantiles[QuantileName(q)] = h.Quantile(q)
+	}
+}
+
+// String возвращает количество, сумму и оценки ReportedQuantiles гистограммы.
+func (h *Histogram) String() string {
+	parts := []string{
+		"count=" + strconv.FormatUint(h.Count, 10),
+		"sum=" + strconv.FormatFloat(h.Sum, 'f', -1, 64),
+	}
+	for _, q := range ReportedQuantiles {
+		parts = append(parts, QuantileName(q)+"="+strconv.FormatFloat(h.Quantile(q), 'f', -1, 64))
+	}
+	return strings.Join(parts, " ")
+}
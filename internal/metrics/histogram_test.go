@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram_Observe(t *testing.T) {
+	h := NewHistogram([]float64{1, 5, 10})
+	for _, v := range []float64{0.5, 1, 3, 7, 20} {
+		h.Observe(v)
+	}
+	assert.Equal(t, []uint64{2, 1, 1, 1}, h.Counts, "bounds are inclusive upper limits")
+	assert.Equal(t, uint64(5), h.Count)
+	assert.Equal(t, 31.5, h.Sum)
+	assert.NoError(t, h.Validate())
+}
+
+func TestHistogram_Merge(t *testing.T) {
+	h := NewHistogram([]float64{1, 5})
+	h.Observe(0.5)
+	o := NewHistogram([]float64{1, 5})
+	o.Observe(3)
+	o.Observe(10)
+
+	require.True(t, h.Merge(o))
+	assert.Equal(t, []uint64{1, 1, 1}, h.Counts)
+	assert.Equal(t, uint64(3), h.Count)
+	assert.Equal(t, 13.5, h.Sum)
+
+	other := NewHistogram([]float64{2, 5})
+	other.Observe(1)
+	assert.False(t, h.Merge(other), "histograms with different buckets are not merged")
+	assert.Equal(t, uint64(3), h.Count)
+}
+
+func TestHistogram_Quantile(t *testing.T) {
+	h := NewHistogram([]float64{10, 20, 40})
+	h.Counts = []uint64{50, 40, 10, 0}
+	h.Count = 100
+
+	assert.InDelta(t, 10.0, h.Quantile(0.5), 1e-9)
+	assert.InDelta(t, 5.0, h.Quantile(0.25), 1e-9, "first bucket starts at zero")
+	assert.InDelta(t, 15.0, h.Quantile(0.7), 1e-9)
+	assert.InDelta(t, 38.0, h.Quantile(0.99), 1e-9)
+
+	h.Counts = []uint64{0, 0, 0, 5}
+	h.Count = 5
+	assert.Equal(t, 40.0, h.Quantile(0.5), "+Inf bucket returns the highest finite bound")
+
+	assert.True(t, math.IsNaN(NewHistogram([]float64{1}).Quantile(0.5)))
+}
+
+func TestHistogram_Validate(t *testing.T) {
+	assert.Error(t, (&Histogram{}).Validate())
+	assert.Error(t, (&Histogram{Bounds: []float64{2, 1}, Counts: []uint64{0, 0, 0}}).Validate())
+	assert.Error(t, (&Histogram{Bounds: []float64{1}, Counts: []uint64{0}}).Validate())
+	assert.Error(t, (&Histogram{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 1}).Validate())
+	assert.NoError(t, (&Histogram{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 2}).Validate())
+}
+
+func TestParseBuckets(t *testing.T) {
+	bounds, err := ParseBuckets("")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultBuckets, bounds)
+
+	bounds, err = ParseBuckets("0.1, 0.5,1")
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.1, 0.5, 1}, bounds)
+
+	_, err = ParseBuckets("1,abc")
+	assert.Error(t, err)
+	_, err = ParseBuckets("1,1")
+	assert.Error(t, err)
+}
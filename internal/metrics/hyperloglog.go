@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+const (
+	// DefaultPrecision - точность HyperLogLog по умолчанию: 2^12 регистров по байту,
+	// стандартная ошибка оценки около 1.6%.
+	DefaultPrecision uint8 = 12
+	// MinPrecision и MaxPrecision - допустимые значения точности HyperLogLog.
+	MinPrecision uint8 = 4
+	MaxPrecision uint8 = 16
+)
+
+// generate:reset
+type HyperLogLog struct {
+	Precision uint8  `json:"precision"` // количество бит хеша, выбирающих регистр
+	Registers []byte `json:"registers"` // 2^Precision регистров, в JSON передаются в base64
+	// Cardinality - оценка количества уникальных элементов, заполняется сервером в ответах /value/.
+	Cardinality *uint64 `json:"cardinality,omitempty"`
+}
+
+// NewHyperLogLog создает пустой HyperLogLog с точностью precision.
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	return &HyperLogLog{
+		Precision: precision,
+		Registers: make([]byte, 1<<precision),
+	}
+}
+
+// hashItem возвращает 64-битный хеш элемента: FNV-1a с финальным перемешиванием MurmurHash3,
+// чтобы старшие биты, выбирающие регистр, были распределены равномерно.
+// Хеш не зависит от процесса, поэтому наброски разных агентов можно объединять.
+func hashItem(item string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Add добавляет элемент item.
+func (s *HyperLogLog) Add(item string) {
+	x := hashItem(item)
+	index := x >> (64 - s.Precision)
+	// ограничивающий бит не дает ранговому значению выйти за 64-Precision+1
+	rank := byte(bits.LeadingZeros64(x<<s.Precision|1<<(s.Precision-1)) + 1)
+	if rank > s.Registers[index] {
+		s.Registers[index] = rank
+	}
+}
+
+// Validate проверяет точность и размер регистров.
+func (s *HyperLogLog) Validate() error {
+	if s.Precision < MinPrecision || s.Precision > MaxPrecision {
+		return fmt.Errorf("invalid precision %d, must be between %d and %d", s.Precision, MinPrecision, MaxPrecision)
+	}
+	if len(s.Registers) != 1<<s.Precision {
+		return fmt.Errorf("sketch has %d registers, %d expected", len(s.Registers), 1<<s.Precision)
+	}
+	maxRank := 64 - s.Precision + 1
+	for _, r := range s.Registers {
+		if r > maxRank {
+			return errors.New("invalid register value")
+		}
+	}
+	return nil
+}
+
+// Merge объединяет набросок с o: в каждом регистре остается максимальное значение.
+// Объединение идемпотентно, повторная отправка того же наброска не меняет оценку.
+// Возвращает false и не изменяет набросок, если точность различается.
+func (s *HyperLogLog) Merge(o *HyperLogLog) bool {
+	if s.Precision != o.Precision || len(s.Registers) != len(o.Registers) {
+		return false
+	}
+	for i, r := range o.Registers {
+		if r > s.Registers[i] {
+			s.Registers[i] = r
+		}
+	}
+	return true
+}
+
+// Clone возвращает копию наброска без оценки количества.
+func (s *HyperLogLog) Clone() *HyperLogLog {
+	if s == nil {
+		return nil
+	}
+	return &HyperLogLog{
+		Precision: s.Precision,
+		Registers: slices.Clone(s.Registers),
+	}
+}
+
+// Estimate оценивает количество уникальных добавленных элементов.
+// Для малых значений используется линейный подсчет по пустым регистрам.
+func (s *HyperLogLog) Estimate() uint64 {
+	m := float64(len(s.Registers))
+	if m == 0 {
+		return 0
+	}
+
+	var sum float64
+	var zeros int
+	for _, r := range s.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(s.Registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// SetCardinality заполняет Cardinality текущей оценкой.
+func (s *HyperLogLog) SetCardinality() {
+	estimate := s.Estimate()
+	s.Cardinality = &estimate
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHyperLogLog_Estimate(t *testing.T) {
+	s := NewHyperLogLog(DefaultPrecision)
+	assert.Equal(t, uint64(0), s.Estimate())
+
+	for _, n := range []int{10, 1000, 100000} {
+		s := NewHyperLogLog(DefaultPrecision)
+		for i := range n {
+			s.Add("user-" + strconv.Itoa(i))
+			// повторные элементы не меняют оценку
+			s.Add("user-" + strconv.Itoa(i))
+		}
+		assert.InEpsilon(t, n, s.Estimate(), 0.05, "n=%d", n)
+	}
+}
+
+func TestHyperLogLog_Merge(t *testing.T) {
+	a := NewHyperLogLog(DefaultPrecision)
+	b := NewHyperLogLog(DefaultPrecision)
+	for i := range 3000 {
+		a.Add(strconv.Itoa(i))
+	}
+	for i := 2000; i < 5000; i++ {
+		b.Add(strconv.Itoa(i))
+	}
+
+	require.True(t, a.Merge(b))
+	assert.InEpsilon(t, 5000, a.Estimate(), 0.05)
+
+	estimate := a.Estimate()
+	require.True(t, a.Merge(b))
+	assert.Equal(t, estimate, a.Estimate(), "merge is idempotent")
+
+	assert.False(t, a.Merge(NewHyperLogLog(10)), "sketches with different precision are not merged")
+}
+
+func TestHyperLogLog_Validate(t *testing.T) {
+	assert.NoError(t, NewHyperLogLog(DefaultPrecision).Validate())
+	assert.Error(t, NewHyperLogLog(2).Validate())
+	assert.Error(t, (&HyperLogLog{Precision: 12, Registers: make([]byte, 100)}).Validate())
+
+	s := NewHyperLogLog(4)
+	s.Registers[0] = 62
+	assert.Error(t, s.Validate())
+}
+
+func TestHyperLogLog_Clone(t *testing.T) {
+	s := NewHyperLogLog(DefaultPrecision)
+	s.Add("a")
+	s.SetCardinality()
+
+	c := s.Clone()
+	assert.Nil(t, c.Cardinality)
+	c.Add("b")
+	assert.Equal(t, uint64(1), s.Estimate(), "clone does not share registers")
+}
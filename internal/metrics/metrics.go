@@ -1,14 +1,126 @@
 package metrics
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
 type Gauge float64
 type Counter int64
 
 // generate:reset
 type Metrics struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	ID        string            `json:"id"`                  // имя метрики
+	MType     string            `json:"type"`                // параметр, принимающий значение gauge, counter, histogram или set
+	Delta     *int64            `json:"delta,omitempty"`     // значение метрики в случае передачи counter
+	Value     *float64          `json:"value,omitempty"`     // значение метрики в случае передачи gauge
+	Labels    map[string]string `json:"labels,omitempty"`    // метки метрики (host, instance и т.д.)
+	Histogram *Histogram        `json:"histogram,omitempty"` // значение метрики в случае передачи histogram
+	Set       *HyperLogLog      `json:"set,omitempty"`       // значение метрики в случае передачи set
+}
+
+// Key возвращает ключ хранения метрики: имя и канонизированные метки
+func (m Metrics) Key() string {
+	return Key(m.ID, m.Labels)
+}
+
+// Key возвращает ключ хранения метрики вида id{a=1,b=2}
+func Key(id string, labels map[string]string) string {
+	canonical := CanonicalLabels(labels)
+	if canonical == "" {
+		return id
+	}
+	return id + "{" + canonical + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `=`, `\=`)
+
+// CanonicalLabels возвращает метки в виде отсортированной строки a=1,b=2.
+// Символы \ , = в ключах и значениях экранируются.
+func CanonicalLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, labelEscaper.Replace(k)+"="+labelEscaper.Replace(labels[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseLabels разбирает строку меток в формате CanonicalLabels
+func ParseLabels(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	result := make(map[string]string)
+	var (
+		key, cur strings.Builder
+		inValue  bool
+		escaped  bool
+	)
+	flush := func() error {
+		if !inValue || key.Len() == 0 {
+			return fmt.Errorf("invalid label pair in %q", s)
+		}
+		result[key.String()] = cur.String()
+		key.Reset()
+		cur.Reset()
+		inValue = false
+		return nil
+	}
+
+	for _, c := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '=' && !inValue:
+			key.WriteString(cur.String())
+			cur.Reset()
+			inValue = true
+		case c == ',':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("dangling escape in %q", s)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ValueString возвращает значение метрики в текстовом виде
+func (m Metrics) ValueString() string {
+	switch {
+	case m.MType == "gauge" && m.Value != nil:
+		return fmt.Sprintf("%f", *m.Value)
+	case m.MType == "counter" && m.Delta != nil:
+		return fmt.Sprintf("%d", *m.Delta)
+	case m.MType == "histogram" && m.Histogram != nil:
+		return m.Histogram.String()
+	case m.MType == "set" && m.Set != nil:
+		return fmt.Sprintf("%d", m.Set.Estimate())
+	}
+	return ""
 }
 
 // generate:reset
@@ -21,4 +133,16 @@ type AuditMetrics struct {
 	TS          int64    `json:"ts"`
 	MetricNames []string `json:"metrics"`
 	IP          string   `json:"ip_address"`
+	AgentID     string   `json:"agent_id,omitempty"`
+}
+
+// Sample — значение метрики, сохраненное в истории в момент обновления.
+// Для counter хранится накопленное значение после обновления.
+type Sample struct {
+	TS     time.Time         `json:"ts"`
+	ID     string            `json:"id"`
+	MType  string            `json:"type"`
+	Delta  *int64            `json:"delta,omitempty"`
+	Value  *float64          `json:"value,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
 }
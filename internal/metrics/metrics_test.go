@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, "HeapAlloc", Key("HeapAlloc", nil))
+	assert.Equal(t, "HeapAlloc{host=a,instance=b}", Key("HeapAlloc", map[string]string{"instance": "b", "host": "a"}))
+	assert.Equal(t, `HeapAlloc{path=/a\,b\=c}`, Key("HeapAlloc", map[string]string{"path": "/a,b=c"}))
+}
+
+func TestParseLabels(t *testing.T) {
+	labels := map[string]string{"host": "a", "path": `/a,b=c\d`}
+
+	parsed, err := ParseLabels(CanonicalLabels(labels))
+	require.NoError(t, err)
+	assert.Equal(t, labels, parsed)
+
+	parsed, err = ParseLabels("")
+	assert.NoError(t, err)
+	assert.Nil(t, parsed)
+
+	_, err = ParseLabels("host")
+	assert.Error(t, err)
+
+	_, err = ParseLabels("host=a,")
+	assert.Error(t, err)
+}
@@ -3,18 +3,39 @@
 
 package metrics
 
+func (rs *Histogram) Reset() {
+	if rs == nil {
+		return
+	}
+	rs.Count = 0
+	rs.Sum = 0
+	rs.Bounds = rs.Bounds[:0]
+	rs.Counts = rs.Counts[:0]
+	clear(rs.Quantiles)
+
+}
+
+func (rs *HyperLogLog) Reset() {
+	if rs == nil {
+		return
+	}
+	rs.Precision = 0
+	rs.Registers = rs.Registers[:0]
+	rs.Cardinality = nil
+
+}
+
 func (rs *Metrics) Reset() {
 	if rs == nil {
 		return
 	}
 	rs.ID = ""
 	rs.MType = ""
-	if rs.Delta != nil {
-		*rs.Delta = 0
-	}
-	if rs.Value != nil {
-		*rs.Value = 0
-	}
+	rs.Delta = nil
+	rs.Value = nil
+	clear(rs.Labels)
+	rs.Histogram = nil
+	rs.Set = nil
 
 }
 
@@ -22,6 +43,7 @@ func (rs *MetricsGroup) Reset() {
 	if rs == nil {
 		return
 	}
+	clear(rs.Slice[:cap(rs.Slice)])
 	rs.Slice = rs.Slice[:0]
 
 }
@@ -33,5 +55,6 @@ func (rs *AuditMetrics) Reset() {
 	rs.TS = 0
 	rs.MetricNames = rs.MetricNames[:0]
 	rs.IP = ""
+	rs.AgentID = ""
 
 }
@@ -0,0 +1,78 @@
+// Package mtls builds the TLS configurations used for mutual authentication of agents and the server:
+// the server verifies agent certificates against a client CA and agents verify the server
+// certificate against their CA bundle.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrNoCertificates is returned when a CA bundle does not contain any certificate.
+var ErrNoCertificates = errors.New("no certificates found")
+
+// ServerConfig returns the server TLS configuration with the certificate and key.
+// If clientCAFile is set, clients must present a certificate signed by one of its CAs.
+func ServerConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load server certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.NoClientCert,
+	}
+	if clientCAFile != "" {
+		cfg.ClientCAs, err = LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client CA: %w", err)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientConfig returns the agent TLS configuration.
+// The server certificate is verified against caFile, or the system roots if it is empty.
+// The client certificate is presented if certFile and keyFile are set.
+// serverName overrides the name checked in the server certificate.
+func ClientConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	var err error
+	if caFile != "" {
+		cfg.RootCAs, err = LoadCertPool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load CA: %w", err)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w in %s", ErrNoCertificates, path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,119 @@
+package mtls
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertificate writes the certificate and its key into dir as <name>.pem and <name>-key.pem.
+func writeCertificate(t *testing.T, dir, name string, cert *Certificate) (string, string) {
+	t.Helper()
+	keyPEM, err := cert.KeyPEM()
+	require.NoError(t, err)
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, os.WriteFile(certFile, cert.CertPEM(), 0644))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	return certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+	caFile, caKeyFile := writeCertificate(t, dir, "ca", ca)
+
+	server, err := ca.IssueServer("localhost", []string{"localhost", "127.0.0.1"}, time.Hour)
+	require.NoError(t, err)
+	serverCert, serverKey := writeCertificate(t, dir, "server", server)
+
+	// сертификат агента выпускается CA, загруженным из файлов
+	loadedCA, err := LoadCertificate(caFile, caKeyFile)
+	require.NoError(t, err)
+	agent, err := loadedCA.IssueClient("agent", time.Hour)
+	require.NoError(t, err)
+	agentCert, agentKey := writeCertificate(t, dir, "agent", agent)
+
+	otherCA, err := NewCA("other CA", time.Hour)
+	require.NoError(t, err)
+	stranger, err := otherCA.IssueClient("stranger", time.Hour)
+	require.NoError(t, err)
+	strangerCert, strangerKey := writeCertificate(t, dir, "stranger", stranger)
+
+	serverConfig, err := ServerConfig(serverCert, serverKey, caFile)
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.TLS = serverConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		wantErr  bool
+	}{
+		{name: "agent certificate", certFile: agentCert, keyFile: agentKey},
+		{name: "no certificate", wantErr: true},
+		{name: "certificate of another CA", certFile: strangerCert, keyFile: strangerKey, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig, err := ClientConfig(caFile, tt.certFile, tt.keyFile, "")
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+
+			resp, err := client.Get(ts.URL)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "agent", string(body))
+		})
+	}
+
+	// агент не доверяет серверу без CA
+	clientConfig, err := ClientConfig("", agentCert, agentKey, "")
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	_, err = client.Get(ts.URL)
+	assert.Error(t, err)
+}
+
+func TestConfig_Errors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	require.NoError(t, os.WriteFile(empty, []byte("no certificates"), 0644))
+
+	_, err := LoadCertPool(empty)
+	assert.ErrorIs(t, err, ErrNoCertificates)
+
+	_, err = ServerConfig(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "missing-key.pem"), "")
+	assert.Error(t, err)
+
+	_, err = ClientConfig(empty, "", "", "")
+	assert.ErrorIs(t, err, ErrNoCertificates)
+
+	ca, err := NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+	leaf, err := ca.IssueClient("agent", time.Hour)
+	require.NoError(t, err)
+	_, err = leaf.IssueClient("nested", time.Hour)
+	assert.Error(t, err)
+}
@@ -0,0 +1,209 @@
+// Package notify delivers alert state changes to external sinks.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"metralert/internal/alert"
+	"metralert/internal/metrics"
+
+	"go.uber.org/zap"
+)
+
+const defaultBackoff = time.Second
+
+// Notification is the payload delivered to the sinks.
+type Notification struct {
+	alert.Alert
+	Message string `json:"message"`
+	TS      int64  `json:"ts"`
+}
+
+// Sink delivers a single notification to an external destination.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, n Notification) error
+}
+
+// Dispatcher fans out alert notifications to the configured sinks.
+// Every sink is retried independently with exponential backoff,
+// repeated firing notifications for the same rule and labels are deduplicated per sink.
+// The deduplication state is recorded only after a successful delivery,
+// alerts that failed to reach a sink are kept until Pending passes them back for another attempt.
+type Dispatcher struct {
+	sinks          []Sink
+	retries        int
+	backoff        time.Duration
+	repeatInterval time.Duration
+	logger         *zap.SugaredLogger
+
+	mutex    sync.Mutex
+	notified map[sinkKey]alert.State
+	lastSent map[sinkKey]time.Time
+	pending  map[string]alert.Alert
+	now      func() time.Time
+}
+
+// sinkKey identifies an alert delivered to a sink by its index in Dispatcher.sinks.
+type sinkKey struct {
+	sink  int
+	alert string
+}
+
+// NewDispatcher creates a Dispatcher for the sinks.
+//
+// Parameters:
+//   - sinks: destinations for notifications
+//   - retries: number of additional attempts per sink after a failed delivery
+//   - repeatInterval: interval after which a still firing alert is notified again, 0 disables repeats
+//   - logger: The structured logger instance
+func NewDispatcher(sinks []Sink, retries int, repeatInterval time.Duration, logger *zap.SugaredLogger) *Dispatcher {
+	if retries < 0 {
+		retries = 0
+	}
+	return &Dispatcher{
+		sinks:          sinks,
+		retries:        retries,
+		backoff:        defaultBackoff,
+		repeatInterval: repeatInterval,
+		logger:         logger,
+		notified:       make(map[sinkKey]alert.State),
+		lastSent:       make(map[sinkKey]time.Time),
+		pending:        make(map[string]alert.Alert),
+		now:            time.Now,
+	}
+}
+
+// Empty reports whether the dispatcher has no sinks configured.
+func (d *Dispatcher) Empty() bool {
+	return d == nil || len(d.sinks) == 0
+}
+
+// RepeatInterval returns the interval after which a still firing alert is notified again, 0 if repeats are disabled.
+func (d *Dispatcher) RepeatInterval() time.Duration {
+	if d == nil {
+		return 0
+	}
+	return d.repeatInterval
+}
+
+// Pending returns the latest alerts that could not be delivered to at least one sink.
+// Dispatching them again retries only the sinks that missed the notification.
+func (d *Dispatcher) Pending() []alert.Alert {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	result := make([]alert.Alert, 0, len(d.pending))
+	for _, a := range d.pending {
+		result = append(result, a)
+	}
+	return result
+}
+
+// Dispatch delivers the alert to every sink unless it duplicates the previous notification
+// delivered to that sink for the rule and labels.
+func (d *Dispatcher) Dispatch(ctx context.Context, a alert.Alert) {
+	if d.Empty() {
+		return
+	}
+
+	n := Notification{
+		Alert:   a,
+		Message: Format(a),
+		TS:      d.now().Unix(),
+	}
+
+	var (
+		wg     sync.WaitGroup
+		failed atomic.Bool
+	)
+	for i, sink := range d.sinks {
+		key := sinkKey{sink: i, alert: a.Key()}
+		if !d.shouldNotify(key, a.State) {
+			continue
+		}
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+			if err := d.sendWithRetry(ctx, sink, n); err != nil {
+				failed.Store(true)
+				d.logger.Warnw("Unable to deliver alert notification",
+					"sink", sink.Name(), "rule", a.Rule, "error", err)
+				return
+			}
+			d.markNotified(key, a.State)
+		}(sink)
+	}
+	wg.Wait()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if failed.Load() {
+		d.pending[a.Key()] = a
+	} else {
+		delete(d.pending, a.Key())
+	}
+}
+
+// shouldNotify applies the deduplication policy to the state last delivered to the sink.
+func (d *Dispatcher) shouldNotify(key sinkKey, state alert.State) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	prev, ok := d.notified[key]
+	switch state {
+	case alert.StateFiring:
+		if ok && prev == alert.StateFiring {
+			return d.repeatInterval > 0 && d.now().Sub(d.lastSent[key]) >= d.repeatInterval
+		}
+	case alert.StateResolved:
+		// resolved отправляем только если ранее уведомляли о срабатывании
+		return ok && prev == alert.StateFiring
+	}
+	return true
+}
+
+// markNotified records a successful delivery of the state to the sink.
+func (d *Dispatcher) markNotified(key sinkKey, state alert.State) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.notified[key] = state
+	d.lastSent[key] = d.now()
+}
+
+func (d *Dispatcher) sendWithRetry(ctx context.Context, sink Sink, n Notification) error {
+	var err error
+	delay := d.backoff
+	for i := 0; i <= d.retries; i++ {
+		err = sink.Send(ctx, n)
+		if err == nil {
+			return nil
+		}
+		if i == d.retries {
+			break
+		}
+		d.logger.Infow("Retrying alert notification", "sink", sink.Name(), "attempt", i+1, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return fmt.Errorf("failed after %d attempts: %w", d.retries+1, err)
+}
+
+// Format renders a human-readable message for the alert.
+func Format(a alert.Alert) string {
+	switch a.State {
+	case alert.StateResolved:
+		return fmt.Sprintf("[RESOLVED] %s: %s (%s) = %g, condition %s %g cleared",
+			a.Rule, metrics.Key(a.Metric, a.Labels), a.MType, a.Value, a.Op, a.Threshold)
+	default:
+		return fmt.Sprintf("[FIRING] %s: %s (%s) = %g %s %g",
+			a.Rule, metrics.Key(a.Metric, a.Labels), a.MType, a.Value, a.Op, a.Threshold)
+	}
+}
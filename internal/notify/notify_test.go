@@ -0,0 +1,256 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"metralert/internal/alert"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeSink struct {
+	mutex    sync.Mutex
+	failures int
+	received []Notification
+	attempts int
+}
+
+func (s *fakeSink) Name() string {
+	return "fake"
+}
+
+func (s *fakeSink) Send(_ context.Context, n Notification) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attempts++
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("temporary failure")
+	}
+	s.received = append(s.received, n)
+	return nil
+}
+
+func testAlert(state alert.State) alert.Alert {
+	return alert.Alert{
+		Rule:      "HighHeapAlloc",
+		Metric:    "HeapAlloc",
+		MType:     "gauge",
+		State:     state,
+		Value:     600,
+		Op:        ">",
+		Threshold: 500,
+	}
+}
+
+func TestDispatcher_Deduplication(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sink := &fakeSink{}
+	d := NewDispatcher([]Sink{sink}, 0, 0, logger.Sugar())
+
+	d.Dispatch(context.Background(), testAlert(alert.StateResolved))
+	d.Dispatch(context.Background(), testAlert(alert.StateFiring))
+	d.Dispatch(context.Background(), testAlert(alert.StateFiring))
+	d.Dispatch(context.Background(), testAlert(alert.StateResolved))
+
+	require.Len(t, sink.received, 2)
+	assert.Equal(t, alert.StateFiring, sink.received[0].State)
+	assert.Equal(t, alert.StateResolved, sink.received[1].State)
+	assert.Contains(t, sink.received[1].Message, "[RESOLVED]")
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sink := &fakeSink{failures: 2}
+	d := NewDispatcher([]Sink{sink}, 2, 0, logger.Sugar())
+	d.backoff = time.Millisecond
+
+	d.Dispatch(context.Background(), testAlert(alert.StateFiring))
+
+	assert.Equal(t, 3, sink.attempts)
+	assert.Len(t, sink.received, 1)
+}
+
+func TestDispatcher_FailedDelivery(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	failing := &fakeSink{failures: 1}
+	healthy := &fakeSink{}
+	d := NewDispatcher([]Sink{failing, healthy}, 0, 0, logger.Sugar())
+
+	d.Dispatch(context.Background(), testAlert(alert.StateFiring))
+	assert.Empty(t, failing.received)
+	assert.Len(t, healthy.received, 1)
+	require.Len(t, d.Pending(), 1)
+
+	// повторная отправка доставляет уведомление только в приемник, который его не получил
+	for _, a := range d.Pending() {
+		d.Dispatch(context.Background(), a)
+	}
+	assert.Len(t, failing.received, 1)
+	assert.Len(t, healthy.received, 1)
+	assert.Empty(t, d.Pending())
+
+	d.Dispatch(context.Background(), testAlert(alert.StateResolved))
+	assert.Len(t, failing.received, 2)
+	assert.Len(t, healthy.received, 2)
+}
+
+func TestWebhookSink_Send(t *testing.T) {
+	var got Notification
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	err := NewWebhookSink(ts.URL).Send(context.Background(), Notification{Alert: testAlert(alert.StateFiring)})
+	require.NoError(t, err)
+	assert.Equal(t, "HighHeapAlloc", got.Rule)
+}
+
+func TestFileSink_Send(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.jsonl")
+	sink := NewFileSink(path)
+
+	require.NoError(t, sink.Send(context.Background(), Notification{Alert: testAlert(alert.StateFiring)}))
+	require.NoError(t, sink.Send(context.Background(), Notification{Alert: testAlert(alert.StateResolved)}))
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var n Notification
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &n))
+		lines++
+	}
+	assert.Equal(t, 2, lines)
+}
+
+// serveSMTP принимает одно соединение и отвечает на команды минимального SMTP-диалога,
+// в data передается полученное письмо.
+func serveSMTP(t *testing.T, ln net.Listener, data chan<- string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			fmt.Fprint(conn, "250 localhost\r\n")
+		case cmd == "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			var msg strings.Builder
+			for {
+				line, err = reader.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				msg.WriteString(line)
+			}
+			data <- msg.String()
+			fmt.Fprint(conn, "250 queued\r\n")
+		case cmd == "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestSMTPSink_Send(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	data := make(chan string, 1)
+	go serveSMTP(t, ln, data)
+
+	sink := NewSMTPSink(ln.Addr().String(), "metralert@example.com", []string{"ops@example.com"})
+	n := Notification{Alert: testAlert(alert.StateFiring), Message: Format(testAlert(alert.StateFiring))}
+	require.NoError(t, sink.Send(context.Background(), n))
+	assert.Contains(t, <-data, "Subject: [FIRING] HighHeapAlloc")
+}
+
+func TestSMTPSink_SendSubject(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	data := make(chan string, 1)
+	go serveSMTP(t, ln, data)
+
+	sink := NewSMTPSink(ln.Addr().String(), "metralert@example.com", []string{"ops@example.com"})
+	n := Notification{Alert: testAlert(alert.StateFiring), Message: "Нагрузка\r\nBcc: victim@example.com"}
+	require.NoError(t, sink.Send(context.Background(), n))
+
+	msg := <-data
+	headers, _, _ := strings.Cut(msg, "\r\n\r\n")
+	assert.NotContains(t, headers, "\r\nBcc:")
+	assert.Contains(t, headers, "Subject: =?utf-8?q?")
+}
+
+func TestSMTPSink_SendHungRelay(t *testing.T) {
+	// relay принимает соединение, но не отвечает
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	sink := NewSMTPSink(ln.Addr().String(), "metralert@example.com", []string{"ops@example.com"})
+	sink.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	err = sink.Send(context.Background(), Notification{Alert: testAlert(alert.StateFiring)})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// отмена контекста прерывает доставку раньше таймаута
+	sink.Timeout = time.Minute
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = sink.Send(ctx, Notification{Alert: testAlert(alert.StateFiring)})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
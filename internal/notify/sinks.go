@@ -0,0 +1,200 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookSink posts notifications as JSON to a generic webhook URL.
+type WebhookSink struct {
+	URL    string
+	client http.Client
+}
+
+// NewWebhookSink creates a WebhookSink for the URL.
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		URL:    url,
+		client: http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Send(ctx context.Context, n Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// FileSink appends notifications to a file, one JSON object per line.
+type FileSink struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+// NewFileSink creates a FileSink for the path.
+func NewFileSink(path string) *FileSink {
+	return &FileSink{Path: path}
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) Send(_ context.Context, n Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// SMTPSink sends notifications by email through an SMTP relay without authentication.
+type SMTPSink struct {
+	Relay string
+	From  string
+	To    []string
+	// Timeout limits a single delivery, including the connection to the relay.
+	Timeout time.Duration
+}
+
+// NewSMTPSink creates an SMTPSink for the relay address (host:port).
+func NewSMTPSink(relay string, from string, to []string) *SMTPSink {
+	return &SMTPSink{
+		Relay:   relay,
+		From:    from,
+		To:      to,
+		Timeout: 10 * time.Second,
+	}
+}
+
+func (s *SMTPSink) Name() string {
+	return "smtp"
+}
+
+func (s *SMTPSink) Send(ctx context.Context, n Notification) error {
+	if len(s.To) == 0 {
+		return errors.New("no smtp recipients configured")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", encodeSubject(n.Message))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Unix(n.TS, 0).Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nRule: %s\r\nMetric: %s (%s)\r\nValue: %g\r\nThreshold: %s %g\r\nState: %s\r\nSince: %s\r\n",
+		n.Message, n.Rule, n.Metric, n.MType, n.Value, n.Op, n.Threshold, n.State, n.Since.Format(time.RFC3339))
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	return s.sendMail(ctx, msg.Bytes())
+}
+
+// encodeSubject folds line breaks in the subject into spaces, so the message text cannot inject headers,
+// and encodes non-ASCII text as an RFC 2047 encoded-word.
+func encodeSubject(subject string) string {
+	subject = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(subject)
+	return mime.QEncoding.Encode("utf-8", subject)
+}
+
+// sendMail delivers the message like smtp.SendMail, but the connection is bounded by the ctx deadline
+// and closed when ctx is cancelled, so a hung relay does not block the dispatcher.
+func (s *SMTPSink) sendMail(ctx context.Context, msg []byte) error {
+	host, _, err := net.SplitHostPort(s.Relay)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.Relay)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,238 @@
+package proto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+
+	"metralert/internal/metrics"
+	"metralert/internal/sign"
+
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var (
+	// ErrNotEncrypted возвращается, если сервер ожидает зашифрованное сообщение, а получено открытое.
+	ErrNotEncrypted = errors.New("message is not encrypted")
+	// ErrUnexpectedEncryption возвращается, если получено зашифрованное сообщение, а ключ не задан.
+	ErrUnexpectedEncryption = errors.New("message is encrypted but no private key is configured")
+	// ErrInvalidHash возвращается при несовпадении подписи сообщения.
+	ErrInvalidHash = errors.New("invalid message hash")
+)
+
+const (
+	hashField      protoreflect.Name = "hash"
+	encryptedField protoreflect.Name = "encrypted"
+)
+
+// Envelope — сообщение с подписью и необязательным зашифрованным содержимым.
+type Envelope interface {
+	gproto.Message
+	GetHash() string
+	GetEncrypted() []byte
+}
+
+// Hash вычисляет HMAC-SHA256 детерминированной сериализации сообщения
+// с незаполненными полями hash и encrypted.
+func Hash(msg Envelope, key string) (string, error) {
+	data, err := signedData(msg)
+	if err != nil {
+		return "", err
+	}
+	return sign.Sum(key, sign.Stamp{}, data), nil
+}
+
+// signedData возвращает детерминированную сериализацию сообщения
+// с незаполненными полями hash и encrypted.
+func signedData(msg Envelope) ([]byte, error) {
+	plain := gproto.Clone(msg)
+	clearField(plain, hashField)
+	clearField(plain, encryptedField)
+	return gproto.MarshalOptions{Deterministic: true}.Marshal(plain)
+}
+
+// HashMessage вычисляет HMAC-SHA256 детерминированной сериализации сообщения.
+func HashMessage(msg gproto.Message, key string) (string, error) {
+	data, err := gproto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Seal подписывает сообщение ключом hashKey и, если задан encrypt, заменяет его содержимое
+// зашифрованной сериализацией. Подпись включает время и nonce и записывается
+// в поле hash в виде "timestamp:nonce:hmac". Пустой hashKey отключает подпись.
+func Seal(msg Envelope, hashKey string, encrypt func([]byte) ([]byte, error)) error {
+	if hashKey != "" {
+		data, err := signedData(msg)
+		if err != nil {
+			return err
+		}
+		stamp, err := sign.NewStamp()
+		if err != nil {
+			return err
+		}
+		setField(msg, hashField, protoreflect.ValueOfString(stamp.Encode(sign.Sum(hashKey, stamp, data))))
+	}
+
+	if encrypt == nil {
+		return nil
+	}
+
+	data, err := gproto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	encrypted, err := encrypt(data)
+	if err != nil {
+		return err
+	}
+	gproto.Reset(msg)
+	setField(msg, encryptedField, protoreflect.ValueOfBytes(encrypted))
+	return nil
+}
+
+// Open расшифровывает сообщение, если задан decrypt, и проверяет подпись верификатором.
+// Неподписанное сообщение отклоняется только в строгом режиме, nil верификатор отключает проверку.
+func Open(msg Envelope, verifier *sign.Verifier, decrypt func([]byte) ([]byte, error)) error {
+	encrypted := msg.GetEncrypted()
+	switch {
+	case decrypt != nil && len(encrypted) == 0:
+		return ErrNotEncrypted
+	case decrypt == nil && len(encrypted) != 0:
+		return ErrUnexpectedEncryption
+	case decrypt != nil:
+		data, err := decrypt(encrypted)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt message: %w", err)
+		}
+		gproto.Reset(msg)
+		if err = gproto.Unmarshal(data, msg); err != nil {
+			return fmt.Errorf("unable to unmarshal decrypted message: %w", err)
+		}
+		if len(msg.GetEncrypted()) != 0 {
+			return errors.New("nested encrypted message")
+		}
+	}
+
+	if !verifier.Enabled() {
+		return nil
+	}
+	data, err := signedData(msg)
+	if err != nil {
+		return err
+	}
+	stamp, received := sign.Decode(msg.GetHash())
+	if err = verifier.Verify(received, stamp, data); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidHash, err)
+	}
+	return nil
+}
+
+func clearField(msg gproto.Message, name protoreflect.Name) {
+	m := msg.ProtoReflect()
+	if fd := m.Descriptor().Fields().ByName(name); fd != nil {
+		m.Clear(fd)
+	}
+}
+
+func setField(msg gproto.Message, name protoreflect.Name, v protoreflect.Value) {
+	m := msg.ProtoReflect()
+	if fd := m.Descriptor().Fields().ByName(name); fd != nil {
+		m.Set(fd, v)
+	}
+}
+
+// FromMetrics преобразует метрику в сообщение protobuf.
+func FromMetrics(m metrics.Metrics) *Metric {
+	x := &Metric{
+		Id:     m.ID,
+		Type:   m.MType,
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Labels: m.Labels,
+	}
+	if m.Histogram != nil {
+		x.Histogram = &Histogram{
+			Bounds: m.Histogram.Bounds,
+			Counts: m.Histogram.Counts,
+			Sum:    m.Histogram.Sum,
+			Count:  m.Histogram.Count,
+		}
+	}
+	if m.Set != nil {
+		x.Set = &HyperLogLog{
+			Precision: uint32(m.Set.Precision),
+			Registers: m.Set.Registers,
+		}
+	}
+	return x
+}
+
+// FromMetricsSlice преобразует слайс метрик в сообщения protobuf.
+func FromMetricsSlice(ms []metrics.Metrics) []*Metric {
+	result := make([]*Metric, 0, len(ms))
+	for _, m := range ms {
+		result = append(result, FromMetrics(m))
+	}
+	return result
+}
+
+// ToMetrics преобразует сообщение protobuf в метрику.
+func (x *Metric) ToMetrics() metrics.Metrics {
+	m := metrics.Metrics{
+		ID:     x.GetId(),
+		MType:  x.GetType(),
+		Labels: x.GetLabels(),
+	}
+	if x.Delta != nil {
+		delta := x.GetDelta()
+		m.Delta = &delta
+	}
+	if x.Value != nil {
+		value := x.GetValue()
+		m.Value = &value
+	}
+	if x.Histogram != nil {
+		m.Histogram = &metrics.Histogram{
+			Count:  x.Histogram.GetCount(),
+			Sum:    x.Histogram.GetSum(),
+			Bounds: x.Histogram.GetBounds(),
+			Counts: x.Histogram.GetCounts(),
+		}
+	}
+	if x.Set != nil {
+		m.Set = x.Set.toHyperLogLog()
+	}
+	return m
+}
+
+// toHyperLogLog преобразует набросок из сообщения protobuf.
+// Точность вне диапазона uint8 заменяется нулем, чтобы набросок не прошел проверку Validate.
+func (x *HyperLogLog) toHyperLogLog() *metrics.HyperLogLog {
+	var precision uint8
+	if p := x.GetPrecision(); p <= math.MaxUint8 {
+		precision = uint8(p)
+	}
+	return &metrics.HyperLogLog{
+		Precision: precision,
+		Registers: x.GetRegisters(),
+	}
+}
+
+// ToMetricsSlice преобразует сообщения protobuf в слайс метрик.
+func ToMetricsSlice(xs []*Metric) []metrics.Metrics {
+	result := make([]metrics.Metrics, 0, len(xs))
+	for _, x := range xs {
+		result = append(result, x.ToMetrics())
+	}
+	return result
+}
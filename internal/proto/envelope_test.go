@@ -0,0 +1,51 @@
+package proto
+
+import (
+	"testing"
+
+	"metralert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+func TestMetric_RoundTrip(t *testing.T) {
+	histogram := metrics.NewHistogram([]float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+
+	set := metrics.NewHyperLogLog(metrics.MinPrecision)
+	set.Add("a")
+	set.Add("b")
+
+	delta := int64(5)
+	value := 1.5
+	tests := []struct {
+		name string
+		m    metrics.Metrics
+	}{
+		{name: "counter", m: metrics.Metrics{ID: "C", MType: "counter", Delta: &delta, Labels: map[string]string{"host": "a"}}},
+		{name: "gauge", m: metrics.Metrics{ID: "G", MType: "gauge", Value: &value}},
+		{name: "histogram", m: metrics.Metrics{ID: "H", MType: "histogram", Histogram: histogram, Labels: map[string]string{"route": "/"}}},
+		{name: "set", m: metrics.Metrics{ID: "S", MType: "set", Set: set}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := gproto.Marshal(FromMetrics(tt.m))
+			require.NoError(t, err)
+			var x Metric
+			require.NoError(t, gproto.Unmarshal(data, &x))
+
+			got := ToMetricsSlice([]*Metric{&x})
+			require.Len(t, got, 1)
+			assert.Equal(t, tt.m, got[0])
+		})
+	}
+}
+
+func TestHyperLogLog_InvalidPrecision(t *testing.T) {
+	x := &Metric{Id: "S", Type: "set", Set: &HyperLogLog{Precision: 256 + uint32(metrics.DefaultPrecision)}}
+	assert.Error(t, x.ToMetrics().Set.Validate())
+}
@@ -7,6 +7,7 @@ import (
 	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -76,49 +77,33 @@ func (p *ResetParam) GenResetAction() {
 		return
 	}
 	if p.ArrayFlag == true {
-		p.ResetAction = fmt.Sprintf("rs.%s = rs.%s[:0]\n", p.FieldName, p.FieldName)
+		// json декодирует элементы среза поверх старых в пределах емкости,
+		// поэтому элементы составных типов обнуляются, чтобы не сохранить поля прошлого значения
+		elem := strings.TrimPrefix(p.FieldType, "[]")
+		if !slices.Contains(basicTypesNum, elem) && elem != "string" && elem != "bool" {
+			p.ResetAction = fmt.Sprintf("clear(rs.%s[:cap(rs.%s)])\n", p.FieldName, p.FieldName)
+		}
+		p.ResetAction += fmt.Sprintf("rs.%s = rs.%s[:0]\n", p.FieldName, p.FieldName)
 		return
 	}
-	if p.ChildStructFlag == true {
-		p.ResetAction = fmt.Sprintf(`var rsInterface interface{} = %s{}
-	if resetter, ok := rsInterface.(interface{ Reset() }); ok && rs.%s != nil {
-		resetter.Reset()
-	}`, strings.TrimPrefix(p.FieldType, "*"), p.FieldName)
+	// указатели обнуляются, а не сбрасываются по месту: значение могло быть передано дальше
+	// (например, сохранено в хранилище), а отсутствующее в следующем json поле должно остаться nil
+	if p.PointerFlag == true {
+		p.ResetAction = fmt.Sprintf("rs.%s = nil\n", p.FieldName)
 		return
 	}
 	if p.FieldType == "bool" {
 		p.ResetAction = fmt.Sprintf("rs.%s = false\n", p.FieldName)
 		return
 	}
-	if p.FieldType == "*bool" {
-		p.ResetAction = fmt.Sprintf(`if rs.%s != nil {
-				*rs.%s = false}
-				`, p.FieldName, p.FieldName)
-		return
-	}
 	if p.FieldType == "string" {
 		p.ResetAction = fmt.Sprintf("rs.%s = \"\"\n", p.FieldName)
 		return
 	}
-	if p.FieldType == "*string" {
-		p.ResetAction = fmt.Sprintf(`if rs.%s != nil {
-				*rs.%s = ""}
-				`, p.FieldName, p.FieldName)
-		return
-	}
 	if slices.Contains(basicTypesNum, p.FieldType) {
 		p.ResetAction = fmt.Sprintf("rs.%s = 0\n", p.FieldName)
 		return
 	}
-	if p.PointerFlag {
-		typeValue := strings.TrimPrefix(p.FieldType, "*")
-		if slices.Contains(basicTypesNum, typeValue) {
-			p.ResetAction = fmt.Sprintf(`if rs.%s != nil {
-				*rs.%s = 0}
-				`, p.FieldName, p.FieldName)
-		}
-		return
-	}
 	return
 }
 func ParseGen(projectDir string) error {
@@ -177,13 +162,13 @@ func (rp *ResetPackage) RenderTemplate(dir string, FileExistsFlag bool) error {
 	if !FileExistsFlag {
 		footerBufFmt, err = format.Source(footerBuf.Bytes())
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
 
 	bufFmt, err := format.Source(buf.Bytes())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if !FileExistsFlag {
@@ -291,12 +276,10 @@ func GenerateReset(filename string) *ResetPackage {
 
 											// логика для указателей
 											if se, ok := field.Type.(*ast.StarExpr); ok {
-												if i, ok := se.X.(*ast.Ident); ok {
-													structP.FieldType = "*" + i.Name
-													structP.PointerFlag = true
-													if i.Obj != nil {
-														structP.ChildStructFlag = true
-													}
+												structP.FieldType = "*" + types.ExprString(se.X)
+												structP.PointerFlag = true
+												if i, ok := se.X.(*ast.Ident); ok && i.Obj != nil {
+													structP.ChildStructFlag = true
 												}
 											}
 
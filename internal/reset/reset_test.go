@@ -1,7 +1,6 @@
 package reset
 
 import (
-	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -33,6 +32,19 @@ func TestResetParam_GenResetAction_Array(t *testing.T) {
 	assert.Equal(t, expected, param.ResetAction)
 }
 
+func TestResetParam_GenResetAction_StructArray(t *testing.T) {
+	param := &ResetParam{
+		FieldName: "items",
+		FieldType: "[]Metrics",
+		ArrayFlag: true,
+	}
+
+	param.GenResetAction()
+
+	expected := "clear(rs.items[:cap(rs.items)])\nrs.items = rs.items[:0]\n"
+	assert.Equal(t, expected, param.ResetAction)
+}
+
 func TestResetParam_GenResetAction_ChildStruct(t *testing.T) {
 	param := &ResetParam{
 		FieldName:       "child",
@@ -43,10 +55,21 @@ func TestResetParam_GenResetAction_ChildStruct(t *testing.T) {
 
 	param.GenResetAction()
 
-	expected := `var rsInterface interface{} = ResetableStruct{}
-	if resetter, ok := rsInterface.(interface{ Reset() }); ok && rs.child != nil {
-		resetter.Reset()
-	}`
+	expected := "rs.child = nil\n"
+	assert.Equal(t, expected, param.ResetAction)
+}
+
+func TestResetParam_GenResetAction_PointerOtherFileStruct(t *testing.T) {
+	// тип объявлен в другом файле пакета, поэтому ChildStructFlag не выставлен
+	param := &ResetParam{
+		FieldName:   "histogram",
+		FieldType:   "*Histogram",
+		PointerFlag: true,
+	}
+
+	param.GenResetAction()
+
+	expected := "rs.histogram = nil\n"
 	assert.Equal(t, expected, param.ResetAction)
 }
 
@@ -71,8 +94,8 @@ func TestResetParam_GenResetAction_PointerBool(t *testing.T) {
 
 	param.GenResetAction()
 
-	assert.True(t, strings.Contains(param.ResetAction, "*rs.testBoolPtr = false"))
-	assert.True(t, strings.Contains(param.ResetAction, "if rs.testBoolPtr != nil"))
+	expected := "rs.testBoolPtr = nil\n"
+	assert.Equal(t, expected, param.ResetAction)
 }
 
 func TestResetParam_GenResetAction_String(t *testing.T) {
@@ -96,8 +119,8 @@ func TestResetParam_GenResetAction_PointerString(t *testing.T) {
 
 	param.GenResetAction()
 
-	assert.True(t, strings.Contains(param.ResetAction, "*rs.testStringPtr = \"\""))
-	assert.True(t, strings.Contains(param.ResetAction, "if rs.testStringPtr != nil"))
+	expected := "rs.testStringPtr = nil\n"
+	assert.Equal(t, expected, param.ResetAction)
 }
 
 func TestResetParam_GenResetAction_BasicTypeNum(t *testing.T) {
@@ -121,8 +144,8 @@ func TestResetParam_GenResetAction_PointerBasicTypeNum(t *testing.T) {
 
 	param.GenResetAction()
 
-	assert.True(t, strings.Contains(param.ResetAction, "*rs.testIntPtr = 0"))
-	assert.True(t, strings.Contains(param.ResetAction, "if rs.testIntPtr != nil"))
+	expected := "rs.testIntPtr = nil\n"
+	assert.Equal(t, expected, param.ResetAction)
 }
 
 func TestResetParam_GenResetAction_UnsupportedType(t *testing.T) {
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// AgentIDHeader carries the stable agent identifier.
+	AgentIDHeader = "X-Agent-ID"
+	// AgentVersionHeader carries the agent build version.
+	AgentVersionHeader = "X-Agent-Version"
+	// AgentReportIntervalHeader carries the agent report interval in seconds.
+	AgentReportIntervalHeader = "X-Agent-Report-Interval"
+	// RealIPHeader carries the agent address checked against the trusted subnet.
+	RealIPHeader = "X-Real-IP"
+
+	defaultAgentReportInterval = 10 * time.Second
+	defaultStaleIntervals      = 3
+)
+
+// AgentInfo describes an agent that has sent metrics to the server.
+type AgentInfo struct {
+	ID             string    `json:"id"`
+	Version        string    `json:"version"`
+	RemoteAddr     string    `json:"remote_addr"`
+	LastSeen       time.Time `json:"last_seen"`
+	ReportInterval int       `json:"report_interval"` // в секундах
+	MetricCount    int       `json:"metric_count"`
+	TotalMetrics   int64     `json:"total_metrics"`
+	Stale          bool      `json:"stale"`
+}
+
+// AgentRegistry keeps track of the agents reporting to the server.
+type AgentRegistry struct {
+	mutex          sync.Mutex
+	agents         map[string]*AgentInfo
+	staleIntervals int
+	now            func() time.Time
+}
+
+// NewAgentRegistry creates an AgentRegistry. An agent is considered stale when it has not
+// reported for more than staleIntervals of its report interval.
+func NewAgentRegistry(staleIntervals int) *AgentRegistry {
+	if staleIntervals <= 0 {
+		staleIntervals = defaultStaleIntervals
+	}
+	return &AgentRegistry{
+		agents:         make(map[string]*AgentInfo),
+		staleIntervals: staleIntervals,
+		now:            time.Now,
+	}
+}
+
+// SetStaleIntervals changes the number of missed report intervals after which an agent is stale.
+func (ar *AgentRegistry) SetStaleIntervals(staleIntervals int) {
+	if staleIntervals <= 0 {
+		return
+	}
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+	ar.staleIntervals = staleIntervals
+}
+
+// Touch records a successful report of metricCount metrics by the agent.
+func (ar *AgentRegistry) Touch(id string, version string, remoteAddr string, reportInterval time.Duration, metricCount int) {
+	if id == "" {
+		return
+	}
+
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	info, ok := ar.agents[id]
+	if !ok {
+		info = &AgentInfo{ID: id}
+		ar.agents[id] = info
+	}
+	info.Version = version
+	info.RemoteAddr = remoteAddr
+	info.LastSeen = ar.now()
+	if reportInterval > 0 {
+		info.ReportInterval = int(reportInterval / time.Second)
+	}
+	info.MetricCount = metricCount
+	info.TotalMetrics += int64(metricCount)
+}
+
+// List returns the known agents sorted by ID with the stale flag computed for the current time.
+func (ar *AgentRegistry) List() []AgentInfo {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	now := ar.now()
+	result := make([]AgentInfo, 0, len(ar.agents))
+	for _, info := range ar.agents {
+		item := *info
+		interval := time.Duration(item.ReportInterval) * time.Second
+		if interval <= 0 {
+			interval = defaultAgentReportInterval
+		}
+		item.Stale = now.Sub(item.LastSeen) > time.Duration(ar.staleIntervals)*interval
+		result = append(result, item)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// trackAgent records the agent identified by the request headers.
+func (server *Server) trackAgent(r *http.Request, metricCount int) {
+	server.touchAgent(
+		r.Header.Get(AgentIDHeader),
+		r.Header.Get(AgentVersionHeader),
+		r.RemoteAddr,
+		r.Header.Get(AgentReportIntervalHeader),
+		metricCount,
+	)
+}
+
+// touchAgent records the agent with the report interval given in seconds as a string.
+func (server *Server) touchAgent(id string, version string, remoteAddr string, reportInterval string, metricCount int) {
+	var interval time.Duration
+	if sec, err := strconv.Atoi(reportInterval); err == nil {
+		interval = time.Duration(sec) * time.Second
+	}
+
+	server.Agents.Touch(id, version, remoteAddr, interval, metricCount)
+}
+
+// GetAgentsHandler handles GET requests to /agents and returns the known agents as JSON.
+func (server *Server) GetAgentsHandler(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(server.Agents.List())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
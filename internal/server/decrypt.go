@@ -1,48 +1,62 @@
 package server
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"os"
+
+	"metralert/internal/hybrid"
 )
 
-func RetrieveDecrypt(body []byte, privateKeyPath string) ([]byte, error) {
+// ErrLegacyEncryption is returned for bodies encrypted directly with RSA PKCS#1 v1.5
+// when the legacy format is not allowed.
+var ErrLegacyEncryption = errors.New("legacy RSA PKCS#1 v1.5 encryption is not allowed")
+
+func RetrieveDecrypt(body []byte, privateKeyPath string, allowLegacy bool) ([]byte, error) {
 	privateKeyPEM, err := os.ReadFile(privateKeyPath)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return Decrypt(body, privateKeyPEM)
+	return Decrypt(body, privateKeyPEM, allowLegacy)
 }
 
-func Decrypt(body []byte, privateKeyPEM []byte) ([]byte, error) {
+// Decrypt decrypts a hybrid envelope (AES-256-GCM body with an RSA-OAEP wrapped or ECDH derived key)
+// with the private key in PKCS#1, SEC 1 or PKCS#8 PEM encoding.
+// Bodies encrypted directly with RSA PKCS#1 v1.5 by older agents are decrypted only if allowLegacy is set.
+func Decrypt(body []byte, privateKeyPEM []byte, allowLegacy bool) ([]byte, error) {
 
 	if len(body) == 0 || len(privateKeyPEM) == 0 {
 		return nil, errors.New("publicKeyPEM or body are empty")
 	}
 
-	privateKeyStruct, rest := pem.Decode(privateKeyPEM)
-	if privateKeyStruct == nil && len(rest) != 0 {
-		return nil, errors.New("unable to decode PEM PublicKey")
+	privateKey, err := hybrid.ParsePrivateKeyPEM(privateKeyPEM)
+	if err != nil {
+		return nil, err
 	}
 
-	if privateKeyStruct.Type != "RSA PRIVATE KEY" {
-		return nil, errors.New("the key is not private")
-	}
+	return decryptWithKey(body, privateKey, allowLegacy)
+}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(privateKeyStruct.Bytes)
-	if err != nil {
-		return nil, err
+// decryptWithKey decrypts the hybrid envelope or, if allowed, the legacy PKCS#1 v1.5 ciphertext of an RSA key.
+func decryptWithKey(body []byte, privateKey crypto.PrivateKey, allowLegacy bool) ([]byte, error) {
+	if len(body) == 0 {
+		return nil, errors.New("body is empty")
 	}
 
-	encryptedData, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, body)
-	if err != nil {
-		return nil, err
+	if hybrid.IsEnvelope(body) {
+		return hybrid.Open(privateKey, body)
+	}
+	if !allowLegacy {
+		return nil, ErrLegacyEncryption
 	}
 
-	return encryptedData, nil
+	rsaKey, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrLegacyEncryption
+	}
+	return rsa.DecryptPKCS1v15(rand.Reader, rsaKey, body)
 }
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"metralert/internal/hybrid"
+	"metralert/internal/metrics"
+	pb "metralert/internal/proto"
+	"metralert/internal/sign"
+	"metralert/internal/storage"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// responseHashMetadata is the gRPC header carrying the HMAC SHA256 of the response message.
+const responseHashMetadata = "hashsha256"
+
+// metricsService implements the gRPC Metrics service on top of the server storage.
+type metricsService struct {
+	pb.UnimplementedMetricsServer
+	server *Server
+}
+
+// NewGRPCServer creates a gRPC server with the Metrics service registered.
+// The interceptors log every call, reject agents outside the trusted subnet, decrypt the requests
+// with the server private key and verify their HMAC SHA256 hash, mirroring the HTTP middlewares.
+// If TLSConfig is set, the server requires TLS and verifies agent certificates like the HTTP server.
+//
+// Returns:
+//   - A pointer to the configured grpc.Server
+func (server *Server) NewGRPCServer() *grpc.Server {
+	var opts []grpc.ServerOption
+	if server.TLSConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(server.TLSConfig)))
+	}
+	s := grpc.NewServer(append(opts,
+		grpc.ChainUnaryInterceptor(
+			server.loggingUnaryInterceptor,
+			server.trustedSubnetUnaryInterceptor,
+			server.envelopeUnaryInterceptor,
+		),
+		grpc.ChainStreamInterceptor(
+			server.loggingStreamInterceptor,
+			server.trustedSubnetStreamInterceptor,
+			server.envelopeStreamInterceptor,
+		),
+	)...)
+	pb.RegisterMetricsServer(s, &metricsService{server: server})
+	return s
+}
+
+// StartGRPC begins serving gRPC requests on the address.
+// It logs the server start event and any fatal errors that occur during startup.
+//
+// Parameters:
+//   - address: The network address (host:port) on which the gRPC server will listen
+func (server *Server) StartGRPC(address string) {
+	server.logger.Infow(
+		"Starting gRPC server",
+		"url", address)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		server.logger.Fatalw("Unable to listen for gRPC:", err)
+	}
+
+	server.GRPCServer = server.NewGRPCServer()
+	if err = server.GRPCServer.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		server.logger.Fatalw("Unable to start gRPC server:", err)
+	}
+}
+
+// ShutdownGRPC gracefully stops the gRPC server if it was started.
+func (server *Server) ShutdownGRPC() {
+	if server.GRPCServer == nil {
+		return
+	}
+	server.logger.Infow("Shutting down gRPC server")
+	server.GRPCServer.GracefulStop()
+}
+
+// loggingUnaryInterceptor logs the method, time spent and status code of unary calls.
+func (server *Server) loggingUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	server.logger.Infow(
+		"gRPC request received",
+		"Method", info.FullMethod,
+		"TimeSpent", time.Since(start),
+		"ResponseStatus", status.Code(err).String(),
+	)
+	return resp, err
+}
+
+// loggingStreamInterceptor logs the method, time spent and status code of streaming calls.
+func (server *Server) loggingStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	server.logger.Infow(
+		"gRPC stream finished",
+		"Method", info.FullMethod,
+		"TimeSpent", time.Since(start),
+		"ResponseStatus", status.Code(err).String(),
+	)
+	return err
+}
+
+// trustedSubnetUnaryInterceptor rejects unary calls with PermissionDenied
+// unless the x-real-ip metadata belongs to the trusted subnet.
+func (server *Server) trustedSubnetUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := server.checkTrustedPeer(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// trustedSubnetStreamInterceptor rejects streaming calls with PermissionDenied
+// unless the x-real-ip metadata belongs to the trusted subnet.
+func (server *Server) trustedSubnetStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := server.checkTrustedPeer(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// checkTrustedPeer applies the trusted subnet rule to the incoming call metadata.
+func (server *Server) checkTrustedPeer(ctx context.Context) error {
+	realIP := incomingMetadata(ctx, RealIPHeader)
+	if server.isTrusted(realIP) {
+		return nil
+	}
+	server.logger.Infow("gRPC call from untrusted address rejected",
+		"RealIP", realIP,
+		"RemoteAddr", peerAddr(ctx))
+	return status.Error(codes.PermissionDenied, "address is not in the trusted subnet")
+}
+
+// envelopeUnaryInterceptor decrypts and verifies the request and signs the response with the hash key.
+func (server *Server) envelopeUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if msg, ok := req.(pb.Envelope); ok {
+		if err := server.openEnvelope(ctx, msg); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := handler(ctx, req)
+	if err != nil || server.hashKey == "" {
+		return resp, err
+	}
+	if msg, ok := resp.(gproto.Message); ok {
+		if hash, err := pb.HashMessage(msg, server.hashKey); err == nil {
+			grpc.SetHeader(ctx, metadata.Pairs(responseHashMetadata, hash))
+		}
+	}
+	return resp, nil
+}
+
+// envelopeStreamInterceptor decrypts and verifies every message received from the stream.
+func (server *Server) envelopeStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &envelopeServerStream{ServerStream: ss, server: server})
+}
+
+// envelopeServerStream wraps grpc.ServerStream to open every received message.
+type envelopeServerStream struct {
+	grpc.ServerStream
+	server *Server
+}
+
+// RecvMsg receives the next message and decrypts and verifies it.
+func (s *envelopeServerStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if msg, ok := m.(pb.Envelope); ok {
+		return s.server.openEnvelope(s.Context(), msg)
+	}
+	return nil
+}
+
+// openEnvelope decrypts the message with the keyring key selected by the x-encryption-key-id metadata
+// if the keyring is configured and verifies its hash.
+// Errors are converted to gRPC statuses matching the HTTP middlewares responses.
+func (server *Server) openEnvelope(ctx context.Context, msg pb.Envelope) error {
+	var decrypt func([]byte) ([]byte, error)
+	if server.Keyring != nil {
+		keyID := incomingMetadata(ctx, hybrid.KeyIDHeader)
+		decrypt = func(data []byte) ([]byte, error) {
+			return server.Keyring.Decrypt(data, keyID, !server.RejectLegacyEncryption)
+		}
+	}
+
+	err := pb.Open(msg, server.HashVerifier, decrypt)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sign.ErrMissingSignature):
+		return status.Error(codes.Unauthenticated, "message is not signed")
+	case errors.Is(err, pb.ErrInvalidHash):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, pb.ErrUnexpectedEncryption):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		server.logger.Infow("Unable to decrypt gRPC message", "error", err)
+		return status.Error(codes.Unauthenticated, "failed to decrypt message")
+	}
+}
+
+// Update stores a single metric.
+func (s *metricsService) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
+	if req.GetMetric() == nil {
+		return nil, status.Error(codes.InvalidArgument, "metric is empty")
+	}
+
+	result, err := s.server.storage.UpdateMetric(ctx, req.GetMetric().ToMetrics())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	s.server.evaluateAlerts(*result)
+	s.server.trackGRPCAgent(ctx, 1)
+
+	return &pb.UpdateResponse{Metric: pb.FromMetrics(*result)}, nil
+}
+
+// UpdateBatch stores a batch of metrics.
+func (s *metricsService) UpdateBatch(ctx context.Context, req *pb.UpdateBatchRequest) (*pb.UpdateBatchResponse, error) {
+	result, err := s.server.updateGRPCBatch(ctx, req.GetMetrics())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UpdateBatchResponse{Metrics: pb.FromMetricsSlice(result)}, nil
+}
+
+// StreamMetrics collects the batches received from the client stream and stores them as a single batch
+// when the client closes the stream, then returns the number of stored metrics.
+// A stream that fails midway stores nothing, so the agent can resend it without counting counters twice.
+func (s *metricsService) StreamMetrics(stream grpc.ClientStreamingServer[pb.UpdateBatchRequest, pb.StreamMetricsResponse]) error {
+	var batch []*pb.Metric
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		batch = append(batch, req.GetMetrics()...)
+	}
+
+	result, err := s.server.updateGRPCBatch(stream.Context(), batch)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&pb.StreamMetricsResponse{Received: int64(len(result))})
+}
+
+// updateGRPCBatch audits and stores a batch of metrics, then evaluates alerts and tracks the agent.
+func (server *Server) updateGRPCBatch(ctx context.Context, batch []*pb.Metric) ([]metrics.Metrics, error) {
+	ms := pb.ToMetricsSlice(batch)
+
+	metricNames := make([]string, 0, len(ms))
+	for _, m := range ms {
+		metricNames = append(metricNames, m.ID)
+	}
+	server.audit(metrics.AuditMetrics{
+		TS:          time.Now().Unix(),
+		MetricNames: metricNames,
+		IP:          peerAddr(ctx),
+		AgentID:     incomingMetadata(ctx, AgentIDHeader),
+	})
+
+	result, err := server.storage.UpdateBatchMetrics(ctx, ms)
+	if errors.Is(err, storage.ErrIncompatible) {
+		server.evaluateAlerts(result...)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	server.evaluateAlerts(result...)
+	server.trackGRPCAgent(ctx, len(result))
+	return result, nil
+}
+
+// trackGRPCAgent records the agent identified by the incoming call metadata.
+func (server *Server) trackGRPCAgent(ctx context.Context, metricCount int) {
+	server.touchAgent(
+		incomingMetadata(ctx, AgentIDHeader),
+		incomingMetadata(ctx, AgentVersionHeader),
+		peerAddr(ctx),
+		incomingMetadata(ctx, AgentReportIntervalHeader),
+		metricCount,
+	)
+}
+
+// incomingMetadata returns the first value of the incoming metadata key.
+func incomingMetadata(ctx context.Context, key string) string {
+	if values := metadata.ValueFromIncomingContext(ctx, key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// peerAddr returns the remote address of the gRPC client.
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
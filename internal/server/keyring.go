@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"metralert/internal/hybrid"
+)
+
+// ErrUnknownKey is returned when the agent requests a key that is not in the keyring.
+var ErrUnknownKey = errors.New("unknown encryption key id")
+
+// Keyring holds the private keys used to decrypt agent payloads, identified by key ID.
+// The keys are loaded from a single PEM file or from every *.pem file of a directory,
+// skipping files with public keys or certificates, and can be reloaded at runtime
+// to rotate keys without a restart. RSA, ECDSA and X25519 keys are supported.
+type Keyring struct {
+	mutex     sync.RWMutex
+	path      string
+	keys      map[string]crypto.PrivateKey
+	ids       []string
+	signature string
+}
+
+// LoadKeyring loads the private keys from the file or directory.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads the key files. The current keys are kept if the new ones can not be loaded.
+func (k *Keyring) Reload() error {
+	files, signature, err := keyFiles(k.path)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PrivateKey, len(files))
+	for _, file := range files {
+		keyPEM, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("unable to read private key %s: %w", file, err)
+		}
+		privateKey, err := hybrid.ParsePrivateKeyPEM(keyPEM)
+		if errors.Is(err, hybrid.ErrNotPrivateKey) {
+			// открытые ключи и сертификаты могут лежать в том же каталоге
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to parse private key %s: %w", file, err)
+		}
+		publicKey, err := hybrid.PublicKey(privateKey)
+		if err != nil {
+			return err
+		}
+		id, err := hybrid.KeyID(publicKey)
+		if err != nil {
+			return err
+		}
+		keys[id] = privateKey
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no private keys found in %s", k.path)
+	}
+
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys = keys
+	k.ids = ids
+	k.signature = signature
+	return nil
+}
+
+// Changed reports whether the key files were modified since the last successful load.
+func (k *Keyring) Changed() bool {
+	_, signature, err := keyFiles(k.path)
+	if err != nil {
+		return false
+	}
+
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return signature != k.signature
+}
+
+// IDs returns the sorted IDs of the loaded keys.
+func (k *Keyring) IDs() []string {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return append([]string(nil), k.ids...)
+}
+
+// Decrypt decrypts the body with the key identified by keyID.
+// Without a key ID, as sent by older agents, every key of the keyring is tried.
+func (k *Keyring) Decrypt(body []byte, keyID string, allowLegacy bool) ([]byte, error) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	if keyID != "" {
+		privateKey, ok := k.keys[keyID]
+		if !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+		}
+		return decryptWithKey(body, privateKey, allowLegacy)
+	}
+
+	var err error
+	for _, id := range k.ids {
+		var decrypted []byte
+		if decrypted, err = decryptWithKey(body, k.keys[id], allowLegacy); err == nil {
+			return decrypted, nil
+		}
+	}
+	return nil, err
+}
+
+// keyFiles returns the key files of the path and a signature of their names, sizes and modification times.
+func keyFiles(path string) ([]string, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.pem"))
+		if err != nil {
+			return nil, "", err
+		}
+		sort.Strings(files)
+	}
+
+	var signature strings.Builder
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(&signature, "%s:%d:%d;", file, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return files, signature.String(), nil
+}
+
+// KeyringReloader reloads the keyring on every value received from reloadCh (SIGHUP)
+// and when the key files change, checking them every interval, until ctx is cancelled.
+// If the keyring is not configured, the function returns immediately.
+func (server *Server) KeyringReloader(ctx context.Context, reloadCh <-chan os.Signal, interval time.Duration) {
+	if server.Keyring == nil {
+		return
+	}
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	reload := func(reason string) {
+		if err := server.Keyring.Reload(); err != nil {
+			server.logger.Errorw("Unable to reload private keys, keeping the current ones", "reason", reason, "error", err)
+			return
+		}
+		server.logger.Infow("Private keys reloaded", "reason", reason, "ids", server.Keyring.IDs())
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reloadCh:
+			reload("signal")
+		case <-tick:
+			if server.Keyring.Changed() {
+				reload("file change")
+			}
+		}
+	}
+}
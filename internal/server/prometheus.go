@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"metralert/internal/metrics"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// promSample is a single series of a Prometheus metric family.
+// Histograms have several lines: buckets, sum and count.
+type promSample struct {
+	lines []string
+}
+
+// promFamily groups the samples sharing a sanitized metric name.
+type promFamily struct {
+	name    string
+	mtype   string
+	help    string
+	samples []promSample
+}
+
+// PrometheusHandler handles GET /metrics requests and renders all stored metrics
+// in the Prometheus text exposition format.
+func (server *Server) PrometheusHandler(w http.ResponseWriter, r *http.Request) {
+	allMetrics, err := server.storage.GetMetrics(r.Context())
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.WriteHeader(http.StatusOK)
+	skipped, err := WritePrometheus(w, allMetrics, server.PrometheusLabels)
+	if err != nil {
+		server.logger.Warnw("Unable to write prometheus exposition", "error", err)
+	}
+	if len(skipped) > 0 {
+		server.logger.Warnw("Metrics skipped in prometheus exposition because their names or label names clash after sanitizing",
+			"metrics", skipped)
+	}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format.
+// Gauges are exposed as gauge, counters as counter and histograms as histogram families
+// with cumulative _bucket, _sum and _count lines. Sets are exposed as gauges of the
+// estimated number of distinct items. constLabels are added to every sample
+// and are overridden by the metric labels with the same name.
+//
+// Different IDs may produce the same sanitized name, e.g. "a.b" and "a_b". A metric is skipped
+// if its family already has another type or if one of its series is already written by another metric,
+// the metric whose ID needs no sanitizing is kept. A metric is also skipped if two of its label names,
+// including constLabels, sanitize to the same name, or if a histogram label sanitizes to the reserved "le".
+// The keys of the skipped metrics are returned.
+func WritePrometheus(w io.Writer, all map[string]metrics.Metrics, constLabels map[string]string) ([]string, error) {
+	families := make(map[string]*promFamily)
+	// series - имена серий с метками, уже занятые записанными метриками
+	series := make(map[string]struct{})
+	var skipped []string
+
+	// порядок обхода определяет, какая из конфликтующих метрик останется,
+	// поэтому сначала идут метрики с допустимым именем, затем по ключу
+	keys := slices.Collect(maps.Keys(all))
+	slices.SortFunc(keys, func(a, b string) int {
+		aExact := SanitizeMetricName(all[a].ID) == all[a].ID
+		bExact := SanitizeMetricName(all[b].ID) == all[b].ID
+		if aExact != bExact {
+			if aExact {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+
+	for _, key := range keys {
+		m := all[key]
+		var mtype string
+		switch m.MType {
+		case "gauge", "counter", "histogram":
+			mtype = m.MType
+		case "set":
+			mtype = "gauge"
+		default:
+			continue
+		}
+
+		labels := mergeLabels(constLabels, m.Labels)
+		if labelNamesClash(labels, m.MType == "histogram") {
+			skipped = append(skipped, key)
+			continue
+		}
+		name := SanitizeMetricName(m.ID)
+		lines := promLines(name, labels, m)
+		if len(lines) == 0 {
+			continue
+		}
+
+		family, ok := families[name]
+		if ok && family.mtype != mtype {
+			skipped = append(skipped, key)
+			continue
+		}
+		if slices.ContainsFunc(lines, func(line string) bool {
+			_, dup := series[promSeries(line)]
+			return dup
+		}) {
+			skipped = append(skipped, key)
+			continue
+		}
+		for _, line := range lines {
+			series[promSeries(line)] = struct{}{}
+		}
+
+		if !ok {
+			family = &promFamily{
+				name:  name,
+				mtype: mtype,
+				help:  fmt.Sprintf("Metric %s of type %s reported by metralert agents.", m.ID, m.MType),
+			}
+			families[name] = family
+		}
+		family.samples = append(family.samples, promSample{lines: lines})
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		family := families[name]
+		fmt.Fprintf(bw, "# HELP %s %s\n", family.name, escapeHelp(family.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", family.name, family.mtype)
+
+		// серии сортируются по первой строке, строки гистограммы остаются в порядке бакетов
+		sort.Slice(family.samples, func(i, j int) bool {
+			return family.samples[i].lines[0] < family.samples[j].lines[0]
+		})
+		for _, sample := range family.samples {
+			for _, line := range sample.lines {
+				bw.WriteString(line)
+				bw.WriteByte('\n')
+			}
+		}
+	}
+	return skipped, bw.Flush()
+}
+
+// promSeries returns the series of an exposition line: the name with labels without the value.
+func promSeries(line string) string {
+	return line[:strings.LastIndexByte(line, ' ')]
+}
+
+// SanitizeMetricName converts a metric ID into a valid Prometheus metric name
+// matching [a-zA-Z_:][a-zA-Z0-9_:]*.
+func SanitizeMetricName(id string) string {
+	if id == "" {
+		return "_"
+	}
+
+	var b strings.Builder
+	for i, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// sanitizeLabelName converts a label key into a valid Prometheus label name matching [a-zA-Z_][a-zA-Z0-9_]*.
+func sanitizeLabelName(name string) string {
+	return strings.ReplaceAll(SanitizeMetricName(name), ":", "_")
+}
+
+// labelNamesClash reports whether two label names sanitize to the same name,
+// or, for histograms, a label name sanitizes to "le", which holds the bucket bound.
+func labelNamesClash(labels map[string]string, histogram bool) bool {
+	names := make(map[string]struct{}, len(labels))
+	for k := range labels {
+		name := sanitizeLabelName(k)
+		if _, dup := names[name]; dup || histogram && name == "le" {
+			return true
+		}
+		names[name] = struct{}{}
+	}
+	return false
+}
+
+func mergeLabels(constLabels map[string]string, labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return constLabels
+	}
+	if len(constLabels) == 0 {
+		return labels
+	}
+	result := maps.Clone(constLabels)
+	maps.Copy(result, labels)
+	return result
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, sanitizeLabelName(k)+`="`+escapeLabelValue(labels[k])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v)
+}
+
+// promLines returns the exposition lines of the metric series, nil if the metric has no value.
+func promLines(name string, labels map[string]string, m metrics.Metrics) []string {
+	switch {
+	case m.MType == "gauge" && m.Value != nil:
+		return []string{name + formatLabels(labels) + " " + strconv.FormatFloat(*m.Value, 'g', -1, 64)}
+	case m.MType == "counter" && m.Delta != nil:
+		return []string{name + formatLabels(labels) + " " + strconv.FormatInt(*m.Delta, 10)}
+	case m.MType == "set" && m.Set != nil:
+		return []string{name + formatLabels(labels) + " " + strconv.FormatUint(m.Set.Estimate(), 10)}
+	case m.MType == "histogram" && m.Histogram != nil:
+		h := m.Histogram
+		if len(h.Counts) != len(h.Bounds)+1 {
+			return nil
+		}
+		lines := make([]string, 0, len(h.Counts)+2)
+		var cumulative uint64
+		for i, c := range h.Counts {
+			cumulative += c
+			le := "+Inf"
+			if i < len(h.Bounds) {
+				le = strconv.FormatFloat(h.Bounds[i], 'g', -1, 64)
+			}
+			bucketLabels := maps.Clone(labels)
+			if bucketLabels == nil {
+				bucketLabels = make(map[string]string, 1)
+			}
+			bucketLabels["le"] = le
+			lines = append(lines, name+"_bucket"+formatLabels(bucketLabels)+" "+strconv.FormatUint(cumulative, 10))
+		}
+		lines = append(lines,
+			name+"_sum"+formatLabels(labels)+" "+strconv.FormatFloat(h.Sum, 'g', -1, 64),
+			name+"_count"+formatLabels(labels)+" "+strconv.FormatUint(h.Count, 10),
+		)
+		return lines
+	}
+	return nil
+}
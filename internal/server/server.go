@@ -7,11 +7,15 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"slices"
@@ -19,14 +23,20 @@ import (
 	"strings"
 	"time"
 
+	"metralert/internal/alert"
+	"metralert/internal/history"
+	"metralert/internal/hybrid"
 	"metralert/internal/metrics"
+	"metralert/internal/notify"
 	"metralert/internal/reset"
+	"metralert/internal/sign"
 	"metralert/internal/storage"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 // Server represents the main server structure that handles HTTP requests and manages metrics storage.
@@ -34,12 +44,35 @@ type Server struct {
 	storage         storage.StorageInterface
 	logger          *zap.SugaredLogger
 	HTTPServer      *http.Server
+	GRPCServer      *grpc.Server
 	Router          *chi.Mux
 	hashKey         string
 	AuditCh         chan metrics.AuditMetrics
 	MetricPool      *reset.PoolNaive[*metrics.Metrics]
 	BatchMetricPool *reset.PoolNaive[*metrics.MetricsGroup]
 	PrivateKeyPath  string
+	Alerts          *alert.Engine
+	NotifyCh        chan alert.Alert
+	// PrometheusLabels are added to every sample exposed on /metrics.
+	PrometheusLabels map[string]string
+	Agents           *AgentRegistry
+	// TrustedSubnet restricts metric ingestion to agents whose X-Real-IP belongs to the subnet.
+	// A nil subnet allows any address.
+	TrustedSubnet *net.IPNet
+	// HashVerifier checks the request signatures made with the hash key.
+	HashVerifier *sign.Verifier
+	// RejectLegacyEncryption rejects bodies encrypted directly with RSA PKCS#1 v1.5 instead of the hybrid envelope.
+	RejectLegacyEncryption bool
+	// Keyring holds the private keys loaded from PrivateKeyPath, nil if decryption is disabled.
+	Keyring *Keyring
+	// TLSConfig enables HTTPS and TLS for gRPC. Agent certificates are verified if it has client CAs.
+	TLSConfig *tls.Config
+}
+
+// mainPageData holds the data rendered by the mainpage.html template.
+type mainPageData struct {
+	Metrics map[string]metrics.Metrics
+	Alerts  []alert.Alert
 }
 
 // New creates and configures a new Server instance with the specified address, storage repository,
@@ -61,32 +94,49 @@ func New(address string, repo storage.StorageInterface, hashKey string, logger *
 	s.PrivateKeyPath = PrivateKeyPath
 
 	if s.PrivateKeyPath != "" {
+		var err error
+		s.Keyring, err = LoadKeyring(s.PrivateKeyPath)
+		if err != nil {
+			logger.Fatalw("Unable to load private keys", "path", s.PrivateKeyPath, "error", err)
+		}
+		logger.Infow("Private keys loaded", "ids", s.Keyring.IDs())
 		s.Router.Use(s.DecryptMiddleware)
 	}
 	s.Router.Use(middleware.Compress(5, "application/json", "text/html"))
 	s.Router.Get("/ping", s.DatabasePinger)
-	s.Router.Route("/update", func(router chi.Router) {
-		router.Post("/{metrictype}/{metricname}/{metricvalue}", s.UpdateHandler)
-		router.Post("/", s.UpdateMetricJSONHandler)
+	s.Router.Group(func(router chi.Router) {
+		router.Use(s.trustedSubnetMiddleware)
+		router.Route("/update", func(router chi.Router) {
+			router.Post("/{metrictype}/{metricname}/{metricvalue}", s.UpdateHandler)
+			router.Post("/", s.UpdateMetricJSONHandler)
+		})
+		router.Post("/updates/", s.UpdateBatchMetricsJSONHandler)
 	})
 	s.Router.Get("/", s.GetMainHandler)
 	s.Router.Route("/value", func(router chi.Router) {
 		router.Get("/{metrictype}/{metricname}", s.GetMetricHandler)
 		router.Post("/", s.ReadMetricJSONHandler)
 	})
-	s.Router.Post("/updates/", s.UpdateBatchMetricsJSONHandler)
+	s.Router.Get("/alerts", s.GetAlertsHandler)
+	s.Router.Get("/query", s.QueryHandler)
+	s.Router.Get("/metrics", s.PrometheusHandler)
+	s.Router.Get("/agents", s.GetAgentsHandler)
 
 	s.Router.Mount("/debug/pprof", http.DefaultServeMux)
 
 	s.storage = repo
 	s.logger = logger
 	s.hashKey = hashKey
+	s.HashVerifier = sign.NewVerifier(hashKey, false, sign.DefaultMaxSkew, sign.DefaultNonceCacheSize)
 
 	s.HTTPServer = &http.Server{
 		Addr:    address,
 		Handler: s.Router,
 	}
 	s.AuditCh = make(chan metrics.AuditMetrics, 50)
+	s.Alerts, _ = alert.NewEngine(nil)
+	s.NotifyCh = make(chan alert.Alert, 50)
+	s.Agents = NewAgentRegistry(defaultStaleIntervals)
 
 	s.MetricPool = reset.NewPoolNaive(func() *metrics.Metrics {
 		return &metrics.Metrics{}
@@ -101,14 +151,22 @@ func New(address string, repo storage.StorageInterface, hashKey string, logger *
 	return s
 }
 
-// Start begins listening for and serving HTTP requests on the configured address.
-// It logs the server start event and any fatal errors that occur during startup.
+// Start begins listening for and serving HTTP requests on the configured address,
+// or HTTPS requests if TLSConfig is set. It logs the server start event and any fatal errors that occur during startup.
 func (server *Server) Start() {
 	server.logger.Infow(
 		"Starting server",
-		"url", server.HTTPServer.Addr)
+		"url", server.HTTPServer.Addr,
+		"tls", server.TLSConfig != nil)
 
-	err := server.HTTPServer.ListenAndServe()
+	var err error
+	if server.TLSConfig != nil {
+		server.HTTPServer.TLSConfig = server.TLSConfig
+		// сертификат и ключ уже загружены в TLSConfig
+		err = server.HTTPServer.ListenAndServeTLS("", "")
+	} else {
+		err = server.HTTPServer.ListenAndServe()
+	}
 	if err != http.ErrServerClosed {
 		server.logger.Fatalw("Unable to start server:", err)
 	}
@@ -181,16 +239,24 @@ func (server *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(logFn)
 }
 
-// verifyHashMiddleware is a middleware function that verifies the HMAC SHA256 hash of the request body
-// against the "Hash" header. If the hash key is not set or the hashes don't match, it returns a 400 error.
+// verifyHashMiddleware is a middleware function that verifies the HMAC SHA256 signature of the request body
+// against the "Hash" header. The signature covers the timestamp and nonce headers if they are present.
+// Unsigned requests are rejected only in strict mode and only if they may carry a body,
+// so GET pages and /metrics stay readable. An invalid, stale or replayed signature results in a 400 error.
 func (server *Server) verifyHashMiddleware(next http.Handler) http.Handler {
 	logFn := func(w http.ResponseWriter, r *http.Request) {
 
-		receivedHash := r.Header.Get("Hash")
+		receivedHash := r.Header.Get(sign.HashHeader)
 		server.logger.Info("Headers ", r.Header)
 		server.logger.Info("Received hash ", receivedHash)
 
-		if server.hashKey == "" || receivedHash == "" || receivedHash == "none" {
+		if !server.HashVerifier.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+		unsigned := receivedHash == "" || receivedHash == "none"
+		if unsigned && (readOnly || !server.HashVerifier.Strict()) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -206,14 +272,13 @@ func (server *Server) verifyHashMiddleware(next http.Handler) http.Handler {
 		// Восстанавливаем тело
 		r.Body = io.NopCloser(bytes.NewReader(body))
 
-		// Вычисляем хеш
-		h := hmac.New(sha256.New, []byte(server.hashKey))
-		h.Write(body)
-		calculatedHash := hex.EncodeToString(h.Sum(nil))
-		server.logger.Info("Calculated hash ", calculatedHash)
-		// Сравниваем хеши
-		if calculatedHash != receivedHash {
-			http.Error(w, "Invalid body hash", http.StatusBadRequest)
+		stamp, err := sign.StampFromHeader(r.Header)
+		if err == nil {
+			err = server.HashVerifier.Verify(receivedHash, stamp, body)
+		}
+		if err != nil {
+			server.logger.Infow("Request signature rejected", "error", err, "RemoteAddr", r.RemoteAddr)
+			http.Error(w, "Invalid body hash: "+err.Error(), http.StatusBadRequest)
 			return
 		}
 
@@ -251,8 +316,11 @@ func (server *Server) hashMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(logFn)
 }
 
-// DecryptMiddleware is a middleware function that decrypts the request body using RSA decryption.
-// It reads the encrypted body, decrypts it using the private key, and restores the decrypted body.
+// DecryptMiddleware is a middleware function that decrypts the request body encrypted by the agent.
+// It reads the hybrid envelope (AES-256-GCM body, RSA-OAEP wrapped key), decrypts it using the keyring key
+// selected by the X-Encryption-Key-ID header, and restores the decrypted body. Without the header every
+// key is tried. The legacy RSA PKCS#1 v1.5 format is accepted unless RejectLegacyEncryption is set.
+// Requests without a body, such as GET pages, are passed through.
 func (server *Server) DecryptMiddleware(next http.Handler) http.Handler {
 	logFn := func(w http.ResponseWriter, r *http.Request) {
 
@@ -264,8 +332,15 @@ func (server *Server) DecryptMiddleware(next http.Handler) http.Handler {
 		}
 		defer r.Body.Close()
 
-		decryptedBody, err := RetrieveDecrypt(body, server.PrivateKeyPath)
+		if len(body) == 0 {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		decryptedBody, err := server.Keyring.Decrypt(body, r.Header.Get(hybrid.KeyIDHeader), !server.RejectLegacyEncryption)
 		if err != nil {
+			server.logger.Infow("Unable to decrypt body", "error", err, "RemoteAddr", r.RemoteAddr)
 			http.Error(w, "Failed to decrypt body", http.StatusUnauthorized)
 			return
 		}
@@ -278,6 +353,33 @@ func (server *Server) DecryptMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(logFn)
 }
 
+// trustedSubnetMiddleware is a middleware function that rejects requests with a 403 error
+// unless the address in the X-Real-IP header belongs to the trusted subnet.
+// If the trusted subnet is not configured, all requests are allowed.
+func (server *Server) trustedSubnetMiddleware(next http.Handler) http.Handler {
+	logFn := func(w http.ResponseWriter, r *http.Request) {
+		if !server.isTrusted(r.Header.Get(RealIPHeader)) {
+			server.logger.Infow("Request from untrusted address rejected",
+				"RealIP", r.Header.Get(RealIPHeader),
+				"RemoteAddr", r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(logFn)
+}
+
+// isTrusted reports whether the address belongs to the trusted subnet.
+func (server *Server) isTrusted(realIP string) bool {
+	if server.TrustedSubnet == nil {
+		return true
+	}
+	ip := net.ParseIP(strings.TrimSpace(realIP))
+	return ip != nil && server.TrustedSubnet.Contains(ip)
+}
+
 // GetMainHandler handles GET requests to the root path and renders all metrics in an HTML page.
 // It retrieves all metrics from storage and executes the mainpage.html template.
 func (server *Server) GetMainHandler(w http.ResponseWriter, r *http.Request) {
@@ -294,20 +396,77 @@ func (server *Server) GetMainHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	data := mainPageData{
+		Metrics: allMetrics,
+		Alerts:  server.Alerts.Active(),
+	}
+
 	w.Header().Set("Content-Type", "text/html")
 	w.WriteHeader(http.StatusOK)
-	tmpl.Execute(w, allMetrics)
+	tmpl.Execute(w, data)
+}
+
+// GetAlertsHandler handles GET requests to /alerts and returns the currently firing alerts as JSON.
+func (server *Server) GetAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(server.Alerts.Active())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// evaluateAlerts runs the alert rules over successfully updated metrics, logs state changes
+// and passes them to NotifyCh. Changes are dropped if the notification queue is full.
+func (server *Server) evaluateAlerts(updated ...metrics.Metrics) {
+	for _, a := range server.Alerts.Evaluate(updated) {
+		server.logger.Warnw("Alert state changed",
+			"rule", a.Rule,
+			"metric", a.Metric,
+			"state", a.State,
+			"value", a.Value,
+			"threshold", a.Threshold)
+
+		select {
+		case server.NotifyCh <- a:
+		default:
+			server.logger.Warnw("Notification queue is full, alert dropped", "rule", a.Rule)
+		}
+	}
+}
+
+// audit passes the entry to AuditCh. Entries are dropped if the audit queue is full,
+// for example when no audit destination is configured and AuditLogger does not read the queue.
+func (server *Server) audit(entry metrics.AuditMetrics) {
+	select {
+	case server.AuditCh <- entry:
+	default:
+		server.logger.Debugw("Audit queue is full, entry dropped", "agent", entry.AgentID)
+	}
 }
 
 // GetMetricHandler handles GET requests to retrieve a specific metric by type and name.
-// It returns the metric value as a string in the response body.
+// Labels may be passed in the "labels" query parameter as "host=a,instance=b".
+// It returns the metric value as a string in the response body. For histograms it returns
+// the count, sum and p50/p95/p99 estimates, or a single estimate if the "quantile" parameter is set.
+// For sets it returns the estimated number of distinct items.
 func (server *Server) GetMetricHandler(w http.ResponseWriter, r *http.Request) {
 	metrictype := chi.URLParam(r, "metrictype")
 	metricname := chi.URLParam(r, "metricname")
 
+	labels, err := metrics.ParseLabels(r.URL.Query().Get("labels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	metric := metrics.Metrics{
-		ID:    metricname,
-		MType: metrictype,
+		ID:     metricname,
+		MType:  metrictype,
+		Labels: labels,
 	}
 
 	storageMetric, ok := server.storage.GetMetricByName(r.Context(), metric)
@@ -315,6 +474,14 @@ func (server *Server) GetMetricHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
+	if storageMetric.Histogram != nil {
+		writeHistogram(w, r, storageMetric.Histogram)
+		return
+	}
+	if storageMetric.Set != nil {
+		fmt.Fprint(w, storageMetric.Set.Estimate())
+		return
+	}
 	if storageMetric.Value != nil {
 		fmt.Fprint(w, *storageMetric.Value)
 	}
@@ -323,21 +490,48 @@ func (server *Server) GetMetricHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// writeHistogram writes the histogram summary, or the estimate of the quantile
+// given in the "quantile" query parameter as a number between 0 and 1.
+func writeHistogram(w http.ResponseWriter, r *http.Request, h *metrics.Histogram) {
+	q := r.URL.Query().Get("quantile")
+	if q == "" {
+		fmt.Fprint(w, h.String())
+		return
+	}
+	quantile, err := strconv.ParseFloat(q, 64)
+	if err != nil || quantile < 0 || quantile > 1 {
+		http.Error(w, "invalid quantile", http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, h.Quantile(quantile))
+}
+
 // UpdateHandler handles POST requests to update a single metric via URL parameters.
-// It supports both counter (integer) and gauge (float64) metric types.
+// It supports counter (integer), gauge (float64) and histogram metric types,
+// labels may be passed in the "labels" query parameter as "host=a,instance=b".
+// A histogram value is a single observation, bucket bounds may be passed in the "buckets"
+// query parameter as "0.1,0.5,1", metrics.DefaultBuckets are used otherwise.
+// A set value is a single item added to the set.
 func (server *Server) UpdateHandler(w http.ResponseWriter, r *http.Request) {
 	metrictype := chi.URLParam(r, "metrictype")
 	metricname := chi.URLParam(r, "metricname")
 	metricvalue := chi.URLParam(r, "metricvalue")
 
+	labels, err := metrics.ParseLabels(r.URL.Query().Get("labels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	metric := metrics.Metrics{
-		ID:    metricname,
-		MType: metrictype,
+		ID:     metricname,
+		MType:  metrictype,
+		Labels: labels,
 	}
 
 	resultMetric := &metrics.Metrics{}
 
-	types := []string{"gauge", "counter"}
+	types := []string{"gauge", "counter", "histogram", "set"}
 	if !slices.Contains(types, metrictype) {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
@@ -356,6 +550,8 @@ func (server *Server) UpdateHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
+		server.evaluateAlerts(*resultMetric)
+		server.trackAgent(r, 1)
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Принята метрика: (Тип: counter, Имя: %s, Значение: %d)\n", metricname, *resultMetric.Delta)
 	case "gauge":
@@ -370,8 +566,42 @@ func (server *Server) UpdateHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
+		server.evaluateAlerts(*resultMetric)
+		server.trackAgent(r, 1)
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Принята метрика: (Тип: counter, Имя: %s, Значение: %f)\n", metricname, *resultMetric.Value)
+	case "histogram":
+		observation, err := strconv.ParseFloat(metricvalue, 64)
+		if err != nil || math.IsNaN(observation) || math.IsInf(observation, 0) {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		bounds, err := metrics.ParseBuckets(r.URL.Query().Get("buckets"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metric.Histogram = metrics.NewHistogram(bounds)
+		metric.Histogram.Observe(observation)
+		resultMetric, err = server.storage.UpdateMetric(r.Context(), metric)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		server.trackAgent(r, 1)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Принята метрика: (Тип: histogram, Имя: %s, Значение: %s)\n", metricname, resultMetric.Histogram)
+	case "set":
+		metric.Set = metrics.NewHyperLogLog(metrics.DefaultPrecision)
+		metric.Set.Add(metricvalue)
+		resultMetric, err = server.storage.UpdateMetric(r.Context(), metric)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		server.trackAgent(r, 1)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Принята метрика: (Тип: set, Имя: %s, Значение: %d)\n", metricname, resultMetric.Set.Estimate())
 	default:
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
@@ -380,6 +610,8 @@ func (server *Server) UpdateHandler(w http.ResponseWriter, r *http.Request) {
 
 // ReadMetricJSONHandler handles POST requests to retrieve a metric in JSON format.
 // It expects a JSON payload with metric ID and type, and returns the full metric object as JSON.
+// Histograms are returned with p50/p95/p99 estimates in the "quantiles" field,
+// sets with the estimated number of distinct items in the "cardinality" field.
 func (server *Server) ReadMetricJSONHandler(w http.ResponseWriter, r *http.Request) {
 	var metric metrics.Metrics
 	var buf bytes.Buffer
@@ -401,6 +633,17 @@ func (server *Server) ReadMetricJSONHandler(w http.ResponseWriter, r *http.Reque
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
+	if storageMetric.Histogram != nil {
+		// копия, чтобы оценки квантилей не попали в хранилище
+		histogram := storageMetric.Histogram.Clone()
+		histogram.SetQuantiles()
+		storageMetric.Histogram = histogram
+	}
+	if storageMetric.Set != nil {
+		set := storageMetric.Set.Clone()
+		set.SetCardinality()
+		storageMetric.Set = set
+	}
 
 	resp, err := json.Marshal(storageMetric)
 	if err != nil {
@@ -412,6 +655,117 @@ func (server *Server) ReadMetricJSONHandler(w http.ResponseWriter, r *http.Reque
 	w.Write(resp)
 }
 
+// queryResponse is the JSON body returned by QueryHandler.
+type queryResponse struct {
+	ID     string            `json:"id"`
+	MType  string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Func   string            `json:"func"`
+	From   time.Time         `json:"from"`
+	To     time.Time         `json:"to"`
+	Step   string            `json:"step"`
+	Points []history.Point   `json:"points"`
+}
+
+// parseQueryTime parses a time given either in RFC3339 or as unix seconds.
+// An empty value returns def.
+func parseQueryTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// parseQueryStep parses a step given either as a Go duration ("60s", "5m") or as seconds.
+func parseQueryStep(v string) (time.Duration, error) {
+	if v == "" {
+		return time.Minute, nil
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(sec) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// QueryHandler handles GET /query requests and returns the metric history between from and to
+// downsampled into step buckets with the aggregation function func (avg, min, max, last, sum, rate).
+// Labels of the series are selected with the "labels" parameter as "host=a,instance=b".
+// Defaults: the last hour, 60s step, avg.
+func (server *Server) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	to, err := parseQueryTime(params.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseQueryTime(params.Get("from"), to.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	step, err := parseQueryStep(params.Get("step"))
+	if err != nil {
+		http.Error(w, "invalid step: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	labels, err := metrics.ParseLabels(params.Get("labels"))
+	if err != nil {
+		http.Error(w, "invalid labels: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := history.Query{
+		ID:    params.Get("id"),
+		MType: params.Get("type"),
+		From:  from,
+		To:    to,
+		Step:  step,
+		Func:  params.Get("func"),
+	}
+	if q.Func == "" {
+		q.Func = history.FuncAvg
+	}
+	if err = q.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	samples, err := server.storage.GetHistory(r.Context(), metrics.Metrics{ID: q.ID, MType: q.MType, Labels: labels}, q.From, q.To)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	points, err := history.Downsample(samples, q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := json.Marshal(queryResponse{
+		ID:     q.ID,
+		MType:  q.MType,
+		Labels: labels,
+		Func:   q.Func,
+		From:   q.From,
+		To:     q.To,
+		Step:   q.Step.String(),
+		Points: points,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
 // gzipDecompress decompresses a gzipped byte slice and returns the decompressed data.
 // It returns an error if decompression fails.
 func gzipDecompress(body []byte) ([]byte, error) {
@@ -461,6 +815,8 @@ func (server *Server) UpdateMetricJSONHandler(w http.ResponseWriter, r *http.Req
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
+	server.evaluateAlerts(*resultMetric)
+	server.trackAgent(r, 1)
 
 	resp, err := json.Marshal(resultMetric)
 	if err != nil {
@@ -516,15 +872,23 @@ func (server *Server) UpdateBatchMetricsJSONHandler(w http.ResponseWriter, r *ht
 		TS:          time.Now().Unix(),
 		MetricNames: metricNames,
 		IP:          r.RemoteAddr,
+		AgentID:     r.Header.Get(AgentIDHeader),
 	}
 
-	server.AuditCh <- auditEntry
+	server.audit(auditEntry)
 
 	resultMetrics, err := server.storage.UpdateBatchMetrics(r.Context(), metricsRead.Slice)
+	if errors.Is(err, storage.ErrIncompatible) {
+		server.evaluateAlerts(resultMetrics...)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	server.evaluateAlerts(resultMetrics...)
+	server.trackAgent(r, len(resultMetrics))
 
 	resp, err := json.Marshal(resultMetrics)
 	if err != nil {
@@ -600,3 +964,41 @@ func (server *Server) AuditLogger(auditFile string, auditURL string) {
 		server.logger.Debugln(auditEntry)
 	}
 }
+
+// AlertNotifier runs a background loop that processes alert state changes from the NotifyCh channel
+// and delivers them through the dispatcher until ctx is cancelled.
+// Alerts that the dispatcher failed to deliver are passed to it again periodically.
+// If the dispatcher has a repeat interval, the active alerts are passed to it periodically as well,
+// so that still firing alerts are notified again. If the dispatcher has no sinks, the function returns immediately.
+func (server *Server) AlertNotifier(ctx context.Context, dispatcher *notify.Dispatcher) {
+	if dispatcher.Empty() {
+		return
+	}
+
+	tick := time.Second
+	if interval := dispatcher.RepeatInterval(); interval > 0 {
+		// the dispatcher decides whether the interval has passed for each alert,
+		// a short tick keeps repeats from being delayed by up to another interval
+		tick = min(interval, tick)
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case a := <-server.NotifyCh:
+			dispatcher.Dispatch(ctx, a)
+		case <-ticker.C:
+			for _, a := range dispatcher.Pending() {
+				dispatcher.Dispatch(ctx, a)
+			}
+			if dispatcher.RepeatInterval() > 0 {
+				for _, a := range server.Alerts.Active() {
+					dispatcher.Dispatch(ctx, a)
+				}
+			}
+		}
+	}
+}
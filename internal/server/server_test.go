@@ -3,16 +3,36 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"metralert/internal/alert"
+	"metralert/internal/hybrid"
 	"metralert/internal/metrics"
+	"metralert/internal/notify"
+	pb "metralert/internal/proto"
+	"metralert/internal/sign"
 	"metralert/internal/storage"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestServer_UpdateMetricJSONHandler(t *testing.T) {
@@ -50,7 +70,7 @@ func TestServer_UpdateMetricJSONHandler(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			logger, _ := zap.NewDevelopment()
 			sugar := logger.Sugar()
-			storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", logger.Sugar())
+			storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, logger.Sugar())
 			server := New(tt.args.url, storage, "", sugar, "")
 			tt.args.requestBody.Delta = (*int64)(&tt.args.metricDelta)
 			jsonBody, err := json.Marshal(tt.args.requestBody)
@@ -71,10 +91,65 @@ func TestServer_UpdateMetricJSONHandler(t *testing.T) {
 	}
 }
 
+func TestServer_UpdateMetricJSONHandler_PooledMetric(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, "")
+
+	post := func(body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		server.UpdateMetricJSONHandler(w, r)
+		return w.Code
+	}
+
+	// метрика из пула не должна сохранять значения предыдущего запроса
+	h := metrics.NewHistogram([]float64{10})
+	h.Observe(1)
+	body, err := json.Marshal(metrics.Metrics{ID: "Latency", MType: "histogram", Histogram: h})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, post(string(body)))
+	assert.Equal(t, http.StatusBadRequest, post(`{"id":"Other","type":"histogram"}`))
+
+	set := metrics.NewHyperLogLog(metrics.DefaultPrecision)
+	set.Add("alice")
+	body, err = json.Marshal(metrics.Metrics{ID: "Users", MType: "set", Set: set})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, post(string(body)))
+	assert.Equal(t, http.StatusBadRequest, post(`{"id":"OtherUsers","type":"set"}`))
+
+	require.Equal(t, http.StatusOK, post(`{"id":"First","type":"gauge","value":5}`))
+	require.Equal(t, http.StatusOK, post(`{"id":"Second","type":"gauge","value":7}`))
+	assert.Equal(t, http.StatusBadRequest, post(`{"id":"Third","type":"gauge"}`))
+
+	r := httptest.NewRequest(http.MethodGet, "/value/gauge/First", nil)
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	assert.Equal(t, "5", w.Body.String(), "stored gauge does not share the pooled value")
+
+	// элементы пакета декодируются поверх элементов предыдущего пакета
+	body, err = json.Marshal([]metrics.Metrics{{ID: "Latency", MType: "histogram", Histogram: h}})
+	require.NoError(t, err)
+	r = httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	server.UpdateBatchMetricsJSONHandler(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(`[{"id":"BatchOther","type":"histogram"}]`))
+	w = httptest.NewRecorder()
+	server.UpdateBatchMetricsJSONHandler(w, r)
+
+	r = httptest.NewRequest(http.MethodGet, "/value/histogram/BatchOther", nil)
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
 func ExampleServer_UpdateMetricJSONHandler() {
 	logger, _ := zap.NewDevelopment()
 	sugar := logger.Sugar()
-	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", logger.Sugar())
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, logger.Sugar())
 	server := New("http://localhost:8080", storage, "", sugar, "")
 	jsonBody, err := json.Marshal(metrics.Metrics{
 		ID:    "NewCounter",
@@ -93,7 +168,7 @@ func ExampleServer_ReadMetricJSONHandler() {
 
 	logger, _ := zap.NewDevelopment()
 	sugar := logger.Sugar()
-	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", logger.Sugar())
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, logger.Sugar())
 	server := New("http://localhost:8080", storage, "", sugar, "")
 	metricsNewCounter := metrics.Metrics{
 		ID:    "NewCounter",
@@ -126,3 +201,864 @@ func ExampleServer_ReadMetricJSONHandler() {
 	// Response Code is 200
 	// Response Body is {"id":"NewCounter","type":"counter","delta":123}
 }
+
+func TestServer_GetAlertsHandler(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, "")
+
+	var err error
+	server.Alerts, err = alert.NewEngine([]alert.Rule{{
+		Name:      "HighHeapAlloc",
+		Metric:    "HeapAlloc",
+		MType:     "gauge",
+		Op:        ">",
+		Threshold: 100,
+	}})
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/update/gauge/HeapAlloc/500", nil)
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	r = httptest.NewRequest(http.MethodGet, "/alerts", nil)
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+
+	var active []alert.Alert
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &active))
+	if assert.Len(t, active, 1) {
+		assert.Equal(t, "HighHeapAlloc", active[0].Rule)
+		assert.Equal(t, alert.StateFiring, active[0].State)
+	}
+}
+
+// recordingSink запоминает доставленные уведомления.
+type recordingSink struct {
+	mutex    sync.Mutex
+	received []notify.Notification
+}
+
+func (s *recordingSink) Name() string {
+	return "recording"
+}
+
+func (s *recordingSink) Send(_ context.Context, n notify.Notification) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.received = append(s.received, n)
+	return nil
+}
+
+func (s *recordingSink) states() []alert.State {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make([]alert.State, 0, len(s.received))
+	for _, n := range s.received {
+		result = append(result, n.State)
+	}
+	return result
+}
+
+func TestServer_AlertNotifier_Repeat(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, "")
+
+	var err error
+	server.Alerts, err = alert.NewEngine([]alert.Rule{{
+		Name:      "HighHeapAlloc",
+		Metric:    "HeapAlloc",
+		MType:     "gauge",
+		Op:        ">",
+		Threshold: 100,
+	}})
+	require.NoError(t, err)
+
+	sink := &recordingSink{}
+	dispatcher := notify.NewDispatcher([]notify.Sink{sink}, 0, 20*time.Millisecond, sugar)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.AlertNotifier(ctx, dispatcher)
+
+	update := func(value string) {
+		r := httptest.NewRequest(http.MethodPost, "/update/gauge/HeapAlloc/"+value, nil)
+		w := httptest.NewRecorder()
+		server.Router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// правило срабатывает один раз, повторные уведомления отправляет таймер
+	update("500")
+	assert.Eventually(t, func() bool {
+		return len(sink.states()) >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	update("50")
+	assert.Eventually(t, func() bool {
+		states := sink.states()
+		return states[len(states)-1] == alert.StateResolved
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// после разрешения повторы прекращаются
+	count := len(sink.states())
+	time.Sleep(100 * time.Millisecond)
+	states := sink.states()
+	assert.Len(t, states, count)
+	for _, state := range states[:count-1] {
+		assert.Equal(t, alert.StateFiring, state)
+	}
+}
+
+func TestServer_QueryHandler(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, "")
+
+	for _, v := range []string{"10", "20", "30"} {
+		r := httptest.NewRequest(http.MethodPost, "/update/gauge/HeapAlloc/"+v, nil)
+		w := httptest.NewRecorder()
+		server.Router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		value float64
+	}{
+		{"avg", "/query?id=HeapAlloc&type=gauge&step=1h", http.StatusOK, 20},
+		{"max", "/query?id=HeapAlloc&type=gauge&step=3600&func=max", http.StatusOK, 30},
+		{"rate on gauge", "/query?id=HeapAlloc&type=gauge&func=rate", http.StatusBadRequest, 0},
+		{"bad step", "/query?id=HeapAlloc&type=gauge&step=abc", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.query, nil)
+			w := httptest.NewRecorder()
+			server.Router.ServeHTTP(w, r)
+			assert.Equal(t, tt.code, w.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var resp queryResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			if assert.NotEmpty(t, resp.Points) {
+				assert.Equal(t, tt.value, resp.Points[len(resp.Points)-1].Value)
+			}
+		})
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	heap := 1.5
+	polls := int64(42)
+	all := map[string]metrics.Metrics{
+		"HeapAlloc":  {ID: "HeapAlloc", MType: "gauge", Value: &heap},
+		"PollCount":  {ID: "PollCount", MType: "counter", Delta: &polls},
+		"cpu.user-1": {ID: "cpu.user-1", MType: "gauge", Value: &heap},
+	}
+
+	var buf bytes.Buffer
+	skipped, err := WritePrometheus(&buf, all, map[string]string{"env": "te\"st"})
+	assert.NoError(t, err)
+	assert.Empty(t, skipped)
+
+	expected := `# HELP HeapAlloc Metric HeapAlloc of type gauge reported by metralert agents.
+# TYPE HeapAlloc gauge
+HeapAlloc{env="te\"st"} 1.5
+# HELP PollCount Metric PollCount of type counter reported by metralert agents.
+# TYPE PollCount counter
+PollCount{env="te\"st"} 42
+# HELP cpu_user_1 Metric cpu.user-1 of type gauge reported by metralert agents.
+# TYPE cpu_user_1 gauge
+cpu_user_1{env="te\"st"} 1.5
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestWritePrometheus_NameClash(t *testing.T) {
+	one, two := 1.0, 2.0
+	polls := int64(3)
+	all := map[string]metrics.Metrics{
+		"cpu.user":            {ID: "cpu.user", MType: "gauge", Value: &one},
+		"cpu_user":            {ID: "cpu_user", MType: "gauge", Value: &two},
+		"cpu-user":            {ID: "cpu-user", MType: "counter", Delta: &polls},
+		"cpu.user{host=a}":    {ID: "cpu.user", MType: "gauge", Value: &one, Labels: map[string]string{"host": "a"}},
+		"cpu-user{host=a}":    {ID: "cpu-user", MType: "gauge", Value: &two, Labels: map[string]string{"host": "a"}},
+		"PollCount{host=a.b}": {ID: "PollCount", MType: "counter", Delta: &polls, Labels: map[string]string{"host": "a.b"}},
+	}
+
+	var buf bytes.Buffer
+	skipped, err := WritePrometheus(&buf, all, nil)
+	require.NoError(t, err)
+	// остается метрика с допустимым именем, при равенстве - первая по ключу
+	assert.ElementsMatch(t, []string{"cpu.user", "cpu-user", "cpu.user{host=a}"}, skipped)
+
+	expected := `# HELP PollCount Metric PollCount of type counter reported by metralert agents.
+# TYPE PollCount counter
+PollCount{host="a.b"} 3
+# HELP cpu_user Metric cpu_user of type gauge reported by metralert agents.
+# TYPE cpu_user gauge
+cpu_user 2
+cpu_user{host="a"} 2
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestWritePrometheus_LabelClash(t *testing.T) {
+	one := 1.0
+	h := metrics.NewHistogram([]float64{1})
+	h.Observe(0.5)
+	all := map[string]metrics.Metrics{
+		"Alloc{host.name=a,host_name=b}": {ID: "Alloc", MType: "gauge", Value: &one, Labels: map[string]string{"host.name": "a", "host_name": "b"}},
+		"Alloc{dc.id=b}":                 {ID: "Alloc", MType: "gauge", Value: &one, Labels: map[string]string{"dc.id": "b"}},
+		"Alloc{le=a}":                    {ID: "Alloc", MType: "gauge", Value: &one, Labels: map[string]string{"le": "a"}},
+		"Latency{le=a}":                  {ID: "Latency", MType: "histogram", Histogram: h, Labels: map[string]string{"le": "a"}},
+		"Size{l.e=a}":                    {ID: "Size", MType: "histogram", Histogram: h, Labels: map[string]string{"l.e": "a"}},
+	}
+
+	var buf bytes.Buffer
+	skipped, err := WritePrometheus(&buf, all, map[string]string{"dc_id": "msk"})
+	require.NoError(t, err)
+	// le допустима у gauge, но зарезервирована у гистограмм; постоянные метки тоже проверяются
+	assert.ElementsMatch(t, []string{"Alloc{host.name=a,host_name=b}", "Alloc{dc.id=b}", "Latency{le=a}"}, skipped)
+
+	expected := `# HELP Alloc Metric Alloc of type gauge reported by metralert agents.
+# TYPE Alloc gauge
+Alloc{dc_id="msk",le="a"} 1
+# HELP Size Metric Size of type histogram reported by metralert agents.
+# TYPE Size histogram
+Size_bucket{dc_id="msk",l_e="a",le="1"} 1
+Size_bucket{dc_id="msk",l_e="a",le="+Inf"} 1
+Size_sum{dc_id="msk",l_e="a"} 0.5
+Size_count{dc_id="msk",l_e="a"} 1
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestWritePrometheus_Histogram(t *testing.T) {
+	h := metrics.NewHistogram([]float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.5, 0.7, 3} {
+		h.Observe(v)
+	}
+	all := map[string]metrics.Metrics{
+		"Latency{route=/a}": {ID: "Latency", MType: "histogram", Histogram: h, Labels: map[string]string{"route": "/a"}},
+	}
+
+	var buf bytes.Buffer
+	_, err := WritePrometheus(&buf, all, nil)
+	require.NoError(t, err)
+
+	expected := `# HELP Latency Metric Latency of type histogram reported by metralert agents.
+# TYPE Latency histogram
+Latency_bucket{le="0.1",route="/a"} 1
+Latency_bucket{le="1",route="/a"} 3
+Latency_bucket{le="+Inf",route="/a"} 4
+Latency_sum{route="/a"} 4.25
+Latency_count{route="/a"} 4
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestServer_Histogram(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, "")
+
+	for _, v := range []string{"5", "15", "15", "35"} {
+		r := httptest.NewRequest(http.MethodPost, "/update/histogram/Latency/"+v+"?buckets=10,20,40", nil)
+		w := httptest.NewRecorder()
+		server.Router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// пакет с той же границей бакетов прибавляется к сохраненной гистограмме
+	h := metrics.NewHistogram([]float64{10, 20, 40})
+	h.Observe(1)
+	body, err := json.Marshal([]metrics.Metrics{{ID: "Latency", MType: "histogram", Histogram: h}})
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	r = httptest.NewRequest(http.MethodGet, "/value/histogram/Latency", nil)
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "count=5 sum=71 p50=12.5 p95=35 p99=39", w.Body.String())
+
+	r = httptest.NewRequest(http.MethodGet, "/value/histogram/Latency?quantile=0.5", nil)
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	assert.Equal(t, "12.5", w.Body.String())
+
+	r = httptest.NewRequest(http.MethodPost, "/value/", bytes.NewReader([]byte(`{"id":"Latency","type":"histogram"}`)))
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	var metric metrics.Metrics
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metric))
+	require.NotNil(t, metric.Histogram)
+	assert.Equal(t, uint64(5), metric.Histogram.Count)
+	assert.Equal(t, 12.5, metric.Histogram.Quantiles["p50"])
+	assert.Contains(t, metric.Histogram.Quantiles, "p99")
+
+	// гистограмма с другими бакетами отклоняется
+	rebucketed := metrics.NewHistogram([]float64{1, 2})
+	rebucketed.Observe(1)
+	body, err = json.Marshal([]metrics.Metrics{{ID: "Latency", MType: "histogram", Histogram: rebucketed}})
+	require.NoError(t, err)
+	r = httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "bucket bounds differ")
+
+	for _, url := range []string{
+		"/update/histogram/Latency/abc",
+		"/update/histogram/Latency/1?buckets=2,1",
+		"/update/histogram/Latency/1?buckets=1,2",
+	} {
+		r = httptest.NewRequest(http.MethodPost, url, nil)
+		w = httptest.NewRecorder()
+		server.Router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+	}
+}
+
+func TestServer_AuditQueueFull(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, "")
+
+	// без аудита очередь никто не читает, обновления не должны блокироваться
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range cap(server.AuditCh) + 10 {
+			r := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(`[{"id":"PollCount","type":"counter","delta":1}]`))
+			w := httptest.NewRecorder()
+			server.Router.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch update blocked on the audit queue")
+	}
+}
+
+func TestServer_Set(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, "")
+
+	for _, user := range []string{"alice", "bob", "alice"} {
+		r := httptest.NewRequest(http.MethodPost, "/update/set/Users/"+user, nil)
+		w := httptest.NewRecorder()
+		server.Router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// набросок агента объединяется с сохраненным
+	set := metrics.NewHyperLogLog(metrics.DefaultPrecision)
+	set.Add("bob")
+	set.Add("carol")
+	body, err := json.Marshal([]metrics.Metrics{{ID: "Users", MType: "set", Set: set}})
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	r = httptest.NewRequest(http.MethodGet, "/value/set/Users", nil)
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3", w.Body.String())
+
+	r = httptest.NewRequest(http.MethodPost, "/value/", bytes.NewReader([]byte(`{"id":"Users","type":"set"}`)))
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	var metric metrics.Metrics
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metric))
+	require.NotNil(t, metric.Set)
+	require.NotNil(t, metric.Set.Cardinality)
+	assert.Equal(t, uint64(3), *metric.Set.Cardinality)
+
+	all, err := storage.GetMetrics(context.Background())
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = WritePrometheus(&buf, all, nil)
+	require.NoError(t, err)
+	assert.Equal(t, `# HELP Users Metric Users of type set reported by metralert agents.
+# TYPE Users gauge
+Users 3
+`, buf.String())
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	tests := map[string]string{
+		"HeapAlloc":   "HeapAlloc",
+		"1stMetric":   "_1stMetric",
+		"disk./home":  "disk__home",
+		"ns:metric_1": "ns:metric_1",
+		"":            "_",
+	}
+	for in, want := range tests {
+		assert.Equal(t, want, SanitizeMetricName(in))
+	}
+}
+
+func TestServer_GetAgentsHandler(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, "")
+
+	now := time.Unix(1000, 0)
+	server.Agents.now = func() time.Time { return now }
+
+	r := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(`[{"id":"A","type":"gauge","value":1},{"id":"B","type":"counter","delta":2}]`))
+	r.Header.Set(AgentIDHeader, "agent-1")
+	r.Header.Set(AgentVersionHeader, "v1.0.0")
+	r.Header.Set(AgentReportIntervalHeader, "10")
+	w := httptest.NewRecorder()
+	go func() { <-server.AuditCh }()
+	server.Router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	list := func() []AgentInfo {
+		r := httptest.NewRequest(http.MethodGet, "/agents", nil)
+		w := httptest.NewRecorder()
+		server.Router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var agents []AgentInfo
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &agents))
+		return agents
+	}
+
+	agents := list()
+	if assert.Len(t, agents, 1) {
+		assert.Equal(t, "agent-1", agents[0].ID)
+		assert.Equal(t, "v1.0.0", agents[0].Version)
+		assert.Equal(t, 2, agents[0].MetricCount)
+		assert.False(t, agents[0].Stale)
+	}
+
+	now = now.Add(31 * time.Second)
+	agents = list()
+	if assert.Len(t, agents, 1) {
+		assert.True(t, agents[0].Stale)
+	}
+}
+
+func TestServer_GRPC(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "secret", sugar, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-server.AuditCh:
+			}
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := server.NewGRPCServer()
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewMetricsClient(conn)
+
+	value := 1.5
+	delta := int64(3)
+	md := metadata.Pairs("x-agent-id", "grpc-agent", "x-agent-version", "v2")
+	callCtx := metadata.NewOutgoingContext(ctx, md)
+
+	t.Run("unary update with valid hash", func(t *testing.T) {
+		req := &pb.UpdateRequest{Metric: &pb.Metric{Id: "G", Type: "gauge", Value: &value, Labels: map[string]string{"host": "a"}}}
+		require.NoError(t, pb.Seal(req, "secret", nil))
+
+		var header metadata.MD
+		resp, err := client.Update(callCtx, req, grpc.Header(&header))
+		require.NoError(t, err)
+		assert.Equal(t, 1.5, resp.GetMetric().GetValue())
+		assert.NotEmpty(t, header.Get(responseHashMetadata))
+	})
+
+	t.Run("unary update with invalid hash", func(t *testing.T) {
+		req := &pb.UpdateRequest{Metric: &pb.Metric{Id: "G", Type: "gauge", Value: &value}, Hash: "bad"}
+		_, err := client.Update(callCtx, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("batch update", func(t *testing.T) {
+		req := &pb.UpdateBatchRequest{Metrics: []*pb.Metric{
+			{Id: "C", Type: "counter", Delta: &delta},
+			{Id: "C", Type: "counter", Delta: &delta},
+		}}
+		require.NoError(t, pb.Seal(req, "secret", nil))
+		resp, err := client.UpdateBatch(callCtx, req)
+		require.NoError(t, err)
+		require.Len(t, resp.GetMetrics(), 2)
+		assert.Equal(t, int64(6), resp.GetMetrics()[1].GetDelta())
+	})
+
+	t.Run("batch set", func(t *testing.T) {
+		sketch := metrics.NewHyperLogLog(metrics.MinPrecision)
+		sketch.Add("a")
+		sketch.Add("b")
+		req := &pb.UpdateBatchRequest{Metrics: pb.FromMetricsSlice([]metrics.Metrics{
+			{ID: "U", MType: "set", Set: sketch},
+		})}
+		require.NoError(t, pb.Seal(req, "secret", nil))
+		_, err := client.UpdateBatch(callCtx, req)
+		require.NoError(t, err)
+
+		all, err := storage.GetMetrics(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, all["U"].Set)
+		assert.Equal(t, uint64(2), all["U"].Set.Estimate())
+	})
+
+	t.Run("batch histogram", func(t *testing.T) {
+		histogram := metrics.NewHistogram([]float64{0.1, 1})
+		histogram.Observe(0.5)
+		req := &pb.UpdateBatchRequest{Metrics: pb.FromMetricsSlice([]metrics.Metrics{
+			{ID: "H", MType: "histogram", Histogram: histogram},
+			{ID: "H", MType: "histogram", Histogram: histogram},
+		})}
+		require.NoError(t, pb.Seal(req, "secret", nil))
+		_, err := client.UpdateBatch(callCtx, req)
+		require.NoError(t, err)
+
+		all, err := storage.GetMetrics(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, all["H"].Histogram)
+		assert.Equal(t, uint64(2), all["H"].Histogram.Count)
+		assert.Equal(t, []uint64{0, 2, 0}, all["H"].Histogram.Counts)
+	})
+
+	t.Run("batch histogram with other buckets", func(t *testing.T) {
+		req := &pb.UpdateBatchRequest{Metrics: pb.FromMetricsSlice([]metrics.Metrics{
+			{ID: "H", MType: "histogram", Histogram: metrics.NewHistogram([]float64{5})},
+		})}
+		require.NoError(t, pb.Seal(req, "secret", nil))
+		_, err := client.UpdateBatch(callCtx, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		stream, err := client.StreamMetrics(callCtx)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			req := &pb.UpdateBatchRequest{Metrics: []*pb.Metric{
+				{Id: "S", Type: "counter", Delta: &delta},
+				{Id: "T", Type: "gauge", Value: &value},
+			}}
+			require.NoError(t, pb.Seal(req, "secret", nil))
+			require.NoError(t, stream.Send(req))
+		}
+		resp, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		assert.Equal(t, int64(6), resp.GetReceived())
+
+		all, err := storage.GetMetrics(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(9), *all["S"].Delta)
+	})
+
+	t.Run("stream with rejected chunk", func(t *testing.T) {
+		stream, err := client.StreamMetrics(callCtx)
+		require.NoError(t, err)
+		req := &pb.UpdateBatchRequest{Metrics: []*pb.Metric{{Id: "R", Type: "counter", Delta: &delta}}}
+		require.NoError(t, pb.Seal(req, "secret", nil))
+		require.NoError(t, stream.Send(req))
+		require.NoError(t, stream.Send(&pb.UpdateBatchRequest{Metrics: req.GetMetrics(), Hash: "bad"}))
+		_, err = stream.CloseAndRecv()
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		// принятые до ошибки пакеты не сохраняются
+		all, err := storage.GetMetrics(ctx)
+		require.NoError(t, err)
+		assert.NotContains(t, all, "R")
+	})
+
+	agents := server.Agents.List()
+	if assert.Len(t, agents, 1) {
+		assert.Equal(t, "grpc-agent", agents[0].ID)
+		assert.Equal(t, "v2", agents[0].Version)
+	}
+}
+
+func TestServer_GRPCDecrypt(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "private.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	require.NoError(t, os.WriteFile(keyPath, keyPEM, 0600))
+
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, keyPath)
+
+	value := 2.0
+	encrypt := func(data []byte) ([]byte, error) {
+		return rsa.EncryptPKCS1v15(rand.Reader, &privateKey.PublicKey, data)
+	}
+
+	plain := &pb.UpdateRequest{Metric: &pb.Metric{Id: "G", Type: "gauge", Value: &value}}
+	assert.Equal(t, codes.Unauthenticated, status.Code(server.openEnvelope(context.Background(), plain)))
+
+	sealed := &pb.UpdateRequest{Metric: &pb.Metric{Id: "G", Type: "gauge", Value: &value}}
+	require.NoError(t, pb.Seal(sealed, "", encrypt))
+	assert.Nil(t, sealed.GetMetric())
+	require.NoError(t, server.openEnvelope(context.Background(), sealed))
+	assert.Equal(t, "G", sealed.GetMetric().GetId())
+	assert.Equal(t, 2.0, sealed.GetMetric().GetValue())
+
+	hybridEncrypt := func(data []byte) ([]byte, error) {
+		return hybrid.Seal(&privateKey.PublicKey, data)
+	}
+	server.RejectLegacyEncryption = true
+
+	legacy := &pb.UpdateRequest{Metric: &pb.Metric{Id: "G", Type: "gauge", Value: &value}}
+	require.NoError(t, pb.Seal(legacy, "", encrypt))
+	assert.Equal(t, codes.Unauthenticated, status.Code(server.openEnvelope(context.Background(), legacy)))
+
+	labels := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		labels[fmt.Sprintf("label%d", i)] = "value"
+	}
+	large := &pb.UpdateRequest{Metric: &pb.Metric{Id: "G", Type: "gauge", Value: &value, Labels: labels}}
+	require.NoError(t, pb.Seal(large, "", hybridEncrypt))
+	require.NoError(t, server.openEnvelope(context.Background(), large))
+	assert.Len(t, large.GetMetric().GetLabels(), 100)
+}
+
+func TestDecrypt(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	body := bytes.Repeat([]byte(`{"id":"A","type":"gauge","value":1}`), 1000)
+	sealed, err := hybrid.Seal(&privateKey.PublicKey, body)
+	require.NoError(t, err)
+	for _, allowLegacy := range []bool{true, false} {
+		decrypted, err := Decrypt(sealed, keyPEM, allowLegacy)
+		require.NoError(t, err)
+		assert.Equal(t, body, decrypted)
+	}
+
+	legacy, err := rsa.EncryptPKCS1v15(rand.Reader, &privateKey.PublicKey, []byte("small"))
+	require.NoError(t, err)
+	decrypted, err := Decrypt(legacy, keyPEM, true)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("small"), decrypted)
+	_, err = Decrypt(legacy, keyPEM, false)
+	assert.ErrorIs(t, err, ErrLegacyEncryption)
+}
+
+func TestServer_TrustedSubnet(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, "")
+	_, server.TrustedSubnet, _ = net.ParseCIDR("192.168.1.0/24")
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		realIP string
+		want   int
+	}{
+		{name: "trusted update", method: http.MethodPost, url: "/update/gauge/A/1", realIP: "192.168.1.10", want: http.StatusOK},
+		{name: "untrusted update", method: http.MethodPost, url: "/update/gauge/A/1", realIP: "10.0.0.1", want: http.StatusForbidden},
+		{name: "missing header", method: http.MethodPost, url: "/update/gauge/A/1", want: http.StatusForbidden},
+		{name: "invalid header", method: http.MethodPost, url: "/update/gauge/A/1", realIP: "not-an-ip", want: http.StatusForbidden},
+		{name: "untrusted batch", method: http.MethodPost, url: "/updates/", realIP: "10.0.0.1", want: http.StatusForbidden},
+		{name: "reading is not restricted", method: http.MethodGet, url: "/alerts", realIP: "10.0.0.1", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.realIP != "" {
+				r.Header.Set(RealIPHeader, tt.realIP)
+			}
+			w := httptest.NewRecorder()
+			server.Router.ServeHTTP(w, r)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+
+	trusted := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-real-ip", "192.168.1.20"))
+	assert.NoError(t, server.checkTrustedPeer(trusted))
+	untrusted := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-real-ip", "10.0.0.1"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(server.checkTrustedPeer(untrusted)))
+}
+
+func TestServer_StrictHash(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "secret", sugar, "")
+	server.HashVerifier = sign.NewVerifier("secret", true, time.Minute, 100)
+
+	body := []byte(`{"id":"A","type":"gauge","value":1}`)
+	stamp, err := sign.NewStamp()
+	require.NoError(t, err)
+
+	send := func(header http.Header) int {
+		r := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body))
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		server.Router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	signed := http.Header{}
+	stamp.SetHeader(signed)
+	signed.Set(sign.HashHeader, sign.Sum("secret", stamp, body))
+
+	legacy := http.Header{}
+	legacy.Set(sign.HashHeader, sign.Sum("secret", sign.Stamp{}, body))
+
+	assert.Equal(t, http.StatusBadRequest, send(http.Header{}), "unsigned")
+	assert.Equal(t, http.StatusBadRequest, send(http.Header{sign.HashHeader: {"none"}}), "none")
+	assert.Equal(t, http.StatusBadRequest, send(legacy), "without timestamp and nonce")
+	assert.Equal(t, http.StatusOK, send(signed), "signed")
+	assert.Equal(t, http.StatusBadRequest, send(signed), "replayed")
+
+	r := httptest.NewRequest(http.MethodGet, "/alerts", nil)
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code, "reading is not restricted")
+
+	unsigned := &pb.UpdateRequest{Metric: &pb.Metric{Id: "G", Type: "gauge"}}
+	assert.Equal(t, codes.Unauthenticated, status.Code(server.openEnvelope(context.Background(), unsigned)))
+	sealed := &pb.UpdateRequest{Metric: &pb.Metric{Id: "G", Type: "gauge"}}
+	require.NoError(t, pb.Seal(sealed, "secret", nil))
+	assert.NoError(t, server.openEnvelope(context.Background(), sealed))
+	assert.Equal(t, codes.InvalidArgument, status.Code(server.openEnvelope(context.Background(), sealed)), "replayed message")
+}
+
+func writePrivateKey(t *testing.T, path string) *rsa.PrivateKey {
+	t.Helper()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	require.NoError(t, os.WriteFile(path, keyPEM, 0600))
+	return privateKey
+}
+
+func TestKeyring(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := writePrivateKey(t, filepath.Join(dir, "old.pem"))
+	newKey := writePrivateKey(t, filepath.Join(dir, "new.pem"))
+	oldID, err := hybrid.KeyID(&oldKey.PublicKey)
+	require.NoError(t, err)
+	newID, err := hybrid.KeyID(&newKey.PublicKey)
+	require.NoError(t, err)
+
+	keyring, err := LoadKeyring(dir)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{oldID, newID}, keyring.IDs())
+	assert.False(t, keyring.Changed())
+
+	body := []byte("payload")
+	sealed, err := hybrid.Seal(&oldKey.PublicKey, body)
+	require.NoError(t, err)
+
+	decrypted, err := keyring.Decrypt(sealed, oldID, false)
+	require.NoError(t, err)
+	assert.Equal(t, body, decrypted)
+
+	decrypted, err = keyring.Decrypt(sealed, "", false)
+	require.NoError(t, err, "without key id every key is tried")
+	assert.Equal(t, body, decrypted)
+
+	_, err = keyring.Decrypt(sealed, newID, false)
+	assert.Error(t, err)
+	_, err = keyring.Decrypt(sealed, "unknown", false)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	// ротация: старый ключ удаляется, новый добавляется
+	require.NoError(t, os.Remove(filepath.Join(dir, "old.pem")))
+	nextKey := writePrivateKey(t, filepath.Join(dir, "next.pem"))
+	nextID, err := hybrid.KeyID(&nextKey.PublicKey)
+	require.NoError(t, err)
+	assert.True(t, keyring.Changed())
+	require.NoError(t, keyring.Reload())
+	assert.ElementsMatch(t, []string{newID, nextID}, keyring.IDs())
+	_, err = keyring.Decrypt(sealed, oldID, false)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	// при ошибке загрузки сохраняются текущие ключи
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("broken"), 0600))
+	assert.Error(t, keyring.Reload())
+	assert.ElementsMatch(t, []string{newID, nextID}, keyring.IDs())
+}
+
+func TestServer_DecryptMiddleware(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "private.pem")
+	privateKey := writePrivateKey(t, keyPath)
+	keyID, err := hybrid.KeyID(&privateKey.PublicKey)
+	require.NoError(t, err)
+
+	logger, _ := zap.NewDevelopment()
+	sugar := logger.Sugar()
+	storage := storage.NewStorage("internal/storage/metrics_database.json", false, "", storage.PgOptions{}, sugar)
+	server := New("", storage, "", sugar, keyPath)
+
+	sealed, err := hybrid.Seal(&privateKey.PublicKey, []byte(`{"id":"A","type":"gauge","value":1}`))
+	require.NoError(t, err)
+
+	send := func(keyID string) int {
+		r := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(sealed))
+		if keyID != "" {
+			r.Header.Set(hybrid.KeyIDHeader, keyID)
+		}
+		w := httptest.NewRecorder()
+		server.Router.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, send(keyID))
+	assert.Equal(t, http.StatusOK, send(""))
+	assert.Equal(t, http.StatusUnauthorized, send("unknown"))
+
+	r := httptest.NewRequest(http.MethodGet, "/alerts", nil)
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code, "requests without a body are not decrypted")
+}
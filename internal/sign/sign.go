@@ -0,0 +1,260 @@
+// Package sign implements HMAC-SHA256 request signing with replay protection.
+//
+// A signature covers the body together with a stamp, the unix timestamp and a random nonce
+// of the request. The verifier accepts a stamp only once and only within the allowed clock skew,
+// so a captured request can not be replayed.
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HashHeader carries the HMAC SHA256 signature of the request.
+	HashHeader = "Hash"
+	// TimestampHeader carries the unix time at which the request was signed.
+	TimestampHeader = "X-Signature-Timestamp"
+	// NonceHeader carries the random nonce of the signature.
+	NonceHeader = "X-Signature-Nonce"
+
+	// DefaultMaxSkew is the default allowed difference between the stamp and the server clock.
+	DefaultMaxSkew = 5 * time.Minute
+	// DefaultNonceCacheSize is the default number of remembered nonces.
+	DefaultNonceCacheSize = 100000
+
+	nonceSize = 16
+)
+
+var (
+	// ErrMissingSignature is returned when a signature or its stamp is required but absent.
+	ErrMissingSignature = errors.New("signature is missing")
+	// ErrInvalidSignature is returned when the signature does not match the body.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrStaleTimestamp is returned when the stamp is outside the allowed clock skew.
+	ErrStaleTimestamp = errors.New("signature timestamp is outside the allowed window")
+	// ErrReplayedNonce is returned when the nonce has already been used.
+	ErrReplayedNonce = errors.New("signature nonce has already been used")
+)
+
+// Stamp is the timestamp and nonce included in the signed material.
+// A zero Stamp denotes a legacy signature of the body only.
+type Stamp struct {
+	Timestamp int64
+	Nonce     string
+}
+
+// NewStamp returns a stamp with the current time and a random nonce.
+func NewStamp() (Stamp, error) {
+	var b [nonceSize]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return Stamp{}, err
+	}
+	return Stamp{Timestamp: time.Now().Unix(), Nonce: hex.EncodeToString(b[:])}, nil
+}
+
+// IsZero reports whether the stamp is absent.
+func (s Stamp) IsZero() bool {
+	return s.Nonce == ""
+}
+
+// SetHeader writes the stamp to the request headers.
+func (s Stamp) SetHeader(h http.Header) {
+	if s.IsZero() {
+		return
+	}
+	h.Set(TimestampHeader, strconv.FormatInt(s.Timestamp, 10))
+	h.Set(NonceHeader, s.Nonce)
+}
+
+// StampFromHeader reads the stamp from the request headers.
+// Missing headers return a zero Stamp.
+func StampFromHeader(h http.Header) (Stamp, error) {
+	nonce := h.Get(NonceHeader)
+	ts := h.Get(TimestampHeader)
+	if nonce == "" && ts == "" {
+		return Stamp{}, nil
+	}
+	if nonce == "" || ts == "" {
+		return Stamp{}, ErrMissingSignature
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return Stamp{}, ErrInvalidSignature
+	}
+	return Stamp{Timestamp: timestamp, Nonce: nonce}, nil
+}
+
+// Encode packs the stamp and the signature into a single string "timestamp:nonce:sum".
+// It is used where there are no headers to carry the stamp, e.g. in gRPC messages.
+func (s Stamp) Encode(sum string) string {
+	if s.IsZero() {
+		return sum
+	}
+	return strconv.FormatInt(s.Timestamp, 10) + ":" + s.Nonce + ":" + sum
+}
+
+// Decode unpacks a string produced by Stamp.Encode.
+// A plain signature returns a zero Stamp.
+func Decode(v string) (Stamp, string) {
+	parts := strings.SplitN(v, ":", 3)
+	if len(parts) != 3 {
+		return Stamp{}, v
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || parts[1] == "" {
+		return Stamp{}, v
+	}
+	return Stamp{Timestamp: timestamp, Nonce: parts[1]}, parts[2]
+}
+
+// Sum calculates the hex encoded HMAC SHA256 of the stamp and the body.
+func Sum(key string, stamp Stamp, body []byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	if !stamp.IsZero() {
+		h.Write([]byte(strconv.FormatInt(stamp.Timestamp, 10) + "\n" + stamp.Nonce + "\n"))
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verifier checks signatures made with the shared key.
+type Verifier struct {
+	key     string
+	strict  bool
+	maxSkew time.Duration
+	nonces  *NonceCache
+	now     func() time.Time
+}
+
+// NewVerifier creates a Verifier.
+// In strict mode a configured key makes a stamped signature mandatory,
+// otherwise unsigned requests and legacy signatures of the body only are accepted.
+// Non-positive maxSkew and cacheSize are replaced with the defaults.
+func NewVerifier(key string, strict bool, maxSkew time.Duration, cacheSize int) *Verifier {
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	if cacheSize <= 0 {
+		cacheSize = DefaultNonceCacheSize
+	}
+	return &Verifier{
+		key:     key,
+		strict:  strict,
+		maxSkew: maxSkew,
+		// отметка принимается в пределах maxSkew в обе стороны, столько же нужно помнить nonce
+		nonces: NewNonceCache(cacheSize, 2*maxSkew),
+		now:    time.Now,
+	}
+}
+
+// Enabled reports whether a key is configured.
+func (v *Verifier) Enabled() bool {
+	return v != nil && v.key != ""
+}
+
+// Strict reports whether signatures are mandatory.
+func (v *Verifier) Strict() bool {
+	return v.Enabled() && v.strict
+}
+
+// Verify checks the received signature of the body.
+// An empty signature or "none" is accepted only outside of strict mode.
+// The nonce is remembered only after the signature is verified.
+func (v *Verifier) Verify(received string, stamp Stamp, body []byte) error {
+	if !v.Enabled() {
+		return nil
+	}
+	if received == "" || received == "none" {
+		if v.strict {
+			return ErrMissingSignature
+		}
+		return nil
+	}
+	if stamp.IsZero() && v.strict {
+		return ErrMissingSignature
+	}
+
+	now := v.now()
+	if !stamp.IsZero() {
+		skew := now.Sub(time.Unix(stamp.Timestamp, 0))
+		if skew > v.maxSkew || skew < -v.maxSkew {
+			return ErrStaleTimestamp
+		}
+	}
+
+	if !hmac.Equal([]byte(Sum(v.key, stamp, body)), []byte(received)) {
+		return ErrInvalidSignature
+	}
+
+	if !stamp.IsZero() && !v.nonces.Add(stamp.Nonce, now) {
+		return ErrReplayedNonce
+	}
+	return nil
+}
+
+// nonceEntry is a remembered nonce with its expiration time.
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+// NonceCache remembers recently used nonces. It holds at most size nonces:
+// when it is full the oldest nonce is forgotten even if it has not expired yet.
+type NonceCache struct {
+	mutex sync.Mutex
+	size  int
+	ttl   time.Duration
+	seen  map[string]time.Time
+	ring  []nonceEntry
+	next  int
+}
+
+// NewNonceCache creates a NonceCache for size nonces remembered for ttl.
+func NewNonceCache(size int, ttl time.Duration) *NonceCache {
+	return &NonceCache{
+		size: size,
+		ttl:  ttl,
+		seen: make(map[string]time.Time, size),
+		ring: make([]nonceEntry, 0, size),
+	}
+}
+
+// Add remembers the nonce and reports whether it has not been seen within ttl.
+func (c *NonceCache) Add(nonce string, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if expires, ok := c.seen[nonce]; ok && now.Before(expires) {
+		return false
+	}
+
+	entry := nonceEntry{nonce: nonce, expires: now.Add(c.ttl)}
+	if len(c.ring) < c.size {
+		c.ring = append(c.ring, entry)
+	} else {
+		oldest := c.ring[c.next]
+		if c.seen[oldest.nonce].Equal(oldest.expires) {
+			delete(c.seen, oldest.nonce)
+		}
+		c.ring[c.next] = entry
+		c.next = (c.next + 1) % c.size
+	}
+	c.seen[nonce] = entry.expires
+	return true
+}
+
+// Len returns the number of remembered nonces.
+func (c *NonceCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.seen)
+}
@@ -0,0 +1,106 @@
+package sign
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifier_Verify(t *testing.T) {
+	now := time.Unix(1000, 0)
+	body := []byte("body")
+	stamp := Stamp{Timestamp: now.Unix(), Nonce: "n1"}
+	signed := Sum("secret", stamp, body)
+	legacy := Sum("secret", Stamp{}, body)
+
+	tests := []struct {
+		name     string
+		strict   bool
+		received string
+		stamp    Stamp
+		want     error
+	}{
+		{name: "stamped", received: signed, stamp: stamp},
+		{name: "unsigned", received: ""},
+		{name: "none", received: "none"},
+		{name: "legacy", received: legacy},
+		{name: "invalid", received: "bad", stamp: stamp, want: ErrInvalidSignature},
+		{name: "strict stamped", strict: true, received: signed, stamp: stamp},
+		{name: "strict unsigned", strict: true, received: "", want: ErrMissingSignature},
+		{name: "strict none", strict: true, received: "none", want: ErrMissingSignature},
+		{name: "strict legacy", strict: true, received: legacy, want: ErrMissingSignature},
+		{
+			name:     "stale",
+			received: Sum("secret", Stamp{Timestamp: now.Add(-time.Hour).Unix(), Nonce: "n2"}, body),
+			stamp:    Stamp{Timestamp: now.Add(-time.Hour).Unix(), Nonce: "n2"},
+			want:     ErrStaleTimestamp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifier("secret", tt.strict, time.Minute, 10)
+			v.now = func() time.Time { return now }
+			assert.ErrorIs(t, v.Verify(tt.received, tt.stamp, body), tt.want)
+		})
+	}
+}
+
+func TestVerifier_Replay(t *testing.T) {
+	v := NewVerifier("secret", true, time.Minute, 10)
+	stamp, err := NewStamp()
+	require.NoError(t, err)
+	body := []byte("body")
+
+	require.NoError(t, v.Verify(Sum("secret", stamp, body), stamp, body))
+	assert.ErrorIs(t, v.Verify(Sum("secret", stamp, body), stamp, body), ErrReplayedNonce)
+}
+
+func TestVerifier_Disabled(t *testing.T) {
+	var nilVerifier *Verifier
+	assert.False(t, nilVerifier.Enabled())
+	assert.NoError(t, nilVerifier.Verify("", Stamp{}, nil))
+
+	v := NewVerifier("", true, 0, 0)
+	assert.False(t, v.Strict())
+	assert.NoError(t, v.Verify("", Stamp{}, nil))
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := NewNonceCache(2, time.Minute)
+
+	assert.True(t, c.Add("a", now))
+	assert.False(t, c.Add("a", now))
+	assert.True(t, c.Add("a", now.Add(2*time.Minute)), "expired nonce is accepted again")
+
+	// кэш ограничен: добавление новых nonce вытесняет самые старые
+	assert.True(t, c.Add("b", now.Add(2*time.Minute)))
+	assert.True(t, c.Add("c", now.Add(2*time.Minute)))
+	assert.Equal(t, 2, c.Len())
+	assert.False(t, c.Add("c", now.Add(2*time.Minute)))
+}
+
+func TestStampEncoding(t *testing.T) {
+	stamp := Stamp{Timestamp: 42, Nonce: "abc"}
+
+	decoded, sum := Decode(stamp.Encode("hash"))
+	assert.Equal(t, stamp, decoded)
+	assert.Equal(t, "hash", sum)
+
+	decoded, sum = Decode("hash")
+	assert.True(t, decoded.IsZero())
+	assert.Equal(t, "hash", sum)
+
+	h := http.Header{}
+	stamp.SetHeader(h)
+	fromHeader, err := StampFromHeader(h)
+	require.NoError(t, err)
+	assert.Equal(t, stamp, fromHeader)
+
+	h.Del(NonceHeader)
+	_, err = StampFromHeader(h)
+	assert.ErrorIs(t, err, ErrMissingSignature)
+}
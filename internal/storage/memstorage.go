@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"maps"
 	"metralert/internal/metrics"
 	"os"
+	"slices"
+	"sync"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -14,14 +16,18 @@ import (
 )
 
 const (
-	GaugeStr   string = "gauge"
-	CounterStr string = "counter"
+	GaugeStr     string = "gauge"
+	CounterStr   string = "counter"
+	HistogramStr string = "histogram"
+	SetStr       string = "set"
 )
 
 type MemStorage struct {
 	db              map[string]metrics.Metrics
 	fileStoragePath string
 	logger          *zap.SugaredLogger
+	historyMutex    sync.RWMutex
+	history         map[string][]metrics.Sample
 }
 
 func NewMemstorage(fileStoragePath string, recover bool, logger *zap.SugaredLogger) *MemStorage {
@@ -29,6 +35,7 @@ func NewMemstorage(fileStoragePath string, recover bool, logger *zap.SugaredLogg
 		db:              make(map[string]metrics.Metrics),
 		fileStoragePath: fileStoragePath,
 		logger:          logger,
+		history:         make(map[string][]metrics.Sample),
 	}
 
 	if recover {
@@ -50,6 +57,7 @@ func NewMemstorage(fileStoragePath string, recover bool, logger *zap.SugaredLogg
 				db:              make(map[string]metrics.Metrics),
 				fileStoragePath: fileStoragePath,
 				logger:          logger,
+				history:         make(map[string][]metrics.Sample),
 			}
 		}
 		logger.Infow("Recovered sussessfully")
@@ -59,18 +67,45 @@ func NewMemstorage(fileStoragePath string, recover bool, logger *zap.SugaredLogg
 }
 
 func (m *MemStorage) ValidateMetric(metric metrics.Metrics) error {
-	var err error
-	switch metric.MType {
-	case GaugeStr:
-		if metric.Value == nil {
-			return errors.New("invalid Value")
+	return validateMetric(metric)
+}
+
+// mergeHistogram прибавляет гистограмму metric к сохраненной.
+// Если границы бакетов отличаются от сохраненных, возвращает ErrIncompatible.
+func (m *MemStorage) mergeHistogram(key string, metric metrics.Metrics) (metrics.Metrics, error) {
+	histogram := metric.Histogram.Clone()
+	if stored, ok := m.db[key]; ok && stored.Histogram != nil {
+		merged := stored.Histogram.Clone()
+		if !merged.Merge(histogram) {
+			return metrics.Metrics{}, histogramMismatch(metric.ID)
 		}
-	case CounterStr:
-		if metric.Delta == nil {
-			return errors.New("invalid Delta")
+		histogram = merged
+	}
+	return metrics.Metrics{
+		ID:        metric.ID,
+		MType:     metric.MType,
+		Histogram: histogram,
+		Labels:    maps.Clone(metric.Labels),
+	}, nil
+}
+
+// mergeSet объединяет набросок множества metric с сохраненным.
+// Если точность отличается от сохраненной, возвращает ErrIncompatible.
+func (m *MemStorage) mergeSet(key string, metric metrics.Metrics) (metrics.Metrics, error) {
+	set := metric.Set.Clone()
+	if stored, ok := m.db[key]; ok && stored.Set != nil {
+		merged := stored.Set.Clone()
+		if !merged.Merge(set) {
+			return metrics.Metrics{}, setMismatch(metric.ID)
 		}
+		set = merged
 	}
-	return err
+	return metrics.Metrics{
+		ID:     metric.ID,
+		MType:  metric.MType,
+		Set:    set,
+		Labels: maps.Clone(metric.Labels),
+	}, nil
 }
 
 func (m *MemStorage) UpdateMetric(_ context.Context, metric metrics.Metrics) (*metrics.Metrics, error) {
@@ -80,63 +115,111 @@ func (m *MemStorage) UpdateMetric(_ context.Context, metric metrics.Metrics) (*m
 	}
 
 	// case in-memory
+	key := metric.Key()
 	switch metric.MType {
 	case "gauge":
-		m.db[metric.ID] = metrics.Metrics{
-			ID:    metric.ID,
-			MType: metric.MType,
-			Value: metric.Value,
+		m.db[key] = metrics.Metrics{
+			ID:     metric.ID,
+			MType:  metric.MType,
+			Value:  metric.Value,
+			Labels: maps.Clone(metric.Labels),
 		}
 	case "counter":
 		var newDelta int64
-		_, ok := m.db[metric.ID]
+		_, ok := m.db[key]
 		if !ok {
 			newDelta = (int64)(*metric.Delta)
 		} else {
-			newDelta = *m.db[metric.ID].Delta + (int64)(*metric.Delta)
+			newDelta = *m.db[key].Delta + (int64)(*metric.Delta)
 		}
-		m.db[metric.ID] = metrics.Metrics{
-			ID:    metric.ID,
-			MType: metric.MType,
-			Delta: &newDelta,
+		m.db[key] = metrics.Metrics{
+			ID:     metric.ID,
+			MType:  metric.MType,
+			Delta:  &newDelta,
+			Labels: maps.Clone(metric.Labels),
 			// Value: &newValue,
 		}
+	case "histogram":
+		var merged metrics.Metrics
+		if merged, err = m.mergeHistogram(key, metric); err != nil {
+			return nil, err
+		}
+		m.db[key] = merged
+	case "set":
+		var merged metrics.Metrics
+		if merged, err = m.mergeSet(key, metric); err != nil {
+			return nil, err
+		}
+		m.db[key] = merged
 	default:
 		err = errors.New("invalid Mtype")
 	}
-	metricItem := m.db[metric.ID]
+	metricItem := m.db[key]
+	if err == nil {
+		m.appendSample(metricItem, time.Now())
+	}
 	return &metricItem, err
 }
 
 func (m *MemStorage) UpdateBatchMetrics(_ context.Context, metricsSlice []metrics.Metrics) ([]metrics.Metrics, error) {
 	var result []metrics.Metrics
 	var errs []error
+	now := time.Now()
 
 	// case in-memory
 	for _, metric := range metricsSlice {
+		key := metric.Key()
 		switch metric.MType {
 		case "gauge":
-			m.db[metric.ID] = metrics.Metrics{
-				ID:    metric.ID,
-				MType: metric.MType,
-				Value: metric.Value,
+			m.db[key] = metrics.Metrics{
+				ID:     metric.ID,
+				MType:  metric.MType,
+				Value:  metric.Value,
+				Labels: maps.Clone(metric.Labels),
 			}
-			result = append(result, m.db[metric.ID])
+			result = append(result, m.db[key])
+			m.appendSample(m.db[key], now)
 		case "counter":
 			var newDelta int64
-			_, ok := m.db[metric.ID]
+			_, ok := m.db[key]
 			if !ok {
 				newDelta = (int64)(*metric.Delta)
 			} else {
-				newDelta = *m.db[metric.ID].Delta + (int64)(*metric.Delta)
+				newDelta = *m.db[key].Delta + (int64)(*metric.Delta)
 			}
-			m.db[metric.ID] = metrics.Metrics{
-				ID:    metric.ID,
-				MType: metric.MType,
-				Delta: &newDelta,
+			m.db[key] = metrics.Metrics{
+				ID:     metric.ID,
+				MType:  metric.MType,
+				Delta:  &newDelta,
+				Labels: maps.Clone(metric.Labels),
 				// Value: &newValue,
 			}
-			result = append(result, m.db[metric.ID])
+			result = append(result, m.db[key])
+			m.appendSample(m.db[key], now)
+		case "histogram":
+			if err := m.ValidateMetric(metric); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			merged, err := m.mergeHistogram(key, metric)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			m.db[key] = merged
+			result = append(result, merged)
+		case "set":
+			if err := m.ValidateMetric(metric); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			merged, err := m.mergeSet(key, metric)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			m.db[key] = merged
+			result = append(result, merged)
 		default:
 			err := errors.New("invalid Mtype")
 			errs = append(errs, err)
@@ -147,24 +230,125 @@ func (m *MemStorage) UpdateBatchMetrics(_ context.Context, metricsSlice []metric
 
 func (m *MemStorage) GetMetricByName(_ context.Context, metric metrics.Metrics) (*metrics.Metrics, bool) {
 	// case in-memory
-	result, ok := m.db[metric.ID]
+	result, ok := m.db[metric.Key()]
 	return &result, ok
 }
 
-func (m *MemStorage) GetMetrics(_ context.Context) (map[string]any, error) {
+func (m *MemStorage) GetMetrics(_ context.Context) (map[string]metrics.Metrics, error) {
 	// case in-memory
-	result := make(map[string]any)
-	for id, metric := range m.db {
+	result := make(map[string]metrics.Metrics)
+	for key, metric := range m.db {
 		switch metric.MType {
 		case "gauge":
-			result[id] = fmt.Sprintf("%f", *metric.Value)
+			if metric.Value == nil {
+				continue
+			}
+			result[key] = metric
 		case "counter":
-			result[id] = fmt.Sprintf("%d", *metric.Delta)
+			if metric.Delta == nil {
+				continue
+			}
+			result[key] = metric
+		case "histogram":
+			if metric.Histogram == nil {
+				continue
+			}
+			result[key] = metric
+		case "set":
+			if metric.Set == nil {
+				continue
+			}
+			result[key] = metric
 		}
 	}
 	return result, nil
 }
 
+// appendSample добавляет текущее значение метрики в историю.
+// История хранится только для gauge и counter.
+func (m *MemStorage) appendSample(metric metrics.Metrics, ts time.Time) {
+	if metric.MType != GaugeStr && metric.MType != CounterStr {
+		return
+	}
+	sample := metrics.Sample{
+		TS:     ts,
+		ID:     metric.ID,
+		MType:  metric.MType,
+		Labels: metric.Labels,
+	}
+	// копируем значения, чтобы история не зависела от переиспользуемых указателей
+	if metric.Delta != nil {
+		delta := *metric.Delta
+		sample.Delta = &delta
+	}
+	if metric.Value != nil {
+		value := *metric.Value
+		sample.Value = &value
+	}
+
+	m.historyMutex.Lock()
+	defer m.historyMutex.Unlock()
+	key := metric.Key()
+	m.history[key] = append(m.history[key], sample)
+}
+
+func (m *MemStorage) GetHistory(_ context.Context, metric metrics.Metrics, from time.Time, to time.Time) ([]metrics.Sample, error) {
+	m.historyMutex.RLock()
+	defer m.historyMutex.RUnlock()
+
+	result := make([]metrics.Sample, 0)
+	var (
+		prev    metrics.Sample
+		hasPrev bool
+	)
+	for _, sample := range m.history[metric.Key()] {
+		if sample.MType != metric.MType {
+			continue
+		}
+		if sample.TS.Before(from) {
+			prev, hasPrev = sample, true
+			continue
+		}
+		if sample.TS.After(to) {
+			continue
+		}
+		result = append(result, sample)
+	}
+	if hasPrev {
+		result = slices.Insert(result, 0, prev)
+	}
+	return result, nil
+}
+
+func (m *MemStorage) Compact(_ context.Context, before time.Time) (int64, error) {
+	var removed int64
+
+	m.historyMutex.Lock()
+	defer m.historyMutex.Unlock()
+
+	for key, samples := range m.history {
+		// сэмплы добавляются в хронологическом порядке
+		i := 0
+		for i < len(samples) && samples[i].TS.Before(before) {
+			i++
+		}
+		if i == 0 {
+			continue
+		}
+		removed += int64(i)
+		if i == len(samples) {
+			delete(m.history, key)
+			continue
+		}
+		m.history[key] = append([]metrics.Sample(nil), samples[i:]...)
+	}
+	return removed, nil
+}
+
+func (m *MemStorage) CompactionService(retention int, compactInterval int) error {
+	return compactionLoop(m, retention, compactInterval, m.logger)
+}
+
 func (m *MemStorage) SaveDatabase() error {
 	file, err := os.Create(m.fileStoragePath)
 	if err != nil {
@@ -1,9 +1,14 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"metralert/internal/metrics"
+	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
@@ -42,3 +47,171 @@ func ExampleMemStorage_ValidateMetric_second() {
 	// <nil>
 
 }
+
+func TestMemStorage_HistoryAndCompact(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	storage := NewMemstorage("internal/storage/metrics_database.json", false, logger.Sugar())
+	ctx := context.Background()
+
+	for _, v := range []float64{1, 2, 3} {
+		value := v
+		_, err := storage.UpdateMetric(ctx, metrics.Metrics{ID: "HeapAlloc", MType: "gauge", Value: &value})
+		require.NoError(t, err)
+	}
+
+	query := metrics.Metrics{ID: "HeapAlloc", MType: "gauge"}
+	history, err := storage.GetHistory(ctx, query, time.Now().Add(-time.Minute), time.Now())
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.Equal(t, 1.0, *history[0].Value)
+	assert.Equal(t, 3.0, *history[2].Value)
+
+	removed, err := storage.Compact(ctx, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), removed)
+
+	history, err = storage.GetHistory(ctx, query, time.Now().Add(-time.Minute), time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func TestMemStorage_HistoryPreviousSample(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	storage := NewMemstorage("internal/storage/metrics_database.json", false, logger.Sugar())
+	ctx := context.Background()
+
+	update := func() {
+		delta := int64(10)
+		_, err := storage.UpdateMetric(ctx, metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+		require.NoError(t, err)
+	}
+	update()
+	update()
+	time.Sleep(time.Millisecond)
+	from := time.Now()
+	update()
+
+	// последний сэмпл до from возвращается первым, более ранние не возвращаются
+	history, err := storage.GetHistory(ctx, metrics.Metrics{ID: "PollCount", MType: "counter"}, from, time.Now())
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, int64(20), *history[0].Delta)
+	assert.True(t, history[0].TS.Before(from))
+	assert.Equal(t, int64(30), *history[1].Delta)
+}
+
+func TestMemStorage_Labels(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	storage := NewMemstorage("internal/storage/metrics_database.json", false, logger.Sugar())
+	ctx := context.Background()
+
+	first, second := 1.0, 2.0
+	_, err := storage.UpdateBatchMetrics(ctx, []metrics.Metrics{
+		{ID: "HeapAlloc", MType: "gauge", Value: &first, Labels: map[string]string{"host": "a"}},
+		{ID: "HeapAlloc", MType: "gauge", Value: &second, Labels: map[string]string{"host": "b"}},
+	})
+	require.NoError(t, err)
+
+	all, err := storage.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	metric, ok := storage.GetMetricByName(ctx, metrics.Metrics{ID: "HeapAlloc", MType: "gauge", Labels: map[string]string{"host": "b"}})
+	require.True(t, ok)
+	assert.Equal(t, 2.0, *metric.Value)
+
+	_, ok = storage.GetMetricByName(ctx, metrics.Metrics{ID: "HeapAlloc", MType: "gauge"})
+	assert.False(t, ok)
+}
+
+func TestMemStorage_Histogram(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	storage := NewMemstorage("internal/storage/metrics_database.json", false, logger.Sugar())
+	ctx := context.Background()
+
+	first := metrics.NewHistogram([]float64{1, 5})
+	first.Observe(0.5)
+	_, err := storage.UpdateMetric(ctx, metrics.Metrics{ID: "Latency", MType: "histogram", Histogram: first})
+	require.NoError(t, err)
+
+	second := metrics.NewHistogram([]float64{1, 5})
+	second.Observe(3)
+	second.Observe(10)
+	result, err := storage.UpdateBatchMetrics(ctx, []metrics.Metrics{{ID: "Latency", MType: "histogram", Histogram: second}})
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Equal(t, []uint64{1, 1, 1}, result[0].Histogram.Counts)
+
+	// полученная гистограмма не должна изменяться вместе с сохраненной
+	assert.Equal(t, uint64(2), second.Count)
+
+	metric, ok := storage.GetMetricByName(ctx, metrics.Metrics{ID: "Latency", MType: "histogram"})
+	require.True(t, ok)
+	assert.Equal(t, uint64(3), metric.Histogram.Count)
+	assert.Equal(t, 13.5, metric.Histogram.Sum)
+
+	// гистограмма с другими бакетами отклоняется, сохраненная не меняется
+	rebucketed := metrics.NewHistogram([]float64{2})
+	rebucketed.Observe(1)
+	_, err = storage.UpdateMetric(ctx, metrics.Metrics{ID: "Latency", MType: "histogram", Histogram: rebucketed})
+	require.ErrorIs(t, err, ErrIncompatible)
+	result, err = storage.UpdateBatchMetrics(ctx, []metrics.Metrics{{ID: "Latency", MType: "histogram", Histogram: rebucketed}})
+	require.ErrorIs(t, err, ErrIncompatible)
+	assert.Empty(t, result)
+	metric, ok = storage.GetMetricByName(ctx, metrics.Metrics{ID: "Latency", MType: "histogram"})
+	require.True(t, ok)
+	assert.Equal(t, uint64(3), metric.Histogram.Count)
+
+	_, err = storage.UpdateMetric(ctx, metrics.Metrics{ID: "Latency", MType: "histogram"})
+	assert.Error(t, err)
+	_, err = storage.UpdateBatchMetrics(ctx, []metrics.Metrics{{ID: "Latency", MType: "histogram", Histogram: &metrics.Histogram{}}})
+	assert.Error(t, err)
+
+	all, err := storage.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, all, "Latency")
+}
+
+func TestMemStorage_Set(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	storage := NewMemstorage("internal/storage/metrics_database.json", false, logger.Sugar())
+	ctx := context.Background()
+
+	first := metrics.NewHyperLogLog(metrics.DefaultPrecision)
+	first.Add("alice")
+	first.Add("bob")
+	_, err := storage.UpdateMetric(ctx, metrics.Metrics{ID: "Users", MType: "set", Set: first})
+	require.NoError(t, err)
+
+	second := metrics.NewHyperLogLog(metrics.DefaultPrecision)
+	second.Add("bob")
+	second.Add("carol")
+	result, err := storage.UpdateBatchMetrics(ctx, []metrics.Metrics{{ID: "Users", MType: "set", Set: second}})
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Equal(t, uint64(3), result[0].Set.Estimate())
+	assert.Equal(t, uint64(2), second.Estimate(), "received sketch is not modified")
+
+	// повторная отправка того же наброска не меняет оценку
+	_, err = storage.UpdateMetric(ctx, metrics.Metrics{ID: "Users", MType: "set", Set: second})
+	require.NoError(t, err)
+	metric, ok := storage.GetMetricByName(ctx, metrics.Metrics{ID: "Users", MType: "set"})
+	require.True(t, ok)
+	assert.Equal(t, uint64(3), metric.Set.Estimate())
+
+	// набросок с другой точностью отклоняется, сохраненный не меняется
+	_, err = storage.UpdateMetric(ctx, metrics.Metrics{ID: "Users", MType: "set", Set: metrics.NewHyperLogLog(metrics.MinPrecision)})
+	require.ErrorIs(t, err, ErrIncompatible)
+	metric, ok = storage.GetMetricByName(ctx, metrics.Metrics{ID: "Users", MType: "set"})
+	require.True(t, ok)
+	assert.Equal(t, metrics.DefaultPrecision, metric.Set.Precision)
+
+	_, err = storage.UpdateMetric(ctx, metrics.Metrics{ID: "Users", MType: "set"})
+	assert.Error(t, err)
+	_, err = storage.UpdateBatchMetrics(ctx, []metrics.Metrics{{ID: "Users", MType: "set", Set: &metrics.HyperLogLog{Precision: 12}}})
+	assert.Error(t, err)
+
+	all, err := storage.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, all, "Users")
+}
@@ -0,0 +1,42 @@
+-- Исходная схема: таблица метрик с метками, гистограммами и множествами и таблица истории.
+-- Все операции идемпотентны, чтобы базы, созданные до появления миграций, переводились без ошибок.
+CREATE TABLE IF NOT EXISTS metrics (
+	"id" VARCHAR(250) NOT NULL,
+	"labels_key" TEXT NOT NULL DEFAULT '',
+	"labels" JSONB NOT NULL DEFAULT '{}',
+	"mtype" VARCHAR(250) NOT NULL DEFAULT '',
+	"delta" BIGINT,
+	"value" DOUBLE PRECISION,
+	PRIMARY KEY ("id", "labels_key")
+);
+
+-- таблицы, созданные до появления меток, переводим на ключ (id, labels_key)
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_name = 'metrics' AND column_name = 'labels_key') THEN
+		ALTER TABLE metrics
+			ADD COLUMN labels_key TEXT NOT NULL DEFAULT '',
+			ADD COLUMN labels JSONB NOT NULL DEFAULT '{}';
+		ALTER TABLE metrics DROP CONSTRAINT metrics_pkey;
+		ALTER TABLE metrics ADD PRIMARY KEY (id, labels_key);
+	END IF;
+END $$;
+
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS histogram JSONB;
+
+-- регистры HyperLogLog метрик set, точность определяется по их количеству
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS hll BYTEA;
+
+CREATE TABLE IF NOT EXISTS metrics_history (
+	"ts" TIMESTAMPTZ NOT NULL DEFAULT now(),
+	"id" VARCHAR(250) NOT NULL,
+	"labels_key" TEXT NOT NULL DEFAULT '',
+	"mtype" VARCHAR(250) NOT NULL DEFAULT '',
+	"delta" BIGINT,
+	"value" DOUBLE PRECISION
+);
+
+ALTER TABLE metrics_history ADD COLUMN IF NOT EXISTS labels_key TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS metrics_history_id_labels_ts_idx ON metrics_history (id, labels_key, ts);
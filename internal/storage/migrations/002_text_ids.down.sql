@@ -0,0 +1,7 @@
+ALTER TABLE metrics_history
+	ALTER COLUMN id TYPE VARCHAR(250),
+	ALTER COLUMN mtype TYPE VARCHAR(250);
+
+ALTER TABLE metrics
+	ALTER COLUMN id TYPE VARCHAR(250),
+	ALTER COLUMN mtype TYPE VARCHAR(250);
@@ -0,0 +1,8 @@
+-- Имена и типы метрик больше не ограничены 250 символами.
+ALTER TABLE metrics
+	ALTER COLUMN id TYPE TEXT,
+	ALTER COLUMN mtype TYPE TEXT;
+
+ALTER TABLE metrics_history
+	ALTER COLUMN id TYPE TEXT,
+	ALTER COLUMN mtype TYPE TEXT;
@@ -0,0 +1,273 @@
+// Package migrations применяет версионированные миграции схемы PostgreSQL.
+//
+// Миграции хранятся во встроенных файлах NNN_name.up.sql и NNN_name.down.sql,
+// примененные версии записываются в таблицу schema_migrations. Каждая миграция
+// выполняется в отдельной транзакции, а весь запуск - под advisory lock, чтобы
+// несколько серверов не применяли миграции одновременно.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//go:embed *.sql
+var embedded embed.FS
+
+// lockID - ключ pg_advisory_lock, под которым применяются миграции.
+const lockID int64 = 0x6d6574726d6967 // "metrmig"
+
+// Migration - одна версия схемы.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Applied - примененная миграция из таблицы schema_migrations.
+type Applied struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+var fileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load читает миграции из fsys. Каждая версия должна иметь файлы up и down,
+// версии должны идти подряд начиная с 1. Миграции возвращаются по возрастанию версий.
+func Load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		match := fileRe.FindStringSubmatch(path.Base(file))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", file)
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %q", file)
+		}
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has different names %q and %q", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	result := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d %s must have up and down files", m.Version, m.Name)
+		}
+		result = append(result, *m)
+	}
+	slices.SortFunc(result, func(a, b Migration) int { return a.Version - b.Version })
+	for i, m := range result {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+	return result, nil
+}
+
+// Migrator применяет миграции к базе данных.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	logger     *zap.SugaredLogger
+}
+
+// New создает Migrator со встроенными миграциями.
+func New(db *sql.DB, logger *zap.SugaredLogger) (*Migrator, error) {
+	migrations, err := Load(embedded)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, logger: logger}, nil
+}
+
+// Latest возвращает последнюю известную версию схемы.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up применяет все непримененные миграции.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down откатывает steps последних примененных миграций.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	if steps <= 0 {
+		return errors.New("number of steps must be positive")
+	}
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		return m.migrate(ctx, conn, current, max(current-steps, 0))
+	})
+}
+
+// To переводит схему на версию target, применяя или откатывая миграции.
+// Версия 0 означает пустую схему.
+func (m *Migrator) To(ctx context.Context, target int) error {
+	if target < 0 || target > m.Latest() {
+		return fmt.Errorf("unknown schema version %d, latest is %d", target, m.Latest())
+	}
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		return m.migrate(ctx, conn, current, target)
+	})
+}
+
+// Status возвращает примененные миграции по возрастанию версий.
+func (m *Migrator) Status(ctx context.Context) ([]Applied, error) {
+	var result []Applied
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var a Applied
+			if err = rows.Scan(&a.Version, &a.Name, &a.AppliedAt); err != nil {
+				return err
+			}
+			result = append(result, a)
+		}
+		return rows.Err()
+	})
+	return result, err
+}
+
+// withLock выполняет fn на отдельном соединении под advisory lock.
+// Блокировка сессионная, поэтому все запросы fn выполняются на том же соединении.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID); err != nil {
+		return fmt.Errorf("unable to acquire migration lock: %w", err)
+	}
+	defer func() {
+		// контекст мог быть отменен, блокировку снимаем в любом случае
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID); err != nil {
+			m.logger.Warnw("Unable to release migration lock", "error", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		"version" INTEGER PRIMARY KEY,
+		"name" TEXT NOT NULL,
+		"applied_at" TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("unable to create schema_migrations: %w", err)
+	}
+	return fn(conn)
+}
+
+// currentVersion возвращает наибольшую примененную версию, 0 если миграции не применялись.
+func currentVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version int
+	err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// migrate применяет миграции от версии current до target.
+func (m *Migrator) migrate(ctx context.Context, conn *sql.Conn, current, target int) error {
+	if current > m.Latest() {
+		return fmt.Errorf("schema version %d is newer than the latest known migration %d", current, m.Latest())
+	}
+	if current == target {
+		m.logger.Infow("Database schema is up to date", "version", current)
+		return nil
+	}
+
+	for current < target {
+		next := m.migrations[current]
+		if err := m.apply(ctx, conn, next, true); err != nil {
+			return err
+		}
+		current = next.Version
+	}
+	for current > target {
+		prev := m.migrations[current-1]
+		if err := m.apply(ctx, conn, prev, false); err != nil {
+			return err
+		}
+		current = prev.Version - 1
+	}
+	return nil
+}
+
+// apply применяет (up) или откатывает миграцию в транзакции вместе с записью в schema_migrations.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	direction, script := "up", migration.Up
+	if !up {
+		direction, script = "down", migration.Down
+	}
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d %s %s failed: %w", migration.Version, migration.Name, direction, err)
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	m.logger.Infow("Migration applied", "version", migration.Version, "name", migration.Name, "direction", direction)
+	return nil
+}
@@ -0,0 +1,62 @@
+package migrations
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestLoad_Embedded(t *testing.T) {
+	migrations, err := Load(embedded)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	assert.Equal(t, 1, migrations[0].Version)
+	assert.Equal(t, "init", migrations[0].Name)
+	assert.Contains(t, migrations[0].Up, "CREATE TABLE IF NOT EXISTS metrics")
+	assert.Contains(t, migrations[0].Down, "DROP TABLE IF EXISTS metrics")
+
+	logger, _ := zap.NewDevelopment()
+	m, err := New(nil, logger.Sugar())
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), m.Latest())
+}
+
+func TestLoad(t *testing.T) {
+	file := func(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s)} }
+
+	migrations, err := Load(fstest.MapFS{
+		"002_second.up.sql":   file("up 2"),
+		"002_second.down.sql": file("down 2"),
+		"001_first.up.sql":    file("up 1"),
+		"001_first.down.sql":  file("down 1"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []Migration{
+		{Version: 1, Name: "first", Up: "up 1", Down: "down 1"},
+		{Version: 2, Name: "second", Up: "up 2", Down: "down 2"},
+	}, migrations)
+
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{"missing down", fstest.MapFS{"001_first.up.sql": file("up")}},
+		{"gap", fstest.MapFS{
+			"001_first.up.sql": file("up"), "001_first.down.sql": file("down"),
+			"003_third.up.sql": file("up"), "003_third.down.sql": file("down"),
+		}},
+		{"different names", fstest.MapFS{"001_first.up.sql": file("up"), "001_other.down.sql": file("down")}},
+		{"invalid name", fstest.MapFS{"first.sql": file("up")}},
+		{"zero version", fstest.MapFS{"000_zero.up.sql": file("up"), "000_zero.down.sql": file("down")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.fsys)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -2,204 +2,462 @@ package storage
 
 import (
 	"context"
-	"database/sql"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"maps"
+	"math/bits"
 	"metralert/internal/metrics"
+	"metralert/internal/storage/migrations"
+	"slices"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 	"go.uber.org/zap"
 )
 
+// DefaultStatementTimeout - таймаут операции с базой данных, если PgOptions.StatementTimeout не задан.
+const DefaultStatementTimeout = 3 * time.Second
+
+// PgOptions - параметры пула соединений PgStorage.
+type PgOptions struct {
+	// MaxConns - максимальное количество соединений пула, 0 - значение pgxpool по умолчанию.
+	MaxConns int32
+	// StatementTimeout - таймаут каждой операции с базой данных, 0 - DefaultStatementTimeout.
+	// По истечении таймаута pgx отменяет выполняющийся запрос.
+	StatementTimeout time.Duration
+}
+
 type PgStorage struct {
-	database *sql.DB
-	logger   *zap.SugaredLogger
+	pool             *pgxpool.Pool
+	logger           *zap.SugaredLogger
+	statementTimeout time.Duration
+	retry            RetryPolicy
 }
 
-func Retry(ctx context.Context, fn func(ctx context.Context) error) error {
-	var errs []error
-	var err error
-	for i := range 3 {
-		err = fn(ctx)
-		if err == nil {
-			return nil
-		}
+const (
+	queryUpsertGauge = `
+		WITH upserted AS (
+			INSERT INTO metrics (id, mtype, value, labels_key, labels)
+			VALUES ( $1 , 'gauge', $2, $3, $4::jsonb )
+			ON CONFLICT (id, labels_key)
+			DO UPDATE SET value = $2
+			RETURNING id, mtype, value, labels_key
+		)
+		INSERT INTO metrics_history (id, mtype, value, labels_key)
+		SELECT id, mtype, value, labels_key FROM upserted
+		RETURNING id, mtype, value
+		`
 
-		errs = append(errs, err)
-		delay := (i*2 + 1)
-		time.Sleep(time.Duration(delay) * time.Second)
+	queryUpsertCounter = `
+		WITH upserted AS (
+			INSERT INTO metrics (id, mtype, delta, labels_key, labels)
+			VALUES ( $1 , 'counter', $2, $3, $4::jsonb )
+			ON CONFLICT (id, labels_key)
+			DO UPDATE SET delta = $2 + metrics.delta
+			RETURNING id, mtype, delta, labels_key
+		)
+		INSERT INTO metrics_history (id, mtype, delta, labels_key)
+		SELECT id, mtype, delta, labels_key FROM upserted
+		RETURNING id, mtype, delta
+		`
+
+	queryUpsertHistogram = `
+		INSERT INTO metrics (id, mtype, histogram, labels_key, labels)
+		VALUES ( $1 , 'histogram', $2::jsonb, $3, $4::jsonb )
+		ON CONFLICT (id, labels_key)
+		DO UPDATE SET histogram = $2::jsonb
+		RETURNING id, mtype
+		`
+
+	queryUpsertSet = `
+		INSERT INTO metrics (id, mtype, hll, labels_key, labels)
+		VALUES ( $1 , 'set', $2, $3, $4::jsonb )
+		ON CONFLICT (id, labels_key)
+		DO UPDATE SET hll = $2
+		RETURNING id, mtype
+		`
+
+	// FOR UPDATE блокирует только существующие строки, поэтому ключи сначала блокируются
+	// advisory lock транзакции: два первых обновления одной метрики не перезапишут друг друга.
+	// Ключи блокируются по порядку, чтобы параллельные пакеты не взаимоблокировались,
+	// совпадение хешей разных ключей только лишний раз упорядочивает их обновления.
+	queryLockKeys = `
+		SELECT pg_advisory_xact_lock($3, key) FROM (
+			SELECT DISTINCT hashtext(id || ' ' || labels_key) AS key
+			FROM unnest($1::text[], $2::text[]) AS keys(id, labels_key)
+			ORDER BY key
+		) AS locks
+		`
+
+	// строки блокируются в порядке ключа, чтобы параллельные пакеты не взаимоблокировались
+	querySelectForUpdate = `
+		SELECT id, labels_key, histogram, hll FROM metrics
+		WHERE (id, labels_key) IN (SELECT * FROM unnest($1::text[], $2::text[]))
+		ORDER BY id, labels_key
+		FOR UPDATE
+		`
+)
+
+// mergeLockClass - первый ключ pg_advisory_xact_lock для блокировки метрик, второй ключ - хеш id и меток.
+// Пространство двух 32-битных ключей не пересекается с ключом миграций.
+const mergeLockClass int32 = 0x6d657267 // "merg"
+
+// labelsParams возвращает канонический ключ меток и их json-представление для запросов
+func labelsParams(labels map[string]string) (string, string, error) {
+	if len(labels) == 0 {
+		return "", "{}", nil
 	}
-	return fmt.Errorf("failed after 3 retries %s", errs)
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "", "", err
+	}
+	return metrics.CanonicalLabels(labels), string(data), nil
 }
 
-func NewPgStorage(databaseAddress string, logger *zap.SugaredLogger) *PgStorage {
+func NewPgStorage(databaseAddress string, opts PgOptions, logger *zap.SugaredLogger) *PgStorage {
 	pg := PgStorage{
-		logger: logger,
+		logger:           logger,
+		statementTimeout: opts.StatementTimeout,
+		retry:            DefaultRetryPolicy(logger),
+	}
+	if pg.statementTimeout <= 0 {
+		pg.statementTimeout = DefaultStatementTimeout
 	}
 
-	queryCreateTable := `CREATE TABLE IF NOT EXISTS metrics (
-		"id" VARCHAR(250) PRIMARY KEY,
-		"mtype" VARCHAR(250) NOT NULL DEFAULT '',
-		"delta" BIGINT,
-		"value" DOUBLE PRECISION
-	) `
+	config, err := pgxpool.ParseConfig(databaseAddress)
+	if err != nil {
+		pg.logger.Fatalw("Unable to parse database dsn", "error", err)
+	}
+	if opts.MaxConns > 0 {
+		config.MaxConns = opts.MaxConns
+	}
+	pg.pool, err = pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		pg.logger.Fatalw("Unable to open DB", "error", err)
+	}
+	pg.logger.Infow("Database connected", "max_conns", config.MaxConns)
 
-	ctx, ctxCancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// миграции могут ждать блокировку, пока их применяет другой сервер
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Minute)
 	defer ctxCancel()
 
-	database, err := sql.Open("pgx", databaseAddress)
-	if err != nil {
-		pg.logger.Fatalw("Unable to open DB")
-	}
-	pg.logger.Infow("Database connected")
-	pg.database = database
+	// соединения берутся из пула, закрытие db пул не закрывает
+	db := stdlib.OpenDBFromPool(pg.pool)
+	defer db.Close()
 
-	_, err = pg.database.ExecContext(ctx, queryCreateTable)
+	migrator, err := migrations.New(db, logger)
 	if err != nil {
-		pg.logger.Fatalw("Unable to create table", "error", err)
+		pg.logger.Fatalw("Unable to load migrations", "error", err)
+	}
+	if err = migrator.Up(ctx); err != nil {
+		pg.logger.Fatalw("Unable to migrate database", "error", err)
 	}
 	return &pg
 }
 
-func (pg *PgStorage) UpdateMetric(reqCtx context.Context, metric metrics.Metrics) (*metrics.Metrics, error) {
-	queryUpdateGauge := `
-		INSERT INTO metrics (id, mtype, value)
-    	VALUES ( $1 , 'gauge', $2 )
-		ON CONFLICT (id) 
-		DO UPDATE SET value = $2
-		RETURNING id, mtype, value
-		`
+// pgMetric - проверенная метрика пакета с параметрами меток для запросов.
+type pgMetric struct {
+	metric     metrics.Metrics
+	labelsKey  string
+	labelsJSON string
+}
 
-	queryUpdateCounter := `
-		INSERT INTO metrics (id, mtype, delta)
-    	VALUES ( $1 , 'counter', $2 )
-		ON CONFLICT (id) 
-		DO UPDATE SET delta = $2 + metrics.delta
-		RETURNING id, mtype, delta
-		`
+// pgRowKey возвращает ключ строки таблицы metrics.
+func pgRowKey(id, labelsKey string) string {
+	return id + "\x00" + labelsKey
+}
 
-	ctx, ctxCancel := context.WithTimeout(reqCtx, 3*time.Second)
-	defer ctxCancel()
+// pgStored - сохраненные гистограмма и набросок множества строки, заблокированной до конца транзакции.
+type pgStored struct {
+	histogram *metrics.Histogram
+	set       *metrics.HyperLogLog
+}
 
-	switch metric.MType {
-	case "gauge":
-		var scannedGauge metrics.Metrics
-		err := Retry(ctx, func(ctx context.Context) error {
-			return pg.database.QueryRowContext(ctx, queryUpdateGauge,
-				metric.ID, metric.Value).Scan(&scannedGauge.ID, &scannedGauge.MType, &scannedGauge.Value)
-		})
+// pgBatcher - пул соединений или транзакция.
+type pgBatcher interface {
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
 
-		return &scannedGauge, err
+// selectForUpdate блокирует до конца транзакции tx ключи гистограмм и множеств пакета
+// и читает их строки, чтобы параллельные обновления, в том числе первые, не потерялись.
+func selectForUpdate(ctx context.Context, tx pgx.Tx, ms []pgMetric) (map[string]*pgStored, error) {
+	var ids, labelsKeys []string
+	for _, m := range ms {
+		if m.metric.MType == HistogramStr || m.metric.MType == SetStr {
+			ids = append(ids, m.metric.ID)
+			labelsKeys = append(labelsKeys, m.labelsKey)
+		}
+	}
 
-	case "counter":
-		var scannedCounter metrics.Metrics
+	if _, err := tx.Exec(ctx, queryLockKeys, ids, labelsKeys, mergeLockClass); err != nil {
+		return nil, err
+	}
 
-		err := Retry(ctx, func(ctx context.Context) error {
-			return pg.database.QueryRowContext(ctx, queryUpdateCounter,
-				metric.ID, metric.Delta).Scan(&scannedCounter.ID, &scannedCounter.MType, &scannedCounter.Delta)
-		})
+	stored := make(map[string]*pgStored)
+	rows, err := tx.Query(ctx, querySelectForUpdate, ids, labelsKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		return &scannedCounter, err
-	default:
-		err := errors.New("invalid Mtype")
-		return &metrics.Metrics{}, err
+	for rows.Next() {
+		var id, labelsKey string
+		var histogram, set []byte
+		if err = rows.Scan(&id, &labelsKey, &histogram, &set); err != nil {
+			return nil, err
+		}
+		s := &pgStored{}
+		if s.histogram, err = scanHistogram(histogram); err != nil {
+			return nil, err
+		}
+		if s.set, err = scanSet(set); err != nil {
+			return nil, err
+		}
+		stored[pgRowKey(id, labelsKey)] = s
 	}
+	return stored, rows.Err()
 }
 
-func (pg *PgStorage) UpdateBatchMetrics(reqCtx context.Context, metricsSlice []metrics.Metrics) ([]metrics.Metrics, error) {
-	var result []metrics.Metrics
+// rejectIncompatible отбрасывает гистограммы и множества пакета, которые нельзя объединить
+// с сохраненными в stored или с предыдущими обновлениями той же метрики в пакете,
+// и возвращает ошибку ErrIncompatible для каждой отброшенной метрики.
+func rejectIncompatible(ms []pgMetric, stored map[string]*pgStored) ([]pgMetric, []error) {
 	var errs []error
+	// границы бакетов и точность, с которыми метрика будет сохранена
+	bounds := make(map[string][]float64)
+	precision := make(map[string]uint8)
+	for key, s := range stored {
+		if s.histogram != nil {
+			bounds[key] = s.histogram.Bounds
+		}
+		if s.set != nil {
+			precision[key] = s.set.Precision
+		}
+	}
 
-	queryUpdateGauge := `
-		INSERT INTO metrics (id, mtype, value)
-		VALUES ( $1 , 'gauge', $2 )
-		ON CONFLICT (id) 
-		DO UPDATE SET value = $2
-		RETURNING id, mtype, value
-		`
+	result := make([]pgMetric, 0, len(ms))
+	for _, m := range ms {
+		key := pgRowKey(m.metric.ID, m.labelsKey)
+		switch m.metric.MType {
+		case HistogramStr:
+			if b, ok := bounds[key]; ok && !slices.Equal(b, m.metric.Histogram.Bounds) {
+				errs = append(errs, histogramMismatch(m.metric.ID))
+				continue
+			}
+			bounds[key] = m.metric.Histogram.Bounds
+		case SetStr:
+			if p, ok := precision[key]; ok && p != m.metric.Set.Precision {
+				errs = append(errs, setMismatch(m.metric.ID))
+				continue
+			}
+			precision[key] = m.metric.Set.Precision
+		}
+		result = append(result, m)
+	}
+	return result, errs
+}
 
-	queryUpdateCounter := `
-		INSERT INTO metrics (id, mtype, delta)
-		VALUES ( $1 , 'counter', $2 )
-		ON CONFLICT (id) 
-		DO UPDATE SET delta = $2 + metrics.delta
-		RETURNING id, mtype, delta
-		`
+// sendBatch отправляет обновления метрик ms одним пакетом запросов и возвращает обновленные метрики.
+// Гистограммы и наброски множеств объединяются с stored, stored обновляется по ходу пакета,
+// чтобы несколько обновлений одной метрики в пакете накапливались.
+// Метрики, несовместимые с stored, должны быть отброшены rejectIncompatible, иначе возвращается ErrIncompatible.
+// История для гистограмм и множеств не хранится.
+func sendBatch(ctx context.Context, conn pgBatcher, ms []pgMetric, stored map[string]*pgStored) ([]metrics.Metrics, error) {
+	batch := &pgx.Batch{}
+	// результаты заполняются при закрытии пакета, слайс не должен перевыделяться
+	result := make([]metrics.Metrics, len(ms))
+
+	for i, m := range ms {
+		r := &result[i]
+		r.Labels = maps.Clone(m.metric.Labels)
+
+		switch m.metric.MType {
+		case GaugeStr:
+			batch.Queue(queryUpsertGauge, m.metric.ID, m.metric.Value, m.labelsKey, m.labelsJSON).
+				QueryRow(func(row pgx.Row) error { return row.Scan(&r.ID, &r.MType, &r.Value) })
+		case CounterStr:
+			batch.Queue(queryUpsertCounter, m.metric.ID, m.metric.Delta, m.labelsKey, m.labelsJSON).
+				QueryRow(func(row pgx.Row) error { return row.Scan(&r.ID, &r.MType, &r.Delta) })
+		case HistogramStr:
+			key := pgRowKey(m.metric.ID, m.labelsKey)
+			if stored[key] == nil {
+				stored[key] = &pgStored{}
+			}
+			histogram := m.metric.Histogram.Clone()
+			if prev := stored[key].histogram; prev != nil {
+				merged := prev.Clone()
+				if !merged.Merge(histogram) {
+					return nil, histogramMismatch(m.metric.ID)
+				}
+				histogram = merged
+			}
+			stored[key].histogram = histogram
+			r.Histogram = histogram
 
-	ctx, ctxCancel := context.WithTimeout(reqCtx, 3*time.Second)
-	defer ctxCancel()
+			data, err := json.Marshal(histogram)
+			if err != nil {
+				return nil, err
+			}
+			batch.Queue(queryUpsertHistogram, m.metric.ID, string(data), m.labelsKey, m.labelsJSON).
+				QueryRow(func(row pgx.Row) error { return row.Scan(&r.ID, &r.MType) })
+		case SetStr:
+			key := pgRowKey(m.metric.ID, m.labelsKey)
+			if stored[key] == nil {
+				stored[key] = &pgStored{}
+			}
+			set := m.metric.Set.Clone()
+			if prev := stored[key].set; prev != nil {
+				merged := prev.Clone()
+				if !merged.Merge(set) {
+					return nil, setMismatch(m.metric.ID)
+				}
+				set = merged
+			}
+			stored[key].set = set
+			r.Set = set
 
-	tx, err := pg.database.Begin()
-	if err != nil {
-		return nil, err
+			batch.Queue(queryUpsertSet, m.metric.ID, set.Registers, m.labelsKey, m.labelsJSON).
+				QueryRow(func(row pgx.Row) error { return row.Scan(&r.ID, &r.MType) })
+		}
 	}
-	defer tx.Rollback()
 
-	stmtCounter, err := tx.PrepareContext(ctx, queryUpdateCounter)
-	if err != nil {
+	if err := conn.SendBatch(ctx, batch).Close(); err != nil {
 		return nil, err
 	}
+	return result, nil
+}
 
-	stmtGauge, err := tx.PrepareContext(ctx, queryUpdateGauge)
-	if err != nil {
+// scanHistogram разбирает гистограмму, прочитанную из столбца histogram.
+func scanHistogram(data []byte) (*metrics.Histogram, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var h metrics.Histogram
+	if err := json.Unmarshal(data, &h); err != nil {
 		return nil, err
 	}
+	return &h, nil
+}
 
-	for _, metric := range metricsSlice {
-		switch metric.MType {
-		case "gauge":
-			var scannedGauge metrics.Metrics
-			err := Retry(ctx, func(ctx context.Context) error {
-				return stmtGauge.QueryRowContext(ctx,
-					metric.ID, metric.Value).Scan(&scannedGauge.ID, &scannedGauge.MType, &scannedGauge.Value)
-			})
-
-			result = append(result, scannedGauge)
-			if err != nil {
-				errs = append(errs, err)
-			}
+// scanSet восстанавливает набросок множества из регистров, прочитанных из столбца hll.
+func scanSet(data []byte) (*metrics.HyperLogLog, error) {
+	if data == nil {
+		return nil, nil
+	}
+	s := &metrics.HyperLogLog{
+		Precision: uint8(bits.Len(uint(len(data))) - 1),
+		Registers: data,
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-		case "counter":
-			var scannedCounter metrics.Metrics
-			err := Retry(ctx, func(ctx context.Context) error {
-				return stmtCounter.QueryRowContext(ctx,
-					metric.ID, metric.Delta).Scan(&scannedCounter.ID, &scannedCounter.MType, &scannedCounter.Delta)
-			})
+func (pg *PgStorage) UpdateMetric(reqCtx context.Context, metric metrics.Metrics) (*metrics.Metrics, error) {
+	result, err := pg.UpdateBatchMetrics(reqCtx, []metrics.Metrics{metric})
+	if len(result) == 0 {
+		return &metrics.Metrics{}, err
+	}
+	return &result[0], err
+}
 
-			result = append(result, scannedCounter)
-			if err != nil {
-				errs = append(errs, err)
-			}
+// UpdateBatchMetrics обновляет метрики одним пакетом запросов pgx.Batch.
+// Пакет выполняется в неявной транзакции за один обмен с сервером; если в пакете есть
+// гистограммы или множества, их строки сначала блокируются в явной транзакции.
+// Ошибочные метрики пропускаются до отправки, так как ошибка запроса отменила бы весь пакет.
+func (pg *PgStorage) UpdateBatchMetrics(reqCtx context.Context, metricsSlice []metrics.Metrics) ([]metrics.Metrics, error) {
+	var errs []error
+	valid := make([]pgMetric, 0, len(metricsSlice))
+	merging := false
 
+	for _, metric := range metricsSlice {
+		switch metric.MType {
+		case GaugeStr, CounterStr, HistogramStr, SetStr:
 		default:
-			err := errors.New("invalid Mtype")
+			errs = append(errs, errors.New("invalid Mtype"))
+			continue
+		}
+		if err := validateMetric(metric); err != nil {
 			errs = append(errs, err)
-
+			continue
+		}
+		labelsKey, labelsJSON, err := labelsParams(metric.Labels)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		valid = append(valid, pgMetric{metric: metric, labelsKey: labelsKey, labelsJSON: labelsJSON})
+		if metric.MType == HistogramStr || metric.MType == SetStr {
+			merging = true
 		}
 	}
-	err = tx.Commit()
+	if len(valid) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	ctx, ctxCancel := context.WithTimeout(reqCtx, pg.statementTimeout)
+	defer ctxCancel()
+
+	var (
+		result   []metrics.Metrics
+		rejected []error
+	)
+	err := pg.retry.Do(ctx, "update_batch", func(ctx context.Context) error {
+		var err error
+		if !merging {
+			result, err = sendBatch(ctx, pg.pool, valid, nil)
+			return err
+		}
+		return pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+			stored, err := selectForUpdate(ctx, tx, valid)
+			if err != nil {
+				return err
+			}
+			// сохраненные значения известны только под блокировкой, проверка повторяется при каждой попытке
+			var compatible []pgMetric
+			compatible, rejected = rejectIncompatible(valid, stored)
+			if len(compatible) == 0 {
+				result = nil
+				return nil
+			}
+			result, err = sendBatch(ctx, tx, compatible, stored)
+			return err
+		})
+	})
 	if err != nil {
 		errs = append(errs, err)
 		return nil, errors.Join(errs...)
 	}
+	errs = append(errs, rejected...)
 	return result, errors.Join(errs...)
 }
 
 func (pg *PgStorage) GetMetricByName(reqCtx context.Context, metric metrics.Metrics) (*metrics.Metrics, bool) {
 	queryGetMetric := `
-		SELECT id, mtype, delta, value 
-		FROM metrics WHERE id = $1
+		SELECT id, mtype, delta, value, histogram, hll
+		FROM metrics WHERE id = $1 AND labels_key = $2
 		`
 
-	ctx, ctxCancel := context.WithTimeout(reqCtx, 3*time.Second)
+	ctx, ctxCancel := context.WithTimeout(reqCtx, pg.statementTimeout)
 	defer ctxCancel()
 
 	ok := true
-	result := metrics.Metrics{}
-	err := Retry(ctx, func(ctx context.Context) error {
-		return pg.database.QueryRowContext(ctx, queryGetMetric,
-			metric.ID).Scan(&result.ID, &result.MType, &result.Delta, &result.Value)
+	result := metrics.Metrics{Labels: maps.Clone(metric.Labels)}
+	var histogram, set []byte
+	err := pg.retry.Do(ctx, "get_metric", func(ctx context.Context) error {
+		return pg.pool.QueryRow(ctx, queryGetMetric,
+			metric.ID, metrics.CanonicalLabels(metric.Labels)).Scan(&result.ID, &result.MType, &result.Delta, &result.Value, &histogram, &set)
 	})
+	if err == nil {
+		result.Histogram, err = scanHistogram(histogram)
+	}
+	if err == nil {
+		result.Set, err = scanSet(set)
+	}
 
 	if err != nil {
 		ok = false
@@ -207,20 +465,20 @@ func (pg *PgStorage) GetMetricByName(reqCtx context.Context, metric metrics.Metr
 	return &result, ok
 }
 
-func (pg *PgStorage) GetMetrics(reqCtx context.Context) (map[string]any, error) {
-	var rows *sql.Rows
-	result := make(map[string]any)
+func (pg *PgStorage) GetMetrics(reqCtx context.Context) (map[string]metrics.Metrics, error) {
+	var rows pgx.Rows
+	result := make(map[string]metrics.Metrics)
 	queryGetMetrics := `
-		SELECT id, mtype, delta, value 
+		SELECT id, mtype, delta, value, labels, histogram, hll
 		FROM metrics
 		`
 
-	ctx, ctxCancel := context.WithTimeout(reqCtx, 3*time.Second)
+	ctx, ctxCancel := context.WithTimeout(reqCtx, pg.statementTimeout)
 	defer ctxCancel()
 
-	err := Retry(ctx, func(ctx context.Context) error {
+	err := pg.retry.Do(ctx, "get_metrics", func(ctx context.Context) error {
 		var err error
-		rows, err = pg.database.QueryContext(ctx, queryGetMetrics)
+		rows, err = pg.pool.Query(ctx, queryGetMetrics)
 		if err != nil {
 			return err
 		}
@@ -241,9 +499,26 @@ func (pg *PgStorage) GetMetrics(reqCtx context.Context) (map[string]any, error)
 
 	for rows.Next() {
 		var metric metrics.Metrics
-		err = rows.Scan(&metric.ID, &metric.MType, &metric.Delta, &metric.Value)
+		var labels, histogram, set []byte
+		err = rows.Scan(&metric.ID, &metric.MType, &metric.Delta, &metric.Value, &labels, &histogram, &set)
 		if err != nil {
 			pg.logger.Warnw("got error when reading metric")
+			continue
+		}
+		if metric.Histogram, err = scanHistogram(histogram); err != nil {
+			pg.logger.Warnw("got error when reading metric histogram", "id", metric.ID)
+			continue
+		}
+		if metric.Set, err = scanSet(set); err != nil {
+			pg.logger.Warnw("got error when reading metric set", "id", metric.ID)
+			continue
+		}
+		if err = json.Unmarshal(labels, &metric.Labels); err != nil {
+			pg.logger.Warnw("got error when reading metric labels", "id", metric.ID)
+			continue
+		}
+		if len(metric.Labels) == 0 {
+			metric.Labels = nil
 		}
 
 		switch metric.MType {
@@ -252,34 +527,109 @@ func (pg *PgStorage) GetMetrics(reqCtx context.Context) (map[string]any, error)
 			if metric.Value == nil {
 				continue
 			}
-			result[metric.ID] = fmt.Sprintf("%f", *metric.Value)
+			result[metric.Key()] = metric
 		case "counter":
 			// защищаемся от nil dereference
 			if metric.Delta == nil {
 				continue
 			}
-			result[metric.ID] = fmt.Sprintf("%d", *metric.Delta)
+			result[metric.Key()] = metric
+		case "histogram":
+			if metric.Histogram == nil {
+				continue
+			}
+			result[metric.Key()] = metric
+		case "set":
+			if metric.Set == nil {
+				continue
+			}
+			result[metric.Key()] = metric
 		}
 	}
 
-	return result, nil
+	return result, rows.Err()
+}
+
+func (pg *PgStorage) GetHistory(reqCtx context.Context, metric metrics.Metrics, from time.Time, to time.Time) ([]metrics.Sample, error) {
+	var rows pgx.Rows
+	queryGetHistory := `
+		(SELECT ts, id, mtype, delta, value
+		FROM metrics_history
+		WHERE id = $1 AND labels_key = $2 AND mtype = $3 AND ts < $4
+		ORDER BY ts DESC
+		LIMIT 1)
+		UNION ALL
+		(SELECT ts, id, mtype, delta, value
+		FROM metrics_history
+		WHERE id = $1 AND labels_key = $2 AND mtype = $3 AND ts BETWEEN $4 AND $5)
+		ORDER BY ts
+		`
+
+	ctx, ctxCancel := context.WithTimeout(reqCtx, pg.statementTimeout)
+	defer ctxCancel()
+
+	err := pg.retry.Do(ctx, "get_history", func(ctx context.Context) error {
+		var err error
+		rows, err = pg.pool.Query(ctx, queryGetHistory,
+			metric.ID, metrics.CanonicalLabels(metric.Labels), metric.MType, from, to)
+		return err
+	})
+	if err != nil {
+		pg.logger.Warnw("get_history error", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]metrics.Sample, 0)
+	for rows.Next() {
+		var sample metrics.Sample
+		err = rows.Scan(&sample.TS, &sample.ID, &sample.MType, &sample.Delta, &sample.Value)
+		if err != nil {
+			return nil, err
+		}
+		sample.Labels = metric.Labels
+		result = append(result, sample)
+	}
+
+	return result, rows.Err()
+}
+
+func (pg *PgStorage) Compact(reqCtx context.Context, before time.Time) (int64, error) {
+	queryCompact := `DELETE FROM metrics_history WHERE ts < $1`
+
+	ctx, ctxCancel := context.WithTimeout(reqCtx, 30*time.Second)
+	defer ctxCancel()
+
+	var tag pgconn.CommandTag
+	err := pg.retry.Do(ctx, "compact", func(ctx context.Context) error {
+		var err error
+		tag, err = pg.pool.Exec(ctx, queryCompact, before)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (pg *PgStorage) CompactionService(retention int, compactInterval int) error {
+	return compactionLoop(pg, retention, compactInterval, pg.logger)
 }
 
 func (pg *PgStorage) Shutdown() error {
 	pg.logger.Infow("Closing database connection")
-	// pg.ctxCancel()
-	pg.database.Close()
+	pg.pool.Close()
 	return nil
 }
 
 func (pg *PgStorage) PingDatabase(reqCtx context.Context) error {
-	if pg.database == nil {
+	if pg.pool == nil {
 		return errors.New("no database connected")
 	}
 
 	ctx, cancel := context.WithTimeout(reqCtx, 1*time.Second)
 	defer cancel()
-	if err := pg.database.PingContext(ctx); err != nil {
+	if err := pg.pool.Ping(ctx); err != nil {
 		return err
 	}
 
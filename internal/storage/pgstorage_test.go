@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"metralert/internal/metrics"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeBatcher запоминает отправленные пакеты, не выполняя запросы.
+type fakeBatcher struct {
+	batches []*pgx.Batch
+}
+
+type fakeBatchResults struct {
+	pgx.BatchResults
+}
+
+func (fakeBatchResults) Close() error { return nil }
+
+func (f *fakeBatcher) SendBatch(_ context.Context, b *pgx.Batch) pgx.BatchResults {
+	f.batches = append(f.batches, b)
+	return fakeBatchResults{}
+}
+
+func TestSendBatch(t *testing.T) {
+	value := 1.5
+	delta := int64(2)
+	first := metrics.NewHistogram([]float64{1, 5})
+	first.Observe(0.5)
+	second := metrics.NewHistogram([]float64{1, 5})
+	second.Observe(3)
+
+	ms := []pgMetric{
+		{metric: metrics.Metrics{ID: "Alloc", MType: GaugeStr, Value: &value}, labelsJSON: "{}"},
+		{metric: metrics.Metrics{ID: "PollCount", MType: CounterStr, Delta: &delta}, labelsJSON: "{}"},
+		{metric: metrics.Metrics{ID: "Latency", MType: HistogramStr, Histogram: first}, labelsJSON: "{}"},
+		{metric: metrics.Metrics{ID: "Latency", MType: HistogramStr, Histogram: second}, labelsJSON: "{}"},
+	}
+
+	stored := map[string]*pgStored{}
+	var conn fakeBatcher
+	result, err := sendBatch(context.Background(), &conn, ms, stored)
+	require.NoError(t, err)
+
+	require.Len(t, conn.batches, 1, "the whole batch is sent at once")
+	batch := conn.batches[0]
+	require.Equal(t, 4, batch.Len())
+	assert.Equal(t, queryUpsertGauge, batch.QueuedQueries[0].SQL)
+	assert.Equal(t, queryUpsertCounter, batch.QueuedQueries[1].SQL)
+	assert.Equal(t, queryUpsertHistogram, batch.QueuedQueries[2].SQL)
+
+	// обновления одной гистограммы в пакете накапливаются
+	require.Len(t, result, 4)
+	assert.Equal(t, uint64(1), result[2].Histogram.Count)
+	assert.Equal(t, uint64(2), result[3].Histogram.Count)
+	assert.Equal(t, uint64(2), stored[pgRowKey("Latency", "")].histogram.Count)
+	assert.Equal(t, uint64(1), first.Count, "received histogram is not modified")
+}
+
+func TestRejectIncompatible(t *testing.T) {
+	stored := map[string]*pgStored{
+		pgRowKey("Latency", ""): {histogram: metrics.NewHistogram([]float64{1, 5})},
+		pgRowKey("Users", ""):   {set: metrics.NewHyperLogLog(metrics.DefaultPrecision)},
+	}
+	ms := []pgMetric{
+		{metric: metrics.Metrics{ID: "Latency", MType: HistogramStr, Histogram: metrics.NewHistogram([]float64{1, 5})}},
+		{metric: metrics.Metrics{ID: "Latency", MType: HistogramStr, Histogram: metrics.NewHistogram([]float64{2})}},
+		{metric: metrics.Metrics{ID: "Users", MType: SetStr, Set: metrics.NewHyperLogLog(metrics.MinPrecision)}},
+		// новая метрика сохраняется с бакетами первого обновления в пакете
+		{metric: metrics.Metrics{ID: "Size", MType: HistogramStr, Histogram: metrics.NewHistogram([]float64{10})}},
+		{metric: metrics.Metrics{ID: "Size", MType: HistogramStr, Histogram: metrics.NewHistogram([]float64{20})}},
+	}
+
+	result, errs := rejectIncompatible(ms, stored)
+	require.Len(t, result, 2)
+	assert.Equal(t, []float64{1, 5}, result[0].metric.Histogram.Bounds)
+	assert.Equal(t, []float64{10}, result[1].metric.Histogram.Bounds)
+	require.Len(t, errs, 3)
+	for _, err := range errs {
+		assert.ErrorIs(t, err, ErrIncompatible)
+	}
+
+	// несовместимая метрика, не отброшенная заранее, отменяет пакет
+	var conn fakeBatcher
+	_, err := sendBatch(context.Background(), &conn, ms[1:2], stored)
+	require.ErrorIs(t, err, ErrIncompatible)
+	assert.Empty(t, conn.batches)
+}
+
+func TestPgStorage_UpdateBatchMetrics_Invalid(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	pg := &PgStorage{logger: logger.Sugar(), statementTimeout: DefaultStatementTimeout}
+
+	// ошибочные метрики отбрасываются до обращения к базе
+	result, err := pg.UpdateBatchMetrics(context.Background(), []metrics.Metrics{
+		{ID: "Alloc", MType: GaugeStr},
+		{ID: "PollCount", MType: CounterStr},
+		{ID: "Users", MType: SetStr, Set: &metrics.HyperLogLog{Precision: 12}},
+		{ID: "Unknown", MType: "summary"},
+	})
+	assert.Error(t, err)
+	assert.Empty(t, result)
+}
+
+// fakeTx запоминает выполненные запросы, чтение строк завершается ошибкой errFakeQuery.
+type fakeTx struct {
+	pgx.Tx
+	queries []string
+	args    [][]any
+}
+
+var errFakeQuery = errors.New("query is not executed")
+
+func (f *fakeTx) Exec(_ context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	f.queries = append(f.queries, sql)
+	f.args = append(f.args, args)
+	return pgconn.CommandTag{}, nil
+}
+
+func (f *fakeTx) Query(_ context.Context, sql string, args ...any) (pgx.Rows, error) {
+	f.queries = append(f.queries, sql)
+	f.args = append(f.args, args)
+	return nil, errFakeQuery
+}
+
+func TestSelectForUpdate_LocksKeys(t *testing.T) {
+	value := 1.5
+	ms := []pgMetric{
+		{metric: metrics.Metrics{ID: "Alloc", MType: GaugeStr, Value: &value}},
+		{metric: metrics.Metrics{ID: "Latency", MType: HistogramStr, Histogram: metrics.NewHistogram([]float64{1})}, labelsKey: "route=/"},
+		{metric: metrics.Metrics{ID: "Users", MType: SetStr, Set: metrics.NewHyperLogLog(metrics.MinPrecision)}},
+	}
+
+	var tx fakeTx
+	_, err := selectForUpdate(context.Background(), &tx, ms)
+	require.ErrorIs(t, err, errFakeQuery)
+
+	// ключи блокируются до чтения строк, даже если строк еще нет
+	require.Equal(t, []string{queryLockKeys, querySelectForUpdate}, tx.queries)
+	assert.Equal(t, []any{[]string{"Latency", "Users"}, []string{"route=/", ""}, mergeLockClass}, tx.args[0])
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.uber.org/zap"
+)
+
+// RetryPolicy - политика повторного выполнения операций с базой данных.
+// Повторяются только временные ошибки (см. IsRetryable), пауза между попытками
+// растет экспоненциально со случайным разбросом и не выходит за срок контекста.
+type RetryPolicy struct {
+	// MaxAttempts - максимальное количество попыток, включая первую.
+	MaxAttempts int
+	// BaseDelay - пауза перед второй попыткой, каждая следующая пауза вдвое длиннее.
+	BaseDelay time.Duration
+	// MaxDelay - ограничение паузы между попытками.
+	MaxDelay time.Duration
+	Logger   *zap.SugaredLogger
+}
+
+// DefaultRetryPolicy возвращает политику с 4 попытками и паузами от 200 мс до 2 с.
+func DefaultRetryPolicy(logger *zap.SugaredLogger) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   200 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		Logger:      logger,
+	}
+}
+
+// Do выполняет fn, повторяя ее при временных ошибках.
+// Постоянные ошибки возвращаются сразу без обертки, чтобы их можно было проверить errors.Is.
+// Если пауза перед следующей попыткой не укладывается в срок ctx или ctx отменен,
+// возвращается последняя ошибка fn. op - название операции для лога.
+func (p RetryPolicy) Do(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			if attempt > 1 {
+				p.Logger.Infow("Database operation succeeded after retries", "op", op, "attempts", attempt)
+			}
+			return nil
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			p.Logger.Warnw("Database operation failed", "op", op, "attempts", attempt, "error", err)
+			return fmt.Errorf("%s failed after %d attempts: %w", op, attempt, err)
+		}
+
+		delay := p.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			p.Logger.Warnw("Database operation failed, no time left to retry", "op", op, "attempts", attempt, "error", err)
+			return fmt.Errorf("%s failed after %d attempts: %w", op, attempt, err)
+		}
+		p.Logger.Infow("Retrying database operation", "op", op, "attempt", attempt, "delay", delay, "error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s failed after %d attempts: %w", op, attempt, err)
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff возвращает паузу после попытки attempt: BaseDelay*2^(attempt-1), не больше MaxDelay,
+// со случайным разбросом в пределах второй половины интервала, чтобы серверы не повторяли запросы одновременно.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.MaxDelay
+	if shift := attempt - 1; shift < 32 && p.BaseDelay<<shift < p.MaxDelay {
+		delay = p.BaseDelay << shift
+	}
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return half + rand.N(delay-half)
+}
+
+// IsRetryable сообщает, имеет ли смысл повторить операцию после ошибки err.
+// Повторяются ошибки соединения (SQLSTATE класса 08, остановка и запуск сервера 57P01-57P03,
+// ошибки установки соединения и обрывы, после которых запрос гарантированно не был отправлен)
+// и конфликты сериализации (40001, 40P01). Нарушения ограничений, отсутствие строк,
+// отмена контекста и прочие ошибки не повторяются.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, "08"):
+			return true
+		case pgErr.Code == "40001", pgErr.Code == "40P01":
+			return true
+		case pgErr.Code == "57P01", pgErr.Code == "57P02", pgErr.Code == "57P03":
+			return true
+		}
+		return false
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	// обрыв соединения после отправки запроса не повторяется: запрос мог выполниться,
+	// и повторное прибавление счетчика исказило бы значение
+	return pgconn.SafeToRetry(err)
+}
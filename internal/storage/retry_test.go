@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection failure", err: &pgconn.PgError{Code: "08006"}, want: true},
+		{name: "wrapped connection failure", err: fmt.Errorf("query: %w", &pgconn.PgError{Code: "08001"}), want: true},
+		{name: "serialization failure", err: &pgconn.PgError{Code: "40001"}, want: true},
+		{name: "deadlock", err: &pgconn.PgError{Code: "40P01"}, want: true},
+		{name: "admin shutdown", err: &pgconn.PgError{Code: "57P01"}, want: true},
+		{name: "unique violation", err: &pgconn.PgError{Code: "23505"}, want: false},
+		{name: "query canceled", err: &pgconn.PgError{Code: "57014"}, want: false},
+		{name: "no rows", err: pgx.ErrNoRows, want: false},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "deadline", err: fmt.Errorf("query: %w", context.DeadlineExceeded), want: false},
+		{name: "other", err: errors.New("boom"), want: false},
+		{name: "nil", err: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsRetryable(tt.err))
+		})
+	}
+}
+
+func testRetryPolicy(t *testing.T) RetryPolicy {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    4 * time.Millisecond,
+		Logger:      logger.Sugar(),
+	}
+}
+
+func TestRetryPolicy_Do(t *testing.T) {
+	retryable := &pgconn.PgError{Code: "40001"}
+
+	t.Run("permanent error", func(t *testing.T) {
+		permanent := &pgconn.PgError{Code: "23505"}
+		calls := 0
+		err := testRetryPolicy(t).Do(context.Background(), "test", func(context.Context) error {
+			calls++
+			return permanent
+		})
+		assert.Equal(t, 1, calls)
+		assert.Same(t, permanent, err)
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		calls := 0
+		err := testRetryPolicy(t).Do(context.Background(), "test", func(context.Context) error {
+			calls++
+			return retryable
+		})
+		assert.Equal(t, 3, calls)
+		require.ErrorIs(t, err, retryable)
+		assert.Contains(t, err.Error(), "after 3 attempts")
+	})
+
+	t.Run("success after retry", func(t *testing.T) {
+		calls := 0
+		err := testRetryPolicy(t).Do(context.Background(), "test", func(context.Context) error {
+			calls++
+			if calls < 2 {
+				return retryable
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("deadline too short", func(t *testing.T) {
+		policy := testRetryPolicy(t)
+		policy.BaseDelay = time.Second
+		policy.MaxDelay = time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		calls := 0
+		start := time.Now()
+		err := policy.Do(ctx, "test", func(context.Context) error {
+			calls++
+			return retryable
+		})
+		assert.Equal(t, 1, calls)
+		require.ErrorIs(t, err, retryable)
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		policy := testRetryPolicy(t)
+		policy.BaseDelay = time.Minute
+		policy.MaxDelay = time.Minute
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := 0
+		err := policy.Do(ctx, "test", func(context.Context) error {
+			calls++
+			cancel()
+			return retryable
+		})
+		assert.Equal(t, 1, calls)
+		require.ErrorIs(t, err, retryable)
+	})
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt := 1; attempt <= 40; attempt++ {
+		want := policy.MaxDelay
+		if attempt < 5 {
+			want = policy.BaseDelay << (attempt - 1)
+		}
+		for range 20 {
+			delay := policy.backoff(attempt)
+			assert.GreaterOrEqual(t, delay, want/2, "attempt %d", attempt)
+			assert.Less(t, delay, want, "attempt %d", attempt)
+		}
+	}
+}
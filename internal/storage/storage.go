@@ -2,26 +2,91 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"metralert/internal/metrics"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// ErrIncompatible возвращается, если гистограмму или набросок множества нельзя объединить с сохраненным:
+// различаются границы бакетов или точность. Такое обновление отклоняется, сохраненное значение не меняется.
+var ErrIncompatible = errors.New("incompatible with the stored metric")
+
 type StorageInterface interface {
 	UpdateMetric(ctx context.Context, metric metrics.Metrics) (*metrics.Metrics, error)
 	UpdateBatchMetrics(ctx context.Context, metrics []metrics.Metrics) ([]metrics.Metrics, error)
 	GetMetricByName(ctx context.Context, metric metrics.Metrics) (*metrics.Metrics, bool)
-	GetMetrics(ctx context.Context) (map[string]any, error)
+	GetMetrics(ctx context.Context) (map[string]metrics.Metrics, error)
+	// GetHistory возвращает сэмплы метрики за [from, to] по возрастанию времени,
+	// первым идет последний сэмпл до from, если он есть: от него считается прирост счетчика.
+	GetHistory(ctx context.Context, metric metrics.Metrics, from time.Time, to time.Time) ([]metrics.Sample, error)
+	Compact(ctx context.Context, before time.Time) (int64, error)
+	CompactionService(retention int, compactInterval int) error
 	PingDatabase(ctx context.Context) error
 	BackupService(storeInterval int) error
 	Shutdown() error
 }
 
-func NewStorage(fileStoragePath string, recover bool, databaseAddress string, logger *zap.SugaredLogger) StorageInterface {
+func NewStorage(fileStoragePath string, recover bool, databaseAddress string, pgOptions PgOptions, logger *zap.SugaredLogger) StorageInterface {
 	switch databaseAddress {
 	case "":
 		return NewMemstorage(fileStoragePath, recover, logger)
 	default:
-		return NewPgStorage(databaseAddress, logger)
+		return NewPgStorage(databaseAddress, pgOptions, logger)
+	}
+}
+
+// validateMetric проверяет, что значение метрики задано для ее типа.
+func validateMetric(metric metrics.Metrics) error {
+	switch metric.MType {
+	case GaugeStr:
+		if metric.Value == nil {
+			return errors.New("invalid Value")
+		}
+	case CounterStr:
+		if metric.Delta == nil {
+			return errors.New("invalid Delta")
+		}
+	case HistogramStr:
+		if metric.Histogram == nil {
+			return errors.New("invalid Histogram")
+		}
+		return metric.Histogram.Validate()
+	case SetStr:
+		if metric.Set == nil {
+			return errors.New("invalid Set")
+		}
+		return metric.Set.Validate()
+	}
+	return nil
+}
+
+// histogramMismatch возвращает ErrIncompatible для гистограммы id с другими границами бакетов.
+func histogramMismatch(id string) error {
+	return fmt.Errorf("histogram %s: bucket bounds differ from the stored ones: %w", id, ErrIncompatible)
+}
+
+// setMismatch возвращает ErrIncompatible для множества id с другой точностью.
+func setMismatch(id string) error {
+	return fmt.Errorf("set %s: precision differs from the stored one: %w", id, ErrIncompatible)
+}
+
+// compactionLoop периодически удаляет из истории сэмплы старше retention секунд
+func compactionLoop(s StorageInterface, retention int, compactInterval int, logger *zap.SugaredLogger) error {
+	if retention <= 0 || compactInterval <= 0 {
+		return nil
+	}
+
+	for {
+		time.Sleep(time.Duration(compactInterval) * time.Second)
+		before := time.Now().Add(-time.Duration(retention) * time.Second)
+		removed, err := s.Compact(context.Background(), before)
+		if err != nil {
+			logger.Warnw("History compaction failed", "error", err)
+			continue
+		}
+		logger.Infow("History compacted", "removed", removed, "before", before)
 	}
 }